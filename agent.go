@@ -3,12 +3,18 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand/v2"
 	"net/http"
 	"os"
 	"runtime"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -16,51 +22,275 @@ import (
 )
 
 const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 64 * 1024
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = (pongWait * 9) / 10
 
 	// Reconnection backoff
 	minReconnectDelay = 5 * time.Second
 	maxReconnectDelay = 60 * time.Second
+
+	// How often drain progress is checked during shutdown
+	drainPollInterval = 100 * time.Millisecond
+
+	// Open file descriptors, as a fraction of the soft limit, at which the
+	// agent warns and at which it refuses new fd-consuming requests
+	fdWarnRatio    = 0.8
+	fdRejectRatio  = 0.9
+	fdWarnInterval = time.Minute
+
+	// Wall clock steps larger than this are logged
+	clockJumpThreshold = 5 * time.Second
+
+	// Time a file operation past Config.OpTimeout is given to notice its
+	// cancelled context before it is answered as timed out
+	opTimeoutGrace = 2 * time.Second
+
+	// File operations refused while this many timed out ones are still
+	// running, bounding the goroutines a stuck filesystem can pile up
+	maxStuckOps = 16
 )
 
+// ErrAgentDraining is returned for new requests received during shutdown
+var ErrAgentDraining = errors.New("agent is shutting down")
+
+// ErrRemoteRestartDisabled is reported when the server requests a restart
+// without Config.AllowRemoteRestart
+var ErrRemoteRestartDisabled = errors.New("remote restart is disabled on this agent")
+
+// ErrReadOnly is returned for mutating requests when Config.ReadOnly is set
+var ErrReadOnly = errors.New("agent is read-only")
+
+// ErrShellArgsRefused is returned for a spawn_pty carrying its own shell
+// arguments while the agent may not run arbitrary commands, since arguments
+// like "-c" would run one
+var ErrShellArgsRefused = errors.New("shell arguments from the server are refused while command execution is disabled or the agent is read-only")
+
+// ErrResourceLimit is returned for requests refused because the agent is
+// close to its open file limit
+var ErrResourceLimit = errors.New("resource limit: too many open files")
+
+// ErrStuckOps is returned for file operations refused because too many
+// earlier ones timed out and have not finished
+var ErrStuckOps = errors.New("too many timed out file operations still running")
+
+// ErrDeviceIDConflict is returned when the server reports that another
+// agent is registered with the same device ID
+var ErrDeviceIDConflict = errors.New("device ID already in use")
+
+// errReconnectRequested ends the main loop when the server asks for a reconnect
+var errReconnectRequested = errors.New("server requested reconnect")
+
+// messageHandlers routes each request type to its handler. It is the single
+// list of supported types, also reported in response to capabilities, and
+// is filled in by init since handleCapabilities refers back to it.
+var messageHandlers map[string]func(a *Agent, msg *Message) error
+
+func init() {
+	messageHandlers = map[string]func(a *Agent, msg *Message) error{
+		MsgTypeRegisterAck:  (*Agent).handleRegisterAck,
+		MsgTypeSpawnPty:     (*Agent).handleSpawnPty,
+		MsgTypePtyInput:     (*Agent).handlePtyInput,
+		MsgTypePtyResize:    (*Agent).handlePtyResize,
+		MsgTypeClosePty:     (*Agent).handleClosePty,
+		MsgTypeExecCmd:      (*Agent).handleExecCmd,
+		MsgTypeCmdStdin:     (*Agent).handleCmdStdin,
+		MsgTypeConfirmCmd:   (*Agent).handleConfirmCmd,
+		MsgTypeListSessions: (*Agent).handleListSessions,
+		MsgTypePruneSession: (*Agent).handlePruneSession,
+		MsgTypeGetEnv:       (*Agent).handleGetEnv,
+		MsgTypePing:         (*Agent).handlePing,
+		MsgTypeReconnect:    (*Agent).handleReconnect,
+		MsgTypeCapabilities: (*Agent).handleCapabilities,
+		MsgTypeVersionCheck: (*Agent).handleVersionCheck,
+		MsgTypeWhoAmI:       (*Agent).handleWhoAmI,
+		MsgTypeRestart:      (*Agent).handleRestart,
+
+		// Processes
+		MsgTypeListProcesses: (*Agent).handleListProcesses,
+		MsgTypeKillProcess:   (*Agent).handleKillProcess,
+		MsgTypeServiceStatus: (*Agent).handleServiceStatus,
+
+		// File operations
+		MsgTypeListFiles:    (*Agent).handleListFiles,
+		MsgTypeDownloadFile: (*Agent).handleDownloadFile,
+		MsgTypeUploadFile:   (*Agent).handleUploadFile,
+		MsgTypeUploadBegin:  (*Agent).handleUploadBegin,
+		MsgTypeUploadChunk:  (*Agent).handleUploadChunk,
+		MsgTypeUploadCommit: (*Agent).handleUploadCommit,
+		MsgTypeCreateFile:   (*Agent).handleCreateFile,
+		MsgTypeCreateFolder: (*Agent).handleCreateFolder,
+		MsgTypeDeleteItem:   (*Agent).handleDeleteItem,
+		MsgTypeDeleteItems:  (*Agent).handleDeleteItems,
+		MsgTypeCopyItem:     (*Agent).handleCopyItem,
+		MsgTypeMoveItem:     (*Agent).handleMoveItem,
+		MsgTypeRenameItem:   (*Agent).handleRenameItem,
+		MsgTypeChmod:        (*Agent).handleChmod,
+
+		// Streaming file operations
+		MsgTypeStreamFileInfo: (*Agent).handleStreamFileInfo,
+		MsgTypeStreamChunk:    (*Agent).handleStreamChunk,
+
+		MsgTypeCompressFiles:    (*Agent).handleCompressFiles,
+		MsgTypeGetDirStats:      (*Agent).handleGetDirStats,
+		MsgTypeDownloadMatching: (*Agent).handleDownloadMatching,
+		MsgTypePatchFile:        (*Agent).handlePatchFile,
+		MsgTypeFileQuickStats:   (*Agent).handleFileQuickStats,
+		MsgTypeListArchive:      (*Agent).handleListArchive,
+		MsgTypeReadFiles:        (*Agent).handleReadFiles,
+		MsgTypeDiskUsage:        (*Agent).handleDiskUsage,
+	}
+}
+
+// messageCapabilities maps request types to the local capability gating them
+var messageCapabilities = map[string]string{
+	MsgTypeSpawnPty:         CapabilityPty,
+	MsgTypeExecCmd:          CapabilityExec,
+	MsgTypeCmdStdin:         CapabilityExec,
+	MsgTypeConfirmCmd:       CapabilityExec,
+	MsgTypeListProcesses:    CapabilityExec,
+	MsgTypeKillProcess:      CapabilityExec,
+	MsgTypeServiceStatus:    CapabilityExec,
+	MsgTypeListFiles:        CapabilityFileOps,
+	MsgTypeDownloadFile:     CapabilityFileOps,
+	MsgTypeUploadFile:       CapabilityFileOps,
+	MsgTypeUploadBegin:      CapabilityFileOps,
+	MsgTypeUploadChunk:      CapabilityFileOps,
+	MsgTypeUploadCommit:     CapabilityFileOps,
+	MsgTypeCreateFile:       CapabilityFileOps,
+	MsgTypeCreateFolder:     CapabilityFileOps,
+	MsgTypeDeleteItem:       CapabilityFileOps,
+	MsgTypeDeleteItems:      CapabilityFileOps,
+	MsgTypeCopyItem:         CapabilityFileOps,
+	MsgTypeMoveItem:         CapabilityFileOps,
+	MsgTypeRenameItem:       CapabilityFileOps,
+	MsgTypeChmod:            CapabilityFileOps,
+	MsgTypeStreamFileInfo:   CapabilityFileOps,
+	MsgTypeStreamChunk:      CapabilityFileOps,
+	MsgTypeGetDirStats:      CapabilityFileOps,
+	MsgTypeCompressFiles:    CapabilityCompress,
+	MsgTypeDownloadMatching: CapabilityCompress,
+	MsgTypePatchFile:        CapabilityFileOps,
+	MsgTypeFileQuickStats:   CapabilityFileOps,
+	MsgTypeListArchive:      CapabilityFileOps,
+	MsgTypeReadFiles:        CapabilityFileOps,
+	MsgTypeDiskUsage:        CapabilityFileOps,
+}
+
+// mutatingTypes are refused in read-only mode. Commands and terminal input
+// are included since their effects cannot be known in advance; terminals
+// can still be spawned to view output.
+var mutatingTypes = map[string]bool{
+	MsgTypeExecCmd:       true,
+	MsgTypeCmdStdin:      true,
+	MsgTypeConfirmCmd:    true,
+	MsgTypeKillProcess:   true,
+	MsgTypePtyInput:      true,
+	MsgTypeUploadFile:    true,
+	MsgTypeUploadBegin:   true,
+	MsgTypeUploadChunk:   true,
+	MsgTypeUploadCommit:  true,
+	MsgTypeCreateFile:    true,
+	MsgTypeCreateFolder:  true,
+	MsgTypeDeleteItem:    true,
+	MsgTypeDeleteItems:   true,
+	MsgTypeCopyItem:      true,
+	MsgTypeMoveItem:      true,
+	MsgTypeRenameItem:    true,
+	MsgTypeChmod:         true,
+	MsgTypeCompressFiles: true,
+	MsgTypePatchFile:     true,
+}
+
+// drainAllowedTypes are message types still handled while draining, since
+// they only act on sessions or transfers that are already in progress
+var drainAllowedTypes = map[string]bool{
+	MsgTypeRegisterAck:  true,
+	MsgTypePtyInput:     true,
+	MsgTypeCmdStdin:     true,
+	MsgTypePtyResize:    true,
+	MsgTypeClosePty:     true,
+	MsgTypePing:         true,
+	MsgTypeListSessions: true,
+	MsgTypeCapabilities: true,
+	MsgTypePruneSession: true,
+	MsgTypeStreamChunk:  true,
+}
+
+// sharedIDTypes carry the RequestID of an earlier request, so a timeout on
+// one of them must not mark that ID as answered and swallow the responses
+// still due for it
+var sharedIDTypes = map[string]bool{
+	MsgTypeUploadBegin:  true,
+	MsgTypeUploadChunk:  true,
+	MsgTypeUploadCommit: true,
+	MsgTypeStreamChunk:  true,
+}
+
 // Agent is the main termix agent that manages WebSocket connection
 type Agent struct {
 	config    *Config
+	ctx       context.Context // cancelled when the agent is stopped
+	cancel    context.CancelFunc
 	conn      *websocket.Conn
-	connMu    sync.Mutex
+	writer    *connWriter // all writes to conn go through it
+	connMu    sync.Mutex  // guards conn and writer
 	sessions  *SessionManager
 	cmdExec   *CommandExecutor
 	fileOps   *FileOps
-	startTime time.Time
+	startTime time.Time // carries a monotonic reading, see elapsed
 	stopChan  chan struct{}
+	stopOnce  sync.Once
+	restart   atomic.Bool // re-execute the binary once stopped, see RestartRequested
 	wg        sync.WaitGroup
+	ops       sync.WaitGroup // in-flight file operations
+	draining  atomic.Bool
+	lastSent  atomic.Int64 // elapsed nanos at the last outbound message
+	fdWarned  atomic.Int64 // elapsed nanos at the last open file warning
+	wallSkew  atomic.Int64 // wall clock minus monotonic time since start, see checkClockJump
+	opCounts  opCounter    // high-frequency requests handled since the last summary
+	stuckOps  atomic.Int32 // file operations still running after timing out
+
+	scope  atomic.Pointer[pathScope] // file operation scope set at registration, nil = unrestricted
+	mounts *pathScope                // file operation scope from Config.AllowedMounts, nil = unrestricted
+
+	registered   atomic.Bool  // connected and acknowledged by the server
+	registeredAt atomic.Int64 // elapsed nanos when registration was last acknowledged
+	healthServer *http.Server
 }
 
 // NewAgent creates a new agent instance
 func NewAgent(config *Config) *Agent {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	a := &Agent{
 		config:    config,
+		ctx:       ctx,
+		cancel:    cancel,
 		startTime: time.Now(),
 		stopChan:  make(chan struct{}),
+		mounts:    newPathScope(config.AllowedMounts),
 	}
 
 	// Initialize session manager with callbacks
 	a.sessions = NewSessionManager(
+		config,
 		a.sendPtyData,
-		a.sendPtyExit,
+		a.sendPtyExitMsg,
+		a.sendPtySpawned,
+		a.emitEvent,
 	)
 
 	// Initialize command executor with callbacks
 	a.cmdExec = NewCommandExecutor(
+		config,
 		a.sendCmdResult,
 		a.sendCmdError,
+		a.sendCmdConfirmRequired,
 	)
 
 	// Initialize file operations handler
-	a.fileOps = NewFileOps(func(msgType string, data interface{}) {
+	a.fileOps = NewFileOps(config, func(msgType string, data interface{}) {
 		if err := a.sendMessage(msgType, data); err != nil {
 			log.Error().Err(err).Str("type", msgType).Msg("failed to send file operation result")
 		}
@@ -73,6 +303,12 @@ func NewAgent(config *Config) *Agent {
 func (a *Agent) Run() error {
 	reconnectDelay := minReconnectDelay
 
+	if a.config.HealthAddr != "" {
+		a.startHealthServer()
+	}
+
+	go a.opSummaryLoop()
+
 	for {
 		select {
 		case <-a.stopChan:
@@ -80,7 +316,16 @@ func (a *Agent) Run() error {
 		default:
 		}
 
+		if a.draining.Load() {
+			return nil
+		}
+
 		err := a.connect()
+		if errors.Is(err, ErrFingerprintChanged) {
+			// Never retry against a server whose identity changed
+			log.Error().Err(err).Msg("refusing to connect; add --accept-fingerprint once to trust the new certificate if the change is expected")
+			return err
+		}
 		if err != nil {
 			log.Error().Err(err).Msg("connection failed")
 
@@ -89,58 +334,226 @@ func (a *Agent) Run() error {
 			}
 
 			log.Info().Dur("delay", reconnectDelay).Msg("reconnecting")
-			time.Sleep(reconnectDelay)
-
-			// Exponential backoff
-			reconnectDelay = reconnectDelay * 2
-			if reconnectDelay > maxReconnectDelay {
-				reconnectDelay = maxReconnectDelay
+			if !a.sleep(reconnectDelay) {
+				return nil
 			}
+
+			reconnectDelay = nextReconnectDelay(reconnectDelay)
 			continue
 		}
 
-		// Reset backoff on successful connection
-		reconnectDelay = minReconnectDelay
-
 		// Run main loop
 		err = a.mainLoop()
-		if err != nil {
+
+		// Only a connection that stayed registered for a while resets the
+		// backoff, so a server that crashes right after accepting is not
+		// retried at the minimum delay forever
+		stable := a.registered.Load() &&
+			a.elapsed()-time.Duration(a.registeredAt.Load()) >= a.config.BackoffResetAfter
+		if stable {
+			reconnectDelay = minReconnectDelay
+		}
+
+		reconnectNow := errors.Is(err, errReconnectRequested)
+		if reconnectNow {
+			log.Info().Msg("reconnecting at server request")
+		} else if err != nil {
 			log.Error().Err(err).Msg("connection lost")
 		}
 
 		// Cleanup
+		a.registered.Store(false)
 		a.connMu.Lock()
-		if a.conn != nil {
-			a.conn.Close()
-			a.conn = nil
+		if a.writer != nil {
+			a.writer.close()
+			a.writer = nil
 		}
+		a.conn = nil
 		a.connMu.Unlock()
 
 		a.sessions.CloseAllSessions()
 
+		// Retrying with the same ID would loop forever
+		if errors.Is(err, ErrDeviceIDConflict) {
+			return err
+		}
+
+		if reconnectNow {
+			a.reloadToken()
+			continue
+		}
+
 		if !a.config.Reconnect {
 			return err
 		}
 
-		log.Info().Dur("delay", reconnectDelay).Msg("reconnecting")
-		time.Sleep(reconnectDelay)
+		log.Info().Dur("delay", reconnectDelay).Bool("stable", stable).Msg("reconnecting")
+		if !a.sleep(reconnectDelay) {
+			return nil
+		}
+		if !stable {
+			reconnectDelay = nextReconnectDelay(reconnectDelay)
+		}
+	}
+}
+
+// nextReconnectDelay doubles the reconnect delay up to maxReconnectDelay
+func nextReconnectDelay(delay time.Duration) time.Duration {
+	return min(delay*2, maxReconnectDelay)
+}
+
+// sleep waits for the given duration, returning false if the agent was
+// stopped in the meantime
+func (a *Agent) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-a.ctx.Done():
+		return false
 	}
 }
 
-// Stop gracefully stops the agent
+// Stop gracefully stops the agent. New requests are refused while in-flight
+// operations and sessions are given ShutdownGracePeriod to finish, after
+// which remaining sessions are closed with a pty_exit sent for each.
 func (a *Agent) Stop() {
+	a.stopOnce.Do(a.stop)
+}
+
+// RestartRequested reports whether the agent stopped so that its binary can
+// be executed again, e.g. after installing an update
+func (a *Agent) RestartRequested() bool {
+	return a.restart.Load()
+}
+
+func (a *Agent) stop() {
+	a.draining.Store(true)
+
+	if grace := a.config.ShutdownGracePeriod; grace > 0 {
+		log.Info().Dur("grace", grace).Msg("draining in-flight operations")
+		if !a.drain(grace) {
+			log.Warn().
+				Int("sessions", a.sessions.SessionCount()).
+				Msg("shutdown grace period expired, forcing close")
+		}
+	}
+
+	// Interrupt anything still running (dials, commands, file walks)
+	a.cancel()
+
 	close(a.stopChan)
-	a.sessions.CloseAllSessions()
+	a.sessions.ExitAllSessions()
+	a.sessions.Stop()
 
 	a.connMu.Lock()
-	if a.conn != nil {
-		a.conn.WriteMessage(websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-		a.conn.Close()
-	}
+	writer := a.writer
 	a.connMu.Unlock()
+	if writer != nil {
+		writer.send(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), false)
+		writer.close()
+	}
 
 	a.wg.Wait()
+	a.stopHealthServer()
+
+	// Uploads cannot resume and archives cannot be streamed once the
+	// process exits
+	a.fileOps.Cleanup()
+}
+
+// drain waits until in-flight operations and sessions have finished or the
+// timeout elapses. Returns true if everything finished in time.
+func (a *Agent) drain(timeout time.Duration) bool {
+	opsDone := make(chan struct{})
+	go func() {
+		a.ops.Wait()
+		a.cmdExec.Wait()
+		close(opsDone)
+	}()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	finished := false
+	for {
+		select {
+		case <-opsDone:
+			finished = true
+			opsDone = nil
+		case <-ticker.C:
+		case <-deadline.C:
+			return false
+		}
+
+		if finished && a.sessions.SessionCount() == 0 {
+			return true
+		}
+	}
+}
+
+// runOp runs a file operation in its own goroutine, tracked for draining
+func (a *Agent) runOp(msgType, requestID string, fn func(ctx context.Context)) {
+	ctx, cancel := a.ctx, context.CancelFunc(func() {})
+	if a.config.OpTimeout > 0 {
+		ctx, cancel = context.WithTimeout(a.ctx, a.config.OpTimeout)
+	}
+
+	done := make(chan struct{})
+	a.ops.Add(1)
+	go func() {
+		defer a.ops.Done()
+		defer cancel()
+		defer close(done)
+		fn(ctx)
+	}()
+
+	if a.config.OpTimeout > 0 {
+		go a.watchOp(ctx, msgType, requestID, done)
+	}
+}
+
+// watchOp reports an operation that outlives Config.OpTimeout as timed out.
+// Operations that honour their context get opTimeoutGrace to report the
+// timeout themselves; the rest, typically blocked in a system call, are
+// answered here and counted as stuck until they return; their own result is
+// then dropped by sendFinal.
+func (a *Agent) watchOp(ctx context.Context, msgType, requestID string, done <-chan struct{}) {
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		return // agent stopping
+	}
+
+	grace := time.NewTimer(opTimeoutGrace)
+	defer grace.Stop()
+	select {
+	case <-done:
+		return
+	case <-grace.C:
+	}
+
+	log.Warn().Str("requestId", requestID).Dur("timeout", a.config.OpTimeout).Msg("file operation timed out")
+	if requestID != "" {
+		if !sharedIDTypes[msgType] {
+			a.fileOps.completed.begin(requestID)
+		}
+		a.fileOps.sendError(requestID, 504, fmt.Sprintf("Operation timed out after %s", a.config.OpTimeout))
+	}
+
+	a.stuckOps.Add(1)
+	<-done
+	a.stuckOps.Add(-1)
+	log.Info().Str("requestId", requestID).Msg("timed out file operation finished")
 }
 
 // connect establishes WebSocket connection
@@ -150,12 +563,15 @@ func (a *Agent) connect() error {
 
 	dialer := websocket.Dialer{
 		HandshakeTimeout: 10 * time.Second,
+		Subprotocols:     a.config.Subprotocols,
 	}
 
 	if a.config.SSL {
-		dialer.TLSClientConfig = &tls.Config{
-			InsecureSkipVerify: a.config.Insecure,
+		tlsConfig, err := buildTLSConfig(a.config.TLSOptions)
+		if err != nil {
+			return err
 		}
+		dialer.TLSClientConfig = tlsConfig
 	}
 
 	header := http.Header{}
@@ -163,18 +579,30 @@ func (a *Agent) connect() error {
 		header.Set("Authorization", "Bearer "+a.config.Token)
 	}
 
-	conn, _, err := dialer.Dial(url, header)
+	conn, _, err := dialer.DialContext(a.ctx, url, header)
 	if err != nil {
 		return err
 	}
 
+	if err := checkSubprotocol(conn, a.config.Subprotocols); err != nil {
+		conn.Close()
+		return err
+	}
+
+	a.recordFingerprint(peerFingerprint(conn))
+
 	a.connMu.Lock()
 	a.conn = conn
+	a.writer = newConnWriter(conn, func() { a.lastSent.Store(int64(a.elapsed())) })
 	a.connMu.Unlock()
 
 	// Send registration
 	if err := a.sendRegistration(); err != nil {
-		conn.Close()
+		a.connMu.Lock()
+		a.writer.close()
+		a.writer = nil
+		a.conn = nil
+		a.connMu.Unlock()
 		return err
 	}
 
@@ -182,35 +610,88 @@ func (a *Agent) connect() error {
 	return nil
 }
 
+// recordFingerprint trusts the server certificate on first use, or replaces
+// the trusted fingerprint when the operator accepted a changed certificate.
+// Nothing is recorded unless fingerprint verification is enabled.
+func (a *Agent) recordFingerprint(fingerprint string) {
+	if !a.config.VerifyFingerprint || fingerprint == "" || fingerprint == a.config.TrustedFingerprint {
+		return
+	}
+	if a.config.TrustedFingerprint != "" && !a.config.AcceptFingerprint {
+		return
+	}
+
+	if err := SaveServerFingerprint(fingerprint); err != nil {
+		log.Warn().Err(err).Msg("failed to store server certificate fingerprint")
+	} else {
+		log.Info().Str("fingerprint", fingerprint).Msg("trusting server certificate")
+	}
+
+	// Verify against the new fingerprint on later reconnects
+	a.config.TrustedFingerprint = fingerprint
+	a.config.AcceptFingerprint = false
+}
+
+// checkSubprotocol verifies the server selected one of the offered subprotocols
+func checkSubprotocol(conn *websocket.Conn, offered []string) error {
+	if len(offered) == 0 {
+		return nil
+	}
+
+	selected := conn.Subprotocol()
+	for _, p := range offered {
+		if p == selected {
+			log.Debug().Str("subprotocol", selected).Msg("subprotocol negotiated")
+			return nil
+		}
+	}
+
+	return fmt.Errorf("server selected subprotocol %q, expected one of %v", selected, offered)
+}
+
 // sendRegistration sends the initial registration message
 func (a *Agent) sendRegistration() error {
-	hostname, _ := os.Hostname()
+	return a.sendMessage(MsgTypeRegister, newRegisterData(a.config.DeviceID, a.config.Token, a.config.Labels))
+}
 
-	data := RegisterData{
-		DeviceID:  a.config.DeviceID,
-		Token:     a.config.Token,
-		Hostname:  hostname,
-		Platform:  Platform(),
-		OS:        OSInfo(),
-		Arch:      Arch(),
-		GoVersion: runtime.Version(),
+// newRegisterData describes this host for the register message
+func newRegisterData(deviceID, token string, labels map[string]string) RegisterData {
+	hostname, _ := os.Hostname()
+	workingDir, _ := os.Getwd()
+	homeDir, _ := os.UserHomeDir()
+
+	return RegisterData{
+		DeviceID:   deviceID,
+		Token:      token,
+		Hostname:   hostname,
+		Platform:   Platform(),
+		OS:         OSInfo(),
+		Arch:       Arch(),
+		GoVersion:  runtime.Version(),
+		WorkingDir: workingDir,
+		HomeDir:    homeDir,
+		Interfaces: NetInterfaces(),
+		Labels:     labels,
 	}
-
-	return a.sendMessage(MsgTypeRegister, data)
 }
 
 // mainLoop handles message reading and heartbeats
 func (a *Agent) mainLoop() error {
-	a.conn.SetReadLimit(maxMessageSize)
+	// The hard limit is for data messages; readMessage enforces the
+	// smaller one for everything else
+	a.conn.SetReadLimit(a.config.DataMaxSize)
 	a.conn.SetReadDeadline(time.Now().Add(pongWait))
 	a.conn.SetPongHandler(func(string) error {
 		a.conn.SetReadDeadline(time.Now().Add(pongWait))
 		return nil
 	})
 
-	// Start heartbeat goroutine
+	// Start heartbeat goroutine, stopped when this connection ends
+	connDone := make(chan struct{})
+	defer close(connDone)
+
 	a.wg.Add(1)
-	go a.heartbeatLoop()
+	go a.heartbeatLoop(a.conn, connDone)
 
 	for {
 		select {
@@ -219,52 +700,155 @@ func (a *Agent) mainLoop() error {
 		default:
 		}
 
-		_, message, err := a.conn.ReadMessage()
+		message, err := a.readMessage(a.conn)
 		if err != nil {
 			return err
 		}
 
 		if err := a.handleMessage(message); err != nil {
+			if errors.Is(err, errReconnectRequested) || errors.Is(err, ErrDeviceIDConflict) {
+				return err
+			}
 			log.Error().Err(err).Msg("failed to handle message")
 		}
 	}
 }
 
-// heartbeatLoop sends periodic heartbeats
-func (a *Agent) heartbeatLoop() {
+// heartbeatLoop sends periodic heartbeats until the agent stops or connDone
+// is closed. A failed write closes conn so that mainLoop's read fails and
+// the agent reconnects, rather than waiting for the read deadline on a
+// connection that may be half open.
+func (a *Agent) heartbeatLoop(conn *websocket.Conn, connDone <-chan struct{}) {
 	defer a.wg.Done()
 
-	ticker := time.NewTicker(time.Duration(a.config.Heartbeat) * time.Second)
-	defer ticker.Stop()
+	fail := func(err error, msg string) {
+		log.Error().Err(err).Msg(msg + ", closing connection")
+		conn.Close()
+	}
+
+	interval := time.Duration(a.config.Heartbeat) * time.Second
+
+	// Stagger the first heartbeat so a fleet reconnecting together spreads out
+	heartbeat := time.NewTimer(rand.N(interval))
+	defer heartbeat.Stop()
 
 	pingTicker := time.NewTicker(pingPeriod)
 	defer pingTicker.Stop()
 
+	// Some proxies ignore ping frames and drop connections that carry no
+	// data, so optionally send a heartbeat after a period of outbound silence
+	keepaliveInterval := a.config.KeepaliveInterval
+	var keepalive *time.Timer
+	var keepaliveC <-chan time.Time
+	if keepaliveInterval > 0 {
+		keepalive = time.NewTimer(keepaliveInterval)
+		defer keepalive.Stop()
+		keepaliveC = keepalive.C
+	}
+
 	for {
 		select {
 		case <-a.stopChan:
 			return
-		case <-ticker.C:
-			uptime := int64(time.Since(a.startTime).Seconds())
-			if err := a.sendMessage(MsgTypeHeartbeat, HeartbeatData{Uptime: uptime}); err != nil {
-				log.Error().Err(err).Msg("failed to send heartbeat")
+		case <-connDone:
+			return
+		case <-heartbeat.C:
+			if err := a.sendHeartbeat(); err != nil {
+				fail(err, "failed to send heartbeat")
 				return
 			}
-		case <-pingTicker.C:
-			a.connMu.Lock()
-			if a.conn != nil {
-				a.conn.SetWriteDeadline(time.Now().Add(writeWait))
-				if err := a.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-					a.connMu.Unlock()
-					log.Error().Err(err).Msg("failed to send ping")
+			heartbeat.Reset(jitter(interval, a.config.HeartbeatJitter))
+		case <-keepaliveC:
+			idle := a.elapsed() - time.Duration(a.lastSent.Load())
+			if idle >= keepaliveInterval {
+				if err := a.sendHeartbeat(); err != nil {
+					fail(err, "failed to send keepalive")
 					return
 				}
+				idle = 0
+			}
+			keepalive.Reset(keepaliveInterval - idle)
+		case <-pingTicker.C:
+			if err := a.writeFrame(websocket.PingMessage, nil, false); err != nil {
+				fail(err, "failed to send ping")
+				return
 			}
-			a.connMu.Unlock()
 		}
 	}
 }
 
+// sendHeartbeat reports the agent uptime and descriptor usage to the server
+func (a *Agent) sendHeartbeat() error {
+	a.checkClockJump()
+
+	data := HeartbeatData{Uptime: int64(a.elapsed().Seconds())}
+	if open, limit, ok := fdUsage(); ok {
+		data.OpenFDs = open
+		data.FDLimit = limit
+	}
+	return a.sendMessage(MsgTypeHeartbeat, data)
+}
+
+// elapsed returns the time since the agent started on the monotonic clock,
+// so uptime and intervals are unaffected when NTP steps the wall clock
+func (a *Agent) elapsed() time.Duration {
+	return time.Since(a.startTime)
+}
+
+// checkClockJump warns when the wall clock was stepped since the last call.
+// Uptime is unaffected but log timestamps jump with the wall clock.
+func (a *Agent) checkClockJump() {
+	now := time.Now()
+	a.noteWallSkew(now.Round(0).Sub(a.startTime.Round(0)) - now.Sub(a.startTime))
+}
+
+// noteWallSkew records skew, the wall clock minus the monotonic time since
+// start, and returns how far it moved if that counts as a jump (else 0)
+func (a *Agent) noteWallSkew(skew time.Duration) time.Duration {
+	jump := skew - time.Duration(a.wallSkew.Swap(int64(skew)))
+	if jump <= clockJumpThreshold && jump >= -clockJumpThreshold {
+		return 0
+	}
+	log.Warn().Dur("jump", jump).Msg("system clock jumped, log timestamps are discontinuous")
+	a.emitEvent(EventCategorySystem, EventSeverityInfo, "system clock jumped",
+		map[string]any{"jumpSeconds": jump.Seconds()})
+	return jump
+}
+
+// checkFDs returns ErrResourceLimit when open file descriptors are close to
+// the soft limit, warning (rate limited) as usage approaches it
+func (a *Agent) checkFDs() error {
+	open, limit, ok := fdUsage()
+	if !ok || limit == 0 {
+		return nil
+	}
+
+	usage := float64(open) / float64(limit)
+	if usage < fdWarnRatio {
+		return nil
+	}
+
+	now := a.elapsed()
+	if last := a.fdWarned.Load(); (last == 0 || now-time.Duration(last) >= fdWarnInterval) && a.fdWarned.CompareAndSwap(last, int64(now)) {
+		log.Warn().Int("open", open).Uint64("limit", limit).Msg("approaching open file limit")
+		a.emitEvent(EventCategorySystem, EventSeverityWarning, "approaching open file limit",
+			map[string]any{"open": open, "limit": limit})
+	}
+
+	if usage >= fdRejectRatio {
+		return ErrResourceLimit
+	}
+	return nil
+}
+
+// jitter returns d randomly adjusted by up to ±j, keeping the average at d
+func jitter(d, j time.Duration) time.Duration {
+	if j <= 0 {
+		return d
+	}
+	return d - j + rand.N(2*j+1)
+}
+
 // handleMessage dispatches incoming messages
 func (a *Agent) handleMessage(data []byte) error {
 	msg, err := ParseMessage(data)
@@ -274,61 +858,131 @@ func (a *Agent) handleMessage(data []byte) error {
 
 	log.Debug().Str("type", msg.Type).Msg("received message")
 
-	switch msg.Type {
-	case MsgTypeRegisterAck:
-		return a.handleRegisterAck(msg)
-	case MsgTypeSpawnPty:
-		return a.handleSpawnPty(msg)
-	case MsgTypePtyInput:
-		return a.handlePtyInput(msg)
-	case MsgTypePtyResize:
-		return a.handlePtyResize(msg)
-	case MsgTypeClosePty:
-		return a.handleClosePty(msg)
-	case MsgTypeExecCmd:
-		return a.handleExecCmd(msg)
-	case MsgTypePing:
-		return a.sendMessage(MsgTypePong, nil)
-
-	// File operations
-	case MsgTypeListFiles:
-		return a.handleListFiles(msg)
-	case MsgTypeDownloadFile:
-		return a.handleDownloadFile(msg)
-	case MsgTypeUploadFile:
-		return a.handleUploadFile(msg)
-	case MsgTypeCreateFile:
-		return a.handleCreateFile(msg)
-	case MsgTypeCreateFolder:
-		return a.handleCreateFolder(msg)
-	case MsgTypeDeleteItem:
-		return a.handleDeleteItem(msg)
-	case MsgTypeCopyItem:
-		return a.handleCopyItem(msg)
-	case MsgTypeMoveItem:
-		return a.handleMoveItem(msg)
-	case MsgTypeRenameItem:
-		return a.handleRenameItem(msg)
-
-	// Streaming file operations
-	case MsgTypeStreamFileInfo:
-		return a.handleStreamFileInfo(msg)
-	case MsgTypeStreamChunk:
-		return a.handleStreamChunk(msg)
-
-	case MsgTypeCompressFiles:
-		return a.handleCompressFiles(msg)
-
-	case MsgTypeGetDirStats:
-		return a.handleGetDirStats(msg)
+	if a.draining.Load() && !drainAllowedTypes[msg.Type] {
+		log.Warn().Str("type", msg.Type).Msg("refusing request while draining")
+		a.rejectRequest(msg, 503, CmdErrSysErr, ErrAgentDraining.Error())
+		return ErrAgentDraining
+	}
 
-	default:
-		log.Warn().Str("type", msg.Type).Msg("unknown message type")
+	if capability, ok := messageCapabilities[msg.Type]; ok && !a.config.CapabilityEnabled(capability) {
+		message := capability + " disabled locally"
+		log.Warn().Str("type", msg.Type).Msg(message)
+		a.rejectRequest(msg, 403, CmdErrPermit, message)
+		return nil
+	}
+
+	if a.config.ReadOnly && mutatingTypes[msg.Type] {
+		log.Warn().Str("type", msg.Type).Msg("refusing mutating request in read-only mode")
+		a.rejectRequest(msg, 403, CmdErrPermit, ErrReadOnly.Error())
+		return nil
+	}
+
+	if capability := messageCapabilities[msg.Type]; capability == CapabilityFileOps || capability == CapabilityCompress {
+		if err := a.checkScope(msg); errors.Is(err, ErrBadPayload) {
+			a.rejectRequest(msg, 400, CmdErrBadRequest, fmt.Sprintf("bad request: %v", err))
+			return nil
+		} else if err != nil {
+			a.rejectRequest(msg, 403, CmdErrPermit, err.Error())
+			return nil
+		}
+	}
+
+	if capability := messageCapabilities[msg.Type]; capability == CapabilityFileOps || capability == CapabilityCompress {
+		if a.stuckOps.Load() >= maxStuckOps {
+			a.rejectRequest(msg, 503, CmdErrNoMem, ErrStuckOps.Error())
+			return ErrStuckOps
+		}
+	}
+
+	// Every capability-gated request opens files, processes or terminals
+	if _, ok := messageCapabilities[msg.Type]; ok {
+		if err := a.checkFDs(); err != nil {
+			a.rejectRequest(msg, 503, CmdErrNoMem, err.Error())
+			return err
+		}
+	}
+
+	err = a.dispatch(msg)
+	if errors.Is(err, ErrBadPayload) {
+		a.rejectRequest(msg, 400, CmdErrBadRequest, fmt.Sprintf("bad request: %v", err))
+	}
+	return err
+}
+
+// checkScope verifies that every path of a file operation is inside both
+// the server's scope for this connection and the local --allowed-mount trees
+func (a *Agent) checkScope(msg *Message) error {
+	scope := a.scope.Load()
+	if scope == nil && a.mounts == nil {
+		return nil
 	}
 
+	paths, err := requestPaths(msg)
+	if err != nil {
+		return err
+	}
+
+	// Archives the agent created for this server are always reachable
+	paths = slices.DeleteFunc(paths, a.fileOps.archives.owns)
+
+	if path, ok := allowsAll(paths, scope, a.mounts); !ok {
+		log.Warn().Str("type", msg.Type).Str("path", path).Msg("refusing request outside the allowed paths")
+		return ErrOutOfScope
+	}
 	return nil
 }
 
+// dispatch routes a message to its handler
+func (a *Agent) dispatch(msg *Message) error {
+	handler, ok := messageHandlers[msg.Type]
+	if !ok {
+		log.Warn().Str("type", msg.Type).Msg("unknown message type")
+		return nil
+	}
+
+	if highFrequencyTypes[msg.Type] {
+		a.opCounts.add(msg.Type)
+	}
+	return handler(a, msg)
+}
+
+// rejectRequest answers a request that will not be handled, using whatever
+// correlation id can be recovered from it. fileCode is used for requestId
+// based requests, cmdCode for token based command requests.
+func (a *Agent) rejectRequest(msg *Message, fileCode, cmdCode int, message string) {
+	a.rejectCorrelated(msg.Type, ParseCorrelation(msg), fileCode, cmdCode, message)
+}
+
+// rejectCorrelated is rejectRequest for a message of msgType whose
+// correlation ids are already known
+func (a *Agent) rejectCorrelated(msgType string, corr Correlation, fileCode, cmdCode int, message string) {
+	switch {
+	case msgType == MsgTypeSpawnPty && corr.SessionID != "":
+		a.sendPtyExit(corr.SessionID, -1, PtyExitReasonError)
+	case corr.Token != "":
+		a.sendCmdError(corr.Token, cmdCode, message)
+	case corr.RequestID != "":
+		err := a.sendMessage(MsgTypeFileError, FileErrorData{
+			RequestID: corr.RequestID,
+			Code:      fileCode,
+			Message:   message,
+		})
+		if err != nil {
+			log.Error().Err(err).Str("requestId", corr.RequestID).Msg("failed to send request rejection")
+		}
+	case corr.SessionID != "":
+		err := a.sendMessage(MsgTypePtyError, PtyErrorMsg{
+			SessionID: corr.SessionID,
+			Message:   message,
+		})
+		if err != nil {
+			log.Error().Err(err).Str("sessionId", corr.SessionID).Msg("failed to send request rejection")
+		}
+	default:
+		log.Warn().Str("type", msgType).Msg("cannot reject request without a correlation id")
+	}
+}
+
 // --- Message handlers ---
 
 func (a *Agent) handleRegisterAck(msg *Message) error {
@@ -337,31 +991,82 @@ func (a *Agent) handleRegisterAck(msg *Message) error {
 		return err
 	}
 
+	if !data.Success && data.Reason == RegisterFailDeviceIDConflict {
+		return a.handleDeviceIDConflict()
+	}
+
 	if !data.Success {
 		log.Error().Str("message", data.Message).Msg("registration failed")
 	} else {
-		log.Info().Msg("registration acknowledged")
+		// Each connection negotiates its own scope
+		a.scope.Store(newPathScope(data.AllowedPaths))
+		a.registeredAt.Store(int64(a.elapsed()))
+		a.registered.Store(true)
+		log.Info().Strs("allowedPaths", data.AllowedPaths).Msg("registration acknowledged")
 	}
 
 	return nil
 }
 
+// handleDeviceIDConflict either gives up with an actionable error or, with
+// AutoUniqueDeviceID, switches to a suffixed device ID and reconnects
+func (a *Agent) handleDeviceIDConflict() error {
+	if !a.config.AutoUniqueDeviceID {
+		return fmt.Errorf("%w: %q is registered by another agent (e.g. a cloned image); set a unique --id",
+			ErrDeviceIDConflict, a.config.DeviceID)
+	}
+
+	deviceID := fmt.Sprintf("%s-%04x", a.config.DeviceID, rand.N(0x10000))
+	log.Warn().
+		Str("deviceId", a.config.DeviceID).
+		Str("newDeviceId", deviceID).
+		Msg("device ID already in use, switching to a unique ID")
+
+	// Keep the new ID across restarts
+	err := UpdateCredentials(func(creds *StoredCredentials) {
+		creds.DeviceID = deviceID
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to store new device ID")
+	}
+
+	a.config.DeviceID = deviceID
+	return errReconnectRequested
+}
+
 func (a *Agent) handleSpawnPty(msg *Message) error {
 	data, err := UnmarshalData[SpawnPtyData](msg)
 	if err != nil {
 		return err
 	}
 
-	log.Info().
+	a.opLog(msg.Type).
 		Str("sessionId", data.SessionID).
 		Uint16("cols", data.Cols).
 		Uint16("rows", data.Rows).
 		Msg("spawn PTY request")
 
-	if err := a.sessions.SpawnSession(data.SessionID, data.Cols, data.Rows, data.Username); err != nil {
+	idleTimeout := time.Duration(data.IdleTimeout) * time.Second
+	if data.ShellArgs != nil && (a.config.ReadOnly || !a.config.CapabilityEnabled(CapabilityExec)) {
+		err = ErrShellArgsRefused
+	} else {
+		err = a.sessions.SpawnSession(data.SessionID, data.Cols, data.Rows, data.Username, idleTimeout, data.ShellArgs, data.Compress)
+	}
+	if err != nil {
 		log.Error().Err(err).Str("sessionId", data.SessionID).Msg("failed to spawn PTY")
+		reason := PtyExitReasonError
+		if errors.Is(err, ErrNoPty) {
+			reason = PtyExitReasonNoPty
+			a.emitEvent(EventCategorySystem, EventSeverityCritical, "host has run out of pseudo-terminals",
+				map[string]any{"sessionId": data.SessionID})
+		}
 		// Notify server of failure
-		a.sendPtyExit(data.SessionID, -1)
+		a.sendPtyExitMsg(&PtyExitMsg{
+			SessionID: data.SessionID,
+			Code:      -1,
+			Reason:    reason,
+			Message:   err.Error(),
+		})
 	}
 
 	return nil
@@ -378,7 +1083,20 @@ func (a *Agent) handlePtyInput(msg *Message) error {
 		return err
 	}
 
-	return session.WriteBase64(data.Data)
+	if err := session.WriteBase64(data.Data); err != nil {
+		if !errors.Is(err, ErrInputDecode) {
+			return err
+		}
+
+		// Let the client know its keystrokes were dropped so it can resend
+		log.Error().Err(err).Str("sessionId", data.SessionID).Msg("dropping malformed PTY input")
+		return a.sendMessage(MsgTypePtyError, PtyErrorMsg{
+			SessionID: data.SessionID,
+			Message:   err.Error(),
+		})
+	}
+
+	return nil
 }
 
 func (a *Agent) handlePtyResize(msg *Message) error {
@@ -410,16 +1128,319 @@ func (a *Agent) handleExecCmd(msg *Message) error {
 		return err
 	}
 
-	log.Info().
+	a.opLog(msg.Type).
 		Str("token", data.Token).
 		Str("command", data.Command).
 		Strs("args", data.Args).
 		Msg("exec command request")
 
-	a.cmdExec.Execute(data)
+	// The output file is written by the agent, so it is bound by the same
+	// scope and mounts as file operations
+	if data.OutputToFile != "" {
+		if path, ok := allowsAll([]string{data.OutputToFile}, a.scope.Load(), a.mounts); !ok {
+			log.Warn().Str("token", data.Token).Str("path", path).Msg("refusing command output file outside the allowed paths")
+			a.sendCmdError(data.Token, CmdErrPermit, ErrOutOfScope.Error())
+			return nil
+		}
+	}
+
+	a.cmdExec.Execute(a.ctx, data)
+	return nil
+}
+
+func (a *Agent) handleConfirmCmd(msg *Message) error {
+	data, err := UnmarshalData[ConfirmCmdData](msg)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Str("token", data.Token).Msg("confirm command request")
+	if err := a.cmdExec.Confirm(a.ctx, data.Token, data.Nonce); err != nil {
+		log.Warn().Err(err).Str("token", data.Token).Msg("command confirmation rejected")
+		a.sendCmdError(data.Token, CmdErrPermit, err.Error())
+	}
+	return nil
+}
+
+func (a *Agent) handleCmdStdin(msg *Message) error {
+	data, err := UnmarshalData[CmdStdinData](msg)
+	if err != nil {
+		return err
+	}
+
+	input, err := base64.StdEncoding.DecodeString(data.Data)
+	if err != nil {
+		// Dropping a frame would corrupt the stream, so stop the command
+		log.Error().Err(err).Str("token", data.Token).Msg("aborting command after malformed stdin")
+		data.Abort = true
+	}
+
+	err = a.cmdExec.Stdin(data.Token, input, data.EOF, data.Abort)
+	if errors.Is(err, ErrNoStdinStream) {
+		// The command may just have finished; its result was already sent
+		log.Debug().Str("token", data.Token).Msg("dropping stdin for command that is not running")
+		return nil
+	}
+	return err
+}
+
+func (a *Agent) handleListSessions(msg *Message) error {
+	data, err := UnmarshalData[ListSessionsData](msg)
+	if err != nil {
+		return err
+	}
+
+	return a.sendMessage(MsgTypeSessionList, SessionListData{
+		RequestID: data.RequestID,
+		Sessions:  a.sessions.ListSessions(),
+	})
+}
+
+func (a *Agent) handlePruneSession(msg *Message) error {
+	data, err := UnmarshalData[PruneSessionData](msg)
+	if err != nil {
+		return err
+	}
+
+	a.opLog(msg.Type).Str("sessionId", data.SessionID).Msg("prune session request")
+
+	result := PruneSessionResultData{
+		RequestID: data.RequestID,
+		SessionID: data.SessionID,
+		Success:   true,
+	}
+
+	if err := a.sessions.PruneSession(data.SessionID); err != nil {
+		result.Success = false
+		result.Message = err.Error()
+	}
+
+	return a.sendMessage(MsgTypePruneSessionResult, result)
+}
+
+// handleReconnect acks a reconnect request and lets in-flight operations
+// finish (up to ShutdownGracePeriod) before ending the connection. No new
+// requests are read meanwhile. Terminal sessions are closed with a pty_exit,
+// as on any disconnect.
+func (a *Agent) handleReconnect(msg *Message) error {
+	data, err := UnmarshalData[ReconnectData](msg)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("reason", data.Reason).Msg("reconnect request")
+
+	if err := a.sendMessage(MsgTypeReconnectAck, ReconnectAckData{RequestID: data.RequestID}); err != nil {
+		log.Error().Err(err).Msg("failed to send reconnect ack")
+	}
+
+	if !a.waitForOps(a.config.ShutdownGracePeriod) {
+		log.Warn().Msg("operations still running, reconnecting anyway")
+	}
+	a.sessions.ExitAllSessions()
+
+	return errReconnectRequested
+}
+
+// handleRestart stops the agent so that main re-executes the binary. The
+// new process reads its configuration and credentials afresh.
+func (a *Agent) handleRestart(msg *Message) error {
+	// The data is optional
+	data := &RestartData{}
+	if len(msg.Data) > 0 {
+		var err error
+		if data, err = UnmarshalData[RestartData](msg); err != nil {
+			return err
+		}
+	}
+
+	if !a.config.AllowRemoteRestart {
+		log.Warn().Str("reason", data.Reason).Msg("refusing remote restart")
+		return a.sendMessage(MsgTypeRestartAck, RestartAckData{
+			RequestID: data.RequestID,
+			Error:     ErrRemoteRestartDisabled.Error(),
+		})
+	}
+
+	log.Info().Str("reason", data.Reason).Msg("restart request")
+
+	if err := a.sendMessage(MsgTypeRestartAck, RestartAckData{RequestID: data.RequestID, Accepted: true}); err != nil {
+		log.Error().Err(err).Msg("failed to send restart ack")
+	}
+
+	// Stop blocks while draining, which needs the read loop to keep running
+	a.restart.Store(true)
+	go a.Stop()
+	return nil
+}
+
+// handleListProcesses reports the host's processes
+func (a *Agent) handleListProcesses(msg *Message) error {
+	// The data is optional
+	data := &ListProcessesData{}
+	if len(msg.Data) > 0 {
+		var err error
+		if data, err = UnmarshalData[ListProcessesData](msg); err != nil {
+			return err
+		}
+	}
+
+	a.opLog(msg.Type).Int("limit", data.Limit).Msg("list processes request")
+
+	a.runOp(msg.Type, data.RequestID, func(ctx context.Context) {
+		a.fileOps.sendFinal(data.RequestID, MsgTypeProcessList, processList(ctx, data))
+	})
+	return nil
+}
+
+// handleKillProcess sends a signal to a process. The operating system
+// decides whether the agent's user may signal it.
+func (a *Agent) handleKillProcess(msg *Message) error {
+	data, err := UnmarshalData[KillProcessData](msg)
+	if err != nil {
+		return err
+	}
+
+	a.opLog(msg.Type).Int("pid", data.PID).Str("signal", data.Signal).Msg("kill process request")
+
+	result := KillProcessResultData{RequestID: data.RequestID, PID: data.PID}
+	if err := killProcess(data.PID, data.Signal); err != nil {
+		log.Warn().Err(err).Int("pid", data.PID).Msg("failed to signal process")
+		result.Error = err.Error()
+	} else {
+		result.Success = true
+	}
+	return a.sendMessage(MsgTypeKillProcessResult, result)
+}
+
+// handleServiceStatus reports the state of a systemd unit
+func (a *Agent) handleServiceStatus(msg *Message) error {
+	data, err := UnmarshalData[ServiceStatusData](msg)
+	if err != nil {
+		return err
+	}
+
+	a.opLog(msg.Type).Str("service", data.ServiceName).Msg("service status request")
+
+	a.runOp(msg.Type, data.RequestID, func(ctx context.Context) {
+		a.fileOps.sendFinal(data.RequestID, MsgTypeServiceStatusResult, serviceStatus(ctx, data))
+	})
 	return nil
 }
 
+// waitForOps waits until in-flight file operations and commands have
+// finished or the timeout elapses. Returns true if everything finished.
+func (a *Agent) waitForOps(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		a.ops.Wait()
+		a.cmdExec.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// reloadToken picks up an agent token rotated in the credential store
+func (a *Agent) reloadToken() {
+	creds, err := LoadCredentials()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to reload credentials, keeping current token")
+		return
+	}
+	if creds.AgentToken != a.config.Token {
+		log.Info().Msg("using updated agent token")
+		a.config.Token = creds.AgentToken
+	}
+}
+
+func (a *Agent) handleGetEnv(msg *Message) error {
+	data, err := UnmarshalData[GetEnvData](msg)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Strs("names", data.Names).Msg("get env request")
+
+	return a.sendMessage(MsgTypeEnvValues, EnvValuesData{
+		RequestID: data.RequestID,
+		Vars:      LookupEnv(a.config.EnvAllowlist, data.Names),
+	})
+}
+
+// handleWhoAmI reports the user and groups the agent runs as
+func (a *Agent) handleWhoAmI(msg *Message) error {
+	// The request ID is optional, so the data may be omitted entirely
+	data := &WhoAmIData{}
+	if len(msg.Data) > 0 {
+		var err error
+		if data, err = UnmarshalData[WhoAmIData](msg); err != nil {
+			return err
+		}
+	}
+
+	log.Debug().Msg("whoami request")
+
+	result := whoAmI()
+	result.RequestID = data.RequestID
+	return a.sendMessage(MsgTypeWhoAmIResult, result)
+}
+
+func (a *Agent) handlePing(msg *Message) error {
+	return a.sendMessage(MsgTypePong, nil)
+}
+
+// handleCapabilities reports every message type the agent handles, which of
+// them are currently refused, and the locally enabled features
+func (a *Agent) handleCapabilities(msg *Message) error {
+	// The request ID is optional, so the data may be omitted entirely
+	data := &CapabilitiesData{}
+	if len(msg.Data) > 0 {
+		var err error
+		if data, err = UnmarshalData[CapabilitiesData](msg); err != nil {
+			return err
+		}
+	}
+
+	log.Debug().Msg("capabilities request")
+
+	result := CapabilitiesResultData{
+		RequestID:       data.RequestID,
+		ProtocolVersion: ProtocolVersion,
+		AgentVersion:    version,
+		MessageTypes:    make([]string, 0, len(messageHandlers)),
+		Features: map[string]bool{
+			FeatureTerminal: a.config.CapabilityEnabled(CapabilityPty),
+			FeatureExec:     a.config.CapabilityEnabled(CapabilityExec),
+			FeatureFileOps:  a.config.CapabilityEnabled(CapabilityFileOps),
+			FeatureCompress: a.config.CapabilityEnabled(CapabilityCompress),
+			FeatureReadOnly: a.config.ReadOnly,
+
+			FeaturePtyCompression: a.config.PtyCompression && a.config.CapabilityEnabled(CapabilityPty),
+		},
+	}
+	for msgType := range messageHandlers {
+		result.MessageTypes = append(result.MessageTypes, msgType)
+
+		capability, gated := messageCapabilities[msgType]
+		if (gated && !a.config.CapabilityEnabled(capability)) || (a.config.ReadOnly && mutatingTypes[msgType]) {
+			result.Disabled = append(result.Disabled, msgType)
+		}
+	}
+	sort.Strings(result.MessageTypes)
+	sort.Strings(result.Disabled)
+
+	return a.sendMessage(MsgTypeCapabilitiesResult, result)
+}
+
 // --- Outgoing message helpers ---
 
 func (a *Agent) sendMessage(msgType string, data interface{}) error {
@@ -428,21 +1449,27 @@ func (a *Agent) sendMessage(msgType string, data interface{}) error {
 		return err
 	}
 
+	return a.writeFrame(websocket.TextMessage, msg, bulkTypes[msgType])
+}
+
+// writeFrame hands a frame to the current connection's writer and waits
+// for it to be written
+func (a *Agent) writeFrame(kind int, data []byte, bulk bool) error {
 	a.connMu.Lock()
-	defer a.connMu.Unlock()
+	writer := a.writer
+	a.connMu.Unlock()
 
-	if a.conn == nil {
+	if writer == nil {
 		return websocket.ErrCloseSent
 	}
-
-	a.conn.SetWriteDeadline(time.Now().Add(writeWait))
-	return a.conn.WriteMessage(websocket.TextMessage, msg)
+	return writer.send(kind, data, bulk)
 }
 
-func (a *Agent) sendPtyData(sessionID string, data []byte) {
+func (a *Agent) sendPtyData(sessionID string, data []byte, compressed bool) {
 	msg := PtyDataMsg{
-		SessionID: sessionID,
-		Data:      base64.StdEncoding.EncodeToString(data),
+		SessionID:  sessionID,
+		Data:       base64.StdEncoding.EncodeToString(data),
+		Compressed: compressed,
 	}
 
 	if err := a.sendMessage(MsgTypePtyData, msg); err != nil {
@@ -450,14 +1477,23 @@ func (a *Agent) sendPtyData(sessionID string, data []byte) {
 	}
 }
 
-func (a *Agent) sendPtyExit(sessionID string, code int) {
-	msg := PtyExitMsg{
+func (a *Agent) sendPtyExit(sessionID string, code int, reason string) {
+	a.sendPtyExitMsg(&PtyExitMsg{
 		SessionID: sessionID,
 		Code:      code,
+		Reason:    reason,
+	})
+}
+
+func (a *Agent) sendPtySpawned(spawned *PtySpawnedData) {
+	if err := a.sendMessage(MsgTypePtySpawned, spawned); err != nil {
+		log.Error().Err(err).Str("sessionId", spawned.SessionID).Msg("failed to send PTY spawned")
 	}
+}
 
+func (a *Agent) sendPtyExitMsg(msg *PtyExitMsg) {
 	if err := a.sendMessage(MsgTypePtyExit, msg); err != nil {
-		log.Error().Err(err).Str("sessionId", sessionID).Msg("failed to send PTY exit")
+		log.Error().Err(err).Str("sessionId", msg.SessionID).Msg("failed to send PTY exit")
 	}
 }
 
@@ -479,6 +1515,12 @@ func (a *Agent) sendCmdError(token string, code int, message string) {
 	}
 }
 
+func (a *Agent) sendCmdConfirmRequired(confirm *CmdConfirmRequiredData) {
+	if err := a.sendMessage(MsgTypeCmdConfirmRequired, confirm); err != nil {
+		log.Error().Err(err).Str("token", confirm.Token).Msg("failed to send command confirmation request")
+	}
+}
+
 // --- File operation handlers ---
 
 func (a *Agent) handleListFiles(msg *Message) error {
@@ -487,8 +1529,8 @@ func (a *Agent) handleListFiles(msg *Message) error {
 		return err
 	}
 
-	log.Info().Str("path", data.Path).Msg("list files request")
-	go a.fileOps.ListFiles(data)
+	a.opLog(msg.Type).Str("path", data.Path).Msg("list files request")
+	a.runOp(msg.Type, data.RequestID, func(ctx context.Context) { a.fileOps.ListFiles(ctx, data) })
 	return nil
 }
 
@@ -498,8 +1540,8 @@ func (a *Agent) handleDownloadFile(msg *Message) error {
 		return err
 	}
 
-	log.Info().Str("path", data.Path).Msg("download file request")
-	go a.fileOps.DownloadFile(data)
+	a.opLog(msg.Type).Str("path", data.Path).Msg("download file request")
+	a.runOp(msg.Type, data.RequestID, func(ctx context.Context) { a.fileOps.DownloadFile(ctx, data) })
 	return nil
 }
 
@@ -509,8 +1551,52 @@ func (a *Agent) handleUploadFile(msg *Message) error {
 		return err
 	}
 
-	log.Info().Str("path", data.Path).Str("fileName", data.FileName).Msg("upload file request")
-	go a.fileOps.UploadFile(data)
+	a.opLog(msg.Type).Str("path", data.Path).Str("fileName", data.FileName).Msg("upload file request")
+	a.runOp(msg.Type, data.RequestID, func(context.Context) { a.fileOps.UploadFile(data) })
+	return nil
+}
+
+func (a *Agent) handleUploadBegin(msg *Message) error {
+	data, err := UnmarshalData[UploadBeginData](msg)
+	if err != nil {
+		return err
+	}
+
+	a.opLog(msg.Type).
+		Str("path", data.Path).
+		Str("fileName", data.FileName).
+		Int64("size", data.Size).
+		Msg("upload begin request")
+	a.runOp(msg.Type, data.RequestID, func(context.Context) { a.fileOps.UploadBegin(data) })
+	return nil
+}
+
+func (a *Agent) handleUploadChunk(msg *Message) error {
+	data, err := UnmarshalData[UploadChunkData](msg)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Str("requestId", data.RequestID).Int64("offset", data.Offset).Msg("upload chunk request")
+	// Chunks are written in the order they arrived, even though each runs
+	// in its own goroutine
+	wait, leave := a.fileOps.chunkWrites.join(data.RequestID)
+	a.runOp(msg.Type, data.RequestID, func(context.Context) {
+		defer leave()
+		wait()
+		a.fileOps.UploadChunk(data)
+	})
+	return nil
+}
+
+func (a *Agent) handleUploadCommit(msg *Message) error {
+	data, err := UnmarshalData[UploadCommitData](msg)
+	if err != nil {
+		return err
+	}
+
+	a.opLog(msg.Type).Str("requestId", data.RequestID).Msg("upload commit request")
+	a.runOp(msg.Type, data.RequestID, func(context.Context) { a.fileOps.UploadCommit(data) })
 	return nil
 }
 
@@ -520,8 +1606,8 @@ func (a *Agent) handleCreateFile(msg *Message) error {
 		return err
 	}
 
-	log.Info().Str("path", data.Path).Str("fileName", data.FileName).Msg("create file request")
-	go a.fileOps.CreateFile(data)
+	a.opLog(msg.Type).Str("path", data.Path).Str("fileName", data.FileName).Msg("create file request")
+	a.runOp(msg.Type, data.RequestID, func(context.Context) { a.fileOps.CreateFile(data) })
 	return nil
 }
 
@@ -531,8 +1617,8 @@ func (a *Agent) handleCreateFolder(msg *Message) error {
 		return err
 	}
 
-	log.Info().Str("path", data.Path).Str("folderName", data.FolderName).Msg("create folder request")
-	go a.fileOps.CreateFolder(data)
+	a.opLog(msg.Type).Str("path", data.Path).Str("folderName", data.FolderName).Msg("create folder request")
+	a.runOp(msg.Type, data.RequestID, func(context.Context) { a.fileOps.CreateFolder(data) })
 	return nil
 }
 
@@ -542,8 +1628,19 @@ func (a *Agent) handleDeleteItem(msg *Message) error {
 		return err
 	}
 
-	log.Info().Str("path", data.Path).Bool("isDirectory", data.IsDirectory).Msg("delete item request")
-	go a.fileOps.DeleteItem(data)
+	a.opLog(msg.Type).Str("path", data.Path).Bool("isDirectory", data.IsDirectory).Msg("delete item request")
+	a.runOp(msg.Type, data.RequestID, func(context.Context) { a.fileOps.DeleteItem(data) })
+	return nil
+}
+
+func (a *Agent) handleDeleteItems(msg *Message) error {
+	data, err := UnmarshalData[DeleteItemsData](msg)
+	if err != nil {
+		return err
+	}
+
+	a.opLog(msg.Type).Int("count", len(data.Paths)).Msg("delete items request")
+	a.runOp(msg.Type, data.RequestID, func(ctx context.Context) { a.fileOps.DeleteItems(ctx, data) })
 	return nil
 }
 
@@ -553,8 +1650,8 @@ func (a *Agent) handleCopyItem(msg *Message) error {
 		return err
 	}
 
-	log.Info().Str("source", data.SourcePath).Str("target", data.TargetDir).Msg("copy item request")
-	go a.fileOps.CopyItem(data)
+	a.opLog(msg.Type).Str("source", data.SourcePath).Str("target", data.TargetDir).Msg("copy item request")
+	a.runOp(msg.Type, data.RequestID, func(ctx context.Context) { a.fileOps.CopyItem(ctx, data) })
 	return nil
 }
 
@@ -564,8 +1661,8 @@ func (a *Agent) handleMoveItem(msg *Message) error {
 		return err
 	}
 
-	log.Info().Str("source", data.SourcePath).Str("target", data.TargetPath).Msg("move item request")
-	go a.fileOps.MoveItem(data)
+	a.opLog(msg.Type).Str("source", data.SourcePath).Str("target", data.TargetPath).Msg("move item request")
+	a.runOp(msg.Type, data.RequestID, func(ctx context.Context) { a.fileOps.MoveItem(ctx, data) })
 	return nil
 }
 
@@ -575,8 +1672,19 @@ func (a *Agent) handleRenameItem(msg *Message) error {
 		return err
 	}
 
-	log.Info().Str("path", data.Path).Str("newName", data.NewName).Msg("rename item request")
-	go a.fileOps.RenameItem(data)
+	a.opLog(msg.Type).Str("path", data.Path).Str("newName", data.NewName).Msg("rename item request")
+	a.runOp(msg.Type, data.RequestID, func(context.Context) { a.fileOps.RenameItem(data) })
+	return nil
+}
+
+func (a *Agent) handleChmod(msg *Message) error {
+	data, err := UnmarshalData[ChmodData](msg)
+	if err != nil {
+		return err
+	}
+
+	a.opLog(msg.Type).Str("path", data.Path).Str("mode", data.Mode).Msg("chmod request")
+	a.runOp(msg.Type, data.RequestID, func(context.Context) { a.fileOps.Chmod(data) })
 	return nil
 }
 
@@ -586,8 +1694,8 @@ func (a *Agent) handleStreamFileInfo(msg *Message) error {
 		return err
 	}
 
-	log.Info().Str("path", data.Path).Msg("stream file info request")
-	go a.fileOps.StreamFileInfo(data)
+	a.opLog(msg.Type).Str("path", data.Path).Msg("stream file info request")
+	a.runOp(msg.Type, data.RequestID, func(context.Context) { a.fileOps.StreamFileInfo(data) })
 	return nil
 }
 
@@ -602,7 +1710,7 @@ func (a *Agent) handleStreamChunk(msg *Message) error {
 		Int64("offset", data.Offset).
 		Int64("length", data.Length).
 		Msg("stream chunk request")
-	go a.fileOps.StreamChunk(data)
+	a.runOp(msg.Type, data.RequestID, func(context.Context) { a.fileOps.StreamChunk(data) })
 	return nil
 }
 
@@ -617,7 +1725,7 @@ func (a *Agent) handleCompressFiles(msg *Message) error {
 		Str("archiveName", data.ArchiveName).
 		Str("format", data.Format).
 		Msg("compress files request")
-	go a.fileOps.CompressFiles(data)
+	a.runOp(msg.Type, data.RequestID, func(ctx context.Context) { a.fileOps.CompressFiles(ctx, data) })
 	return nil
 }
 
@@ -630,6 +1738,77 @@ func (a *Agent) handleGetDirStats(msg *Message) error {
 	log.Debug().
 		Str("path", data.Path).
 		Msg("get dir stats request")
-	go a.fileOps.GetDirStats(data)
+	a.runOp(msg.Type, data.RequestID, func(ctx context.Context) { a.fileOps.GetDirStats(ctx, data) })
+	return nil
+}
+
+func (a *Agent) handleDiskUsage(msg *Message) error {
+	data, err := UnmarshalData[DiskUsageData](msg)
+	if err != nil {
+		return err
+	}
+
+	a.opLog(msg.Type).Str("path", data.Path).Msg("disk usage request")
+
+	a.runOp(msg.Type, data.RequestID, func(context.Context) { a.fileOps.DiskUsage(data) })
+	return nil
+}
+
+func (a *Agent) handleDownloadMatching(msg *Message) error {
+	data, err := UnmarshalData[DownloadMatchingData](msg)
+	if err != nil {
+		return err
+	}
+
+	a.opLog(msg.Type).
+		Str("rootPath", data.RootPath).
+		Str("glob", data.Glob).
+		Str("format", data.ArchiveFormat).
+		Msg("download matching request")
+	a.runOp(msg.Type, data.RequestID, func(ctx context.Context) { a.fileOps.DownloadMatching(ctx, data) })
+	return nil
+}
+
+func (a *Agent) handlePatchFile(msg *Message) error {
+	data, err := UnmarshalData[PatchFileData](msg)
+	if err != nil {
+		return err
+	}
+
+	a.opLog(msg.Type).Str("path", data.Path).Int("edits", len(data.Edits)).Msg("patch file request")
+	a.runOp(msg.Type, data.RequestID, func(context.Context) { a.fileOps.PatchFile(data) })
+	return nil
+}
+
+func (a *Agent) handleFileQuickStats(msg *Message) error {
+	data, err := UnmarshalData[FileQuickStatsData](msg)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Str("path", data.Path).Msg("file quick stats request")
+	a.runOp(msg.Type, data.RequestID, func(context.Context) { a.fileOps.FileQuickStats(data) })
+	return nil
+}
+
+func (a *Agent) handleListArchive(msg *Message) error {
+	data, err := UnmarshalData[ListArchiveData](msg)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Str("archivePath", data.ArchivePath).Msg("list archive request")
+	a.runOp(msg.Type, data.RequestID, func(ctx context.Context) { a.fileOps.ListArchive(ctx, data) })
+	return nil
+}
+
+func (a *Agent) handleReadFiles(msg *Message) error {
+	data, err := UnmarshalData[ReadFilesData](msg)
+	if err != nil {
+		return err
+	}
+
+	a.opLog(msg.Type).Int("count", len(data.Paths)).Msg("read files request")
+	a.runOp(msg.Type, data.RequestID, func(ctx context.Context) { a.fileOps.ReadFiles(ctx, data) })
 	return nil
 }
@@ -0,0 +1,193 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestAgent returns an agent with just enough set up to run file
+// operations, recording what they send
+func newTestAgent(t *testing.T, config *Config) (*Agent, *sentLog) {
+	t.Helper()
+	sent := &sentLog{}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &Agent{
+		config:  config,
+		ctx:     ctx,
+		cancel:  cancel,
+		fileOps: NewFileOps(config, sent.send),
+	}, sent
+}
+
+func TestRunOpLeavesNoGoroutines(t *testing.T) {
+	a, _ := newTestAgent(t, &Config{OpTimeout: time.Minute})
+	before := runtime.NumGoroutine()
+
+	for range 100 {
+		a.runOp(MsgTypeListFiles, "req", func(context.Context) {})
+	}
+	a.ops.Wait()
+
+	// The watchers exit once their operation is done, not at the timeout
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines still running, had %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTimedOutOpResultIsDropped(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for opTimeoutGrace")
+	}
+
+	a, sent := newTestAgent(t, &Config{OpTimeout: 10 * time.Millisecond})
+	release := make(chan struct{})
+
+	// A non-mutating operation stuck in a call that ignores its context
+	a.runOp(MsgTypeListFiles, "req", func(context.Context) {
+		<-release
+		a.fileOps.sendFinal("req", MsgTypeFileList, FileListData{RequestID: "req"})
+	})
+
+	deadline := time.Now().Add(opTimeoutGrace + 5*time.Second)
+	for a.stuckOps.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("operation was never reported as timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	a.ops.Wait()
+
+	sent.mu.Lock()
+	defer sent.mu.Unlock()
+	if len(sent.msgs) != 1 {
+		t.Fatalf("sent %d responses, want only the timeout", len(sent.msgs))
+	}
+	if e, ok := sent.msgs[0].data.(FileErrorData); !ok || e.Code != 504 {
+		t.Fatalf("response = %+v, want a 504 file_error", sent.msgs[0].data)
+	}
+}
+
+func TestHeartbeatWriteFailureClosesConnection(t *testing.T) {
+	// The server accepts the connection and then never sends anything, so
+	// reads hang until the connection is closed
+	release := make(chan struct{})
+	defer close(release)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		<-release
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Without a writer every send fails, as on a half-open connection
+	a, _ := newTestAgent(t, &Config{Heartbeat: 1})
+	a.startTime = time.Now()
+	connDone := make(chan struct{})
+	defer close(connDone)
+	a.wg.Add(1)
+	go a.heartbeatLoop(conn, connDone)
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadMessage()
+		readErr <- err
+	}()
+
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Fatal("read returned a message")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read still blocked after the heartbeat failed")
+	}
+}
+
+func TestClockJumpLeavesUptimeMonotonic(t *testing.T) {
+	a, _ := newTestAgent(t, &Config{})
+	a.startTime = time.Now().Add(-time.Minute)
+
+	// Drift below the threshold is not a jump
+	if jump := a.noteWallSkew(time.Second); jump != 0 {
+		t.Fatalf("1s drift reported as a %v jump", jump)
+	}
+
+	// An NTP step back by an hour, then forward again
+	before := a.elapsed()
+	if jump := a.noteWallSkew(-time.Hour); jump != -time.Hour-time.Second {
+		t.Fatalf("step back reported as %v", jump)
+	}
+	after := a.elapsed()
+	if after < before || after < time.Minute || after > time.Minute+time.Second {
+		t.Fatalf("uptime went from %v to %v across the clock step", before, after)
+	}
+	if jump := a.noteWallSkew(0); jump != time.Hour {
+		t.Fatalf("step forward reported as %v", jump)
+	}
+	if again := a.elapsed(); again < after {
+		t.Fatalf("uptime went backwards from %v to %v", after, again)
+	}
+
+	// With no step since the last check nothing is reported
+	a.checkClockJump()
+	if jump := a.noteWallSkew(time.Duration(a.wallSkew.Load())); jump != 0 {
+		t.Fatalf("unchanged skew reported as a %v jump", jump)
+	}
+}
+
+func TestListProcessesRunsAsOp(t *testing.T) {
+	a, sent := newTestAgent(t, &Config{OpTimeout: time.Minute})
+
+	msg := scopeMessage(t, MsgTypeListProcesses, ListProcessesData{RequestID: "ps", Limit: 5})
+	if err := a.handleListProcesses(msg); err != nil {
+		t.Fatal(err)
+	}
+	a.ops.Wait()
+
+	list, ok := sent.last(t).data.(ProcessListData)
+	if !ok || list.RequestID != "ps" {
+		t.Fatalf("response = %+v, want a process list for ps", sent.last(t).data)
+	}
+	if list.Error == "" && (len(list.Processes) == 0 || len(list.Processes) > 5) {
+		t.Fatalf("listed %d processes with limit 5", len(list.Processes))
+	}
+}
+
+func TestServiceStatusRunsAsOp(t *testing.T) {
+	a, sent := newTestAgent(t, &Config{OpTimeout: time.Minute})
+
+	msg := scopeMessage(t, MsgTypeServiceStatus, ServiceStatusData{RequestID: "svc", ServiceName: "bad name;"})
+	if err := a.handleServiceStatus(msg); err != nil {
+		t.Fatal(err)
+	}
+	a.ops.Wait()
+
+	status, ok := sent.last(t).data.(ServiceStatusResultData)
+	if !ok || status.RequestID != "svc" || status.Error == "" {
+		t.Fatalf("response = %+v, want an invalid name error for svc", sent.last(t).data)
+	}
+}
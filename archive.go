@@ -0,0 +1,292 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrUnsupportedArchive is returned by listArchive for formats it cannot read
+var ErrUnsupportedArchive = errors.New("unsupported archive format")
+
+// compressFormatExts lists the file extensions accepted for each
+// compress_files format, the first being the one appended when missing
+var compressFormatExts = map[string][]string{
+	"zip":     {".zip"},
+	"tar.gz":  {".tar.gz", ".tgz"},
+	"tgz":     {".tgz", ".tar.gz"},
+	"tar.bz2": {".tar.bz2", ".tbz2"},
+	"tbz2":    {".tbz2", ".tar.bz2"},
+	"tar.xz":  {".tar.xz", ".txz"},
+	"tar":     {".tar"},
+	"7z":      {".7z"},
+}
+
+// archiveFileName validates a compress_files archive name for format. The
+// name must be a plain file name, which is placed next to the sources, and
+// gets the format's extension appended if it has none. An empty name
+// defaults to "archive".
+func archiveFileName(name, format string) (string, error) {
+	exts, ok := compressFormatExts[format]
+	if !ok {
+		return "", fmt.Errorf("unsupported compression format: %s", format)
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "archive"
+	}
+	if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return "", fmt.Errorf("archive name must be a file name without directories")
+	}
+	if strings.HasPrefix(name, "-") {
+		// Would be parsed as an option by zip/tar/7z
+		return "", fmt.Errorf("archive name must not start with '-'")
+	}
+
+	lower := strings.ToLower(name)
+	for _, ext := range exts {
+		if strings.HasSuffix(lower, ext) {
+			return name, nil
+		}
+	}
+
+	// Reject names that claim a different archive type than the format
+	for other, otherExts := range compressFormatExts {
+		for _, ext := range otherExts {
+			if strings.HasSuffix(lower, ext) {
+				return "", fmt.Errorf("archive name %q does not match format %s (looks like %s)", name, format, other)
+			}
+		}
+	}
+
+	return name + exts[0], nil
+}
+
+// nativeArchiveFormats are the formats writeArchive can produce without
+// external tools
+var nativeArchiveFormats = map[string]string{
+	"zip":    ".zip",
+	"tar.gz": ".tar.gz",
+	"tgz":    ".tgz",
+	"tar":    ".tar",
+}
+
+// writeArchive writes the given files, relative to root, into w using a
+// native Go encoder for the requested format
+func writeArchive(ctx context.Context, w io.Writer, format, root string, relPaths []string) error {
+	switch format {
+	case "zip":
+		return writeZip(ctx, w, root, relPaths)
+	case "tar.gz", "tgz":
+		gz := gzip.NewWriter(w)
+		if err := writeTar(ctx, gz, root, relPaths); err != nil {
+			gz.Close()
+			return err
+		}
+		return gz.Close()
+	case "tar":
+		return writeTar(ctx, w, root, relPaths)
+	default:
+		return fmt.Errorf("unsupported archive format: %s", format)
+	}
+}
+
+func writeZip(ctx context.Context, w io.Writer, root string, relPaths []string) error {
+	zw := zip.NewWriter(w)
+
+	for _, rel := range relPaths {
+		if err := ctx.Err(); err != nil {
+			zw.Close()
+			return err
+		}
+
+		if err := addZipEntry(zw, root, rel); err != nil {
+			zw.Close()
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func addZipEntry(zw *zip.Writer, root, rel string) error {
+	file, err := os.Open(filepath.Join(root, rel))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(rel)
+	header.Method = zip.Deflate
+
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, file)
+	return err
+}
+
+func writeTar(ctx context.Context, w io.Writer, root string, relPaths []string) error {
+	tw := tar.NewWriter(w)
+
+	for _, rel := range relPaths {
+		if err := ctx.Err(); err != nil {
+			tw.Close()
+			return err
+		}
+
+		if err := addTarEntry(tw, root, rel); err != nil {
+			tw.Close()
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func addTarEntry(tw *tar.Writer, root, rel string) error {
+	file, err := os.Open(filepath.Join(root, rel))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(rel)
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	// Copy exactly the size recorded in the header in case the file grows
+	_, err = io.CopyN(tw, file, info.Size())
+	return err
+}
+
+// listArchive calls emit for each entry of the zip or tar archive at path,
+// stopping after limit entries. It reports whether entries were left over.
+// The format is chosen by extension; compressed tars must be gzip or bzip2.
+func listArchive(ctx context.Context, path string, limit int, emit func(ArchiveEntry)) (bool, error) {
+	lower := strings.ToLower(path)
+	if strings.HasSuffix(lower, ".zip") {
+		return listZip(ctx, path, limit, emit)
+	}
+
+	var decompress func(io.Reader) (io.Reader, error)
+	switch {
+	case strings.HasSuffix(lower, ".tar"):
+		decompress = func(r io.Reader) (io.Reader, error) { return r, nil }
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		decompress = func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+	case strings.HasSuffix(lower, ".tar.bz2"), strings.HasSuffix(lower, ".tbz2"):
+		decompress = func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil }
+	default:
+		return false, ErrUnsupportedArchive
+	}
+
+	file, err := os.Open(longPath(path))
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	r, err := decompress(file)
+	if err != nil {
+		return false, err
+	}
+	return listTar(ctx, r, limit, emit)
+}
+
+func listZip(ctx context.Context, path string, limit int, emit func(ArchiveEntry)) (bool, error) {
+	zr, err := zip.OpenReader(longPath(path))
+	if err != nil {
+		return false, err
+	}
+	defer zr.Close()
+
+	for i, file := range zr.File {
+		if i == limit {
+			return true, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		info := file.FileInfo()
+		emit(archiveEntry(file.Name, info.Mode(), info.Size(), file.Modified, ""))
+	}
+	return false, nil
+}
+
+func listTar(ctx context.Context, r io.Reader, limit int, emit func(ArchiveEntry)) (bool, error) {
+	tr := tar.NewReader(r)
+
+	for n := 0; ; n++ {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		header, err := tr.Next()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if n == limit {
+			return true, nil
+		}
+
+		emit(archiveEntry(header.Name, header.FileInfo().Mode(), header.Size, header.ModTime, header.Linkname))
+	}
+}
+
+func archiveEntry(name string, mode os.FileMode, size int64, modTime time.Time, linkTarget string) ArchiveEntry {
+	entry := ArchiveEntry{
+		Name:        name,
+		Type:        "file",
+		Size:        size,
+		ModTime:     modTime.Format(time.RFC3339),
+		Permissions: mode.Perm().String(),
+		LinkTarget:  linkTarget,
+	}
+	switch {
+	case mode.IsDir():
+		entry.Type = "directory"
+		entry.Size = 0
+	case mode&os.ModeSymlink != 0:
+		entry.Type = "link"
+	}
+	return entry
+}
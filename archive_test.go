@@ -0,0 +1,48 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import "testing"
+
+func TestArchiveFileName(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		want    string
+		wantErr bool
+	}{
+		// Empty names fall back to a default
+		{"", "zip", "archive.zip", false},
+		{"   ", "tar.gz", "archive.tar.gz", false},
+
+		// Missing extensions are appended, matching ones kept
+		{"backup", "tar.xz", "backup.tar.xz", false},
+		{"backup.TGZ", "tar.gz", "backup.TGZ", false},
+		{"backup.tar.gz", "tgz", "backup.tar.gz", false},
+		{"notes.txt", "7z", "notes.txt.7z", false},
+
+		// Traversal and directories
+		{"../../evil.zip", "zip", "", true},
+		{"/tmp/evil.zip", "zip", "", true},
+		{`..\evil.zip`, "zip", "", true},
+		{`C:\evil.zip`, "zip", "", true},
+		{"..", "zip", "", true},
+		{".", "zip", "", true},
+		{"-evil.zip", "zip", "", true},
+
+		// Extension and format mismatches
+		{"backup.zip", "tar.gz", "", true},
+		{"backup.tar.gz", "tar", "", true},
+		{"backup.tar", "tar.bz2", "", true},
+		{"backup.7z", "zip", "", true},
+
+		{"backup.rar", "rar", "", true},
+	}
+	for _, tt := range tests {
+		got, err := archiveFileName(tt.name, tt.format)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("archiveFileName(%q, %q) = %q, %v; want %q, error %v",
+				tt.name, tt.format, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
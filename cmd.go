@@ -8,9 +8,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/rs/zerolog/log"
 )
@@ -19,6 +30,15 @@ const (
 	cmdRunningLimit        = 5
 	cmdExecDefaultTimeout  = 30 * time.Second
 	cmdExecMaxTimeout      = 600 * time.Second // 10 minutes max
+
+	// Streamed stdin frames buffered ahead of the process reading them
+	cmdStdinQueue = 64
+)
+
+var (
+	ErrStdinOverflow = errors.New("stdin buffer full")
+	ErrCmdAborted    = errors.New("aborted by server")
+	ErrNoStdinStream = errors.New("no running command accepts stdin with this token")
 )
 
 // CmdError codes
@@ -29,29 +49,119 @@ const (
 	CmdErrNoMem
 	CmdErrSysErr
 	CmdErrRespTooBig
+	CmdErrBadRequest
 )
 
 var cmdSemaphore = make(chan struct{}, cmdRunningLimit)
 
 // CommandExecutor handles remote command execution
 type CommandExecutor struct {
+	config     *Config
 	sendResult func(result *CmdResultData)
 	sendError  func(token string, code int, message string)
+	wg         sync.WaitGroup
+	streams    sync.Map // token -> *stdinStream
+
+	// Dangerous command confirmation, see cmd_confirm.go
+	sendConfirm func(confirm *CmdConfirmRequiredData)
+	dangerous   []*regexp.Regexp
+	pending     sync.Map // nonce -> *pendingCmd
+}
+
+// stdinStream feeds cmd_stdin frames to a running command's stdin. Frames
+// are queued so a slow reader never blocks the connection; a server that
+// outpaces the process by more than cmdStdinQueue frames aborts it.
+type stdinStream struct {
+	frames chan []byte
+	cancel context.CancelCauseFunc
+	mu     sync.Mutex
+	closed bool
+}
+
+// send queues data and, with eof, closes stdin once it has been written
+func (s *stdinStream) send(data []byte, eof bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrNoStdinStream
+	}
+	if len(data) > 0 {
+		select {
+		case s.frames <- data:
+		default:
+			s.closeLocked()
+			s.cancel(ErrStdinOverflow)
+			return ErrStdinOverflow
+		}
+	}
+	if eof {
+		s.closeLocked()
+	}
+	return nil
+}
+
+// abort kills the command
+func (s *stdinStream) abort() {
+	s.mu.Lock()
+	s.closeLocked()
+	s.mu.Unlock()
+	s.cancel(ErrCmdAborted)
+}
+
+func (s *stdinStream) close() {
+	s.mu.Lock()
+	s.closeLocked()
+	s.mu.Unlock()
+}
+
+func (s *stdinStream) closeLocked() {
+	if !s.closed {
+		s.closed = true
+		close(s.frames)
+	}
+}
+
+// pump writes queued frames to w until the stream is closed. If the process
+// stops reading, the remaining frames are discarded.
+func (s *stdinStream) pump(w io.WriteCloser) {
+	defer w.Close()
+	for data := range s.frames {
+		if _, err := w.Write(data); err != nil {
+			for range s.frames {
+			}
+			return
+		}
+	}
 }
 
 // NewCommandExecutor creates a new command executor
 func NewCommandExecutor(
+	config *Config,
 	sendResult func(result *CmdResultData),
 	sendError func(token string, code int, message string),
+	sendConfirm func(confirm *CmdConfirmRequiredData),
 ) *CommandExecutor {
-	return &CommandExecutor{
-		sendResult: sendResult,
-		sendError:  sendError,
+	e := &CommandExecutor{
+		config:      config,
+		sendResult:  sendResult,
+		sendError:   sendError,
+		sendConfirm: sendConfirm,
 	}
+	if config != nil {
+		e.dangerous = compilePatterns(config.DangerousPatterns)
+	}
+	return e
+}
+
+// Execute runs a command and sends the result via the callback.
+// The command is killed if ctx is cancelled. With Config.ConfirmDangerous,
+// commands matching a dangerous pattern only run once confirmed.
+func (e *CommandExecutor) Execute(ctx context.Context, cmd *ExecCmdData) {
+	e.execute(ctx, cmd, false)
 }
 
-// Execute runs a command and sends the result via the callback
-func (e *CommandExecutor) Execute(cmd *ExecCmdData) {
+func (e *CommandExecutor) execute(ctx context.Context, cmd *ExecCmdData, confirmed bool) {
 	// Validate user if specified
 	var u *user.User
 	var err error
@@ -65,13 +175,54 @@ func (e *CommandExecutor) Execute(cmd *ExecCmdData) {
 		}
 	}
 
+	switch cmd.Encoding {
+	case "", CmdEncodingBase64, CmdEncodingUTF8:
+	default:
+		e.sendError(cmd.Token, CmdErrBadRequest, "unsupported encoding: "+cmd.Encoding)
+		return
+	}
+
+	if err := checkEnvNames(cmd.Env); err != nil {
+		e.sendError(cmd.Token, CmdErrBadRequest, err.Error())
+		return
+	}
+
+	if cmd.OutputToFile != "" {
+		if err := checkOutputPath(cmd.OutputToFile); err != nil {
+			log.Error().Err(err).Str("path", cmd.OutputToFile).Msg("invalid command output file")
+			e.sendError(cmd.Token, CmdErrBadRequest, err.Error())
+			return
+		}
+	}
+
 	// Find command path
 	cmdPath, err := exec.LookPath(cmd.Command)
+	if err != nil && strings.ContainsAny(cmd.Command, `/\`) {
+		if code, message, ok := explainNotRunnable(cmd.Command); ok {
+			log.Error().Err(err).Str("command", cmd.Command).Msg(message)
+			e.sendError(cmd.Token, code, message)
+			return
+		}
+	}
 	if err != nil || cmdPath == "" {
-		log.Error().Str("command", cmd.Command).Msg("command not found")
-		e.sendError(cmd.Token, CmdErrNotFound, "command not found")
+		message := "command not found"
+		if !strings.ContainsAny(cmd.Command, `/\`) {
+			// Bare names are searched in PATH, which is often not what the
+			// operator expects for an agent started by init or cron
+			message += ", searched PATH=" + os.Getenv("PATH")
+		}
+		log.Error().Err(err).Str("command", cmd.Command).Str("path", os.Getenv("PATH")).Msg("command not found")
+		e.sendError(cmd.Token, CmdErrNotFound, message)
 		return
 	}
+	log.Debug().Str("command", cmd.Command).Str("resolved", cmdPath).Msg("resolved command")
+
+	if !confirmed {
+		if pattern := e.dangerousMatch(cmd); pattern != "" {
+			e.requestConfirm(cmd, pattern)
+			return
+		}
+	}
 
 	// Determine timeout
 	timeout := cmdExecDefaultTimeout
@@ -85,21 +236,145 @@ func (e *CommandExecutor) Execute(cmd *ExecCmdData) {
 	// Try to acquire semaphore
 	select {
 	case cmdSemaphore <- struct{}{}:
-		go e.executeCommand(u, cmdPath, cmd.Args, cmd.Token, timeout)
+		// Register before starting so stdin frames sent right after the
+		// request find the stream
+		var stream *stdinStream
+		if cmd.StreamStdin {
+			stream = &stdinStream{frames: make(chan []byte, cmdStdinQueue)}
+			ctx, stream.cancel = context.WithCancelCause(ctx)
+			if _, running := e.streams.LoadOrStore(cmd.Token, stream); running {
+				stream.cancel(nil)
+				<-cmdSemaphore
+				e.sendError(cmd.Token, CmdErrBadRequest, "a command with this token is already running")
+				return
+			}
+		}
+
+		e.wg.Add(1)
+		go e.executeCommand(ctx, u, cmdPath, cmd, timeout, stream)
 	default:
 		log.Warn().Int("limit", cmdRunningLimit).Msg("command limit reached")
 		e.sendError(cmd.Token, CmdErrNoMem, "too many concurrent commands")
 	}
 }
 
-func (e *CommandExecutor) executeCommand(u *user.User, cmdPath string, args []string, token string, timeout time.Duration) {
+// Stdin passes a cmd_stdin frame to the command started with token
+func (e *CommandExecutor) Stdin(token string, data []byte, eof, abort bool) error {
+	value, ok := e.streams.Load(token)
+	if !ok {
+		return ErrNoStdinStream
+	}
+	stream := value.(*stdinStream)
+
+	if abort {
+		stream.abort()
+		return nil
+	}
+	return stream.send(data, eof)
+}
+
+// Wait blocks until all running commands have finished
+func (e *CommandExecutor) Wait() {
+	e.wg.Wait()
+}
+
+// checkEnvNames rejects environment variables that cannot be passed to a
+// process
+func checkEnvNames(env map[string]string) error {
+	for name, value := range env {
+		if name == "" || strings.ContainsAny(name, "=\x00") || strings.ContainsRune(value, 0) {
+			return fmt.Errorf("invalid environment variable %q", name)
+		}
+	}
+	return nil
+}
+
+// commandEnv builds the environment for a command run as u (nil = the
+// agent's user). By default the agent's environment is inherited; with
+// Config.CleanCommandEnv only cleanEnvKeys are kept. The request's own
+// variables are added last so they take precedence.
+func (e *CommandExecutor) commandEnv(u *user.User, extra map[string]string) []string {
+	clean := e.config != nil && e.config.CleanCommandEnv
+	if !clean && len(extra) == 0 {
+		return nil // inherit
+	}
+
+	var env []string
+	if clean {
+		for _, key := range cleanEnvKeys {
+			if value, ok := os.LookupEnv(key); ok {
+				env = append(env, key+"="+value)
+			}
+		}
+		if _, ok := os.LookupEnv("PATH"); !ok {
+			env = append(env, "PATH="+defaultCommandPath)
+		}
+		env = append(env, userEnv(u)...)
+	} else {
+		env = os.Environ()
+	}
+
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+extra[name])
+	}
+	return env
+}
+
+// checkOutputPath validates an OutputToFile destination: an absolute path
+// without ".." segments whose parent directory exists
+func checkOutputPath(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("output file must be an absolute path")
+	}
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == filepath.Separator }) {
+		if part == ".." {
+			return fmt.Errorf("output file must not contain '..'")
+		}
+	}
+
+	if info, err := os.Stat(longPath(path)); err == nil && info.IsDir() {
+		return fmt.Errorf("output file is a directory")
+	}
+	if info, err := os.Stat(longPath(filepath.Dir(path))); err != nil || !info.IsDir() {
+		return fmt.Errorf("output directory does not exist")
+	}
+	return nil
+}
+
+// outputPerm is the mode of a new OutputToFile file, masked with Config.Umask
+// like files created by file operations
+func (e *CommandExecutor) outputPerm() os.FileMode {
+	var mode os.FileMode = 0644
+	if e.config != nil {
+		mode &^= e.config.Umask
+	}
+	return mode
+}
+
+func (e *CommandExecutor) executeCommand(parent context.Context, u *user.User, cmdPath string, req *ExecCmdData, timeout time.Duration, stream *stdinStream) {
 	defer func() {
 		<-cmdSemaphore
+		e.wg.Done()
 	}()
 
+	if stream != nil {
+		defer func() {
+			e.streams.Delete(req.Token)
+			stream.close()
+			stream.cancel(nil)
+		}()
+	}
+
+	args, token, outputFile := req.Args, req.Token, req.OutputToFile
+
 	log.Debug().Str("command", cmdPath).Strs("args", args).Str("token", token).Dur("timeout", timeout).Msg("executing command")
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(parent, timeout)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, cmdPath, args...)
@@ -108,11 +383,42 @@ func (e *CommandExecutor) executeCommand(u *user.User, cmdPath string, args []st
 	if u != nil {
 		setSysProcAttr(cmd, u)
 	}
+	cmd.Env = e.commandEnv(u, req.Env)
 
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
+	var output *os.File
+	if outputFile != "" {
+		var err error
+		output, err = os.OpenFile(longPath(outputFile), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, e.outputPerm())
+		if err != nil {
+			log.Error().Err(err).Str("path", outputFile).Str("token", token).Msg("failed to open command output file")
+			e.sendError(token, CmdErrSysErr, fmt.Sprintf("cannot open output file: %v", err))
+			return
+		}
+		defer output.Close()
+
+		// The file belongs to the user the command runs as, like files the
+		// command creates itself
+		if err := chownOutput(output, u); err != nil {
+			log.Error().Err(err).Str("path", outputFile).Str("token", token).Msg("failed to change command output file owner")
+			e.sendError(token, CmdErrSysErr, fmt.Sprintf("cannot change output file owner: %v", err))
+			return
+		}
+		cmd.Stdout = output
+	}
+
+	if stream != nil {
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			e.sendError(token, CmdErrSysErr, fmt.Sprintf("cannot open stdin: %v", err))
+			return
+		}
+		go stream.pump(stdin)
+	}
+
 	exitCode := 0
 	err := cmd.Run()
 
@@ -121,6 +427,14 @@ func (e *CommandExecutor) executeCommand(u *user.User, cmdPath string, args []st
 			log.Error().Str("command", cmdPath).Str("token", token).Msg("command timeout")
 			e.sendError(token, CmdErrSysErr, "command timeout")
 			return
+		} else if ctx.Err() == context.Canceled {
+			message := "command cancelled"
+			if cause := context.Cause(ctx); cause != context.Canceled {
+				message += ": " + cause.Error()
+			}
+			log.Warn().Str("command", cmdPath).Str("token", token).Msg(message)
+			e.sendError(token, CmdErrSysErr, message)
+			return
 		} else if exitErr, ok := err.(*exec.ExitError); ok {
 			exitCode = exitErr.ExitCode()
 		} else {
@@ -130,26 +444,71 @@ func (e *CommandExecutor) executeCommand(u *user.User, cmdPath string, args []st
 		}
 	}
 
-	stdoutBytes := stdout.Bytes()
-	stderrBytes := stderr.Bytes()
+	var outputSize int64
+	if output != nil {
+		info, err := output.Stat()
+		if err != nil {
+			e.sendError(token, CmdErrSysErr, fmt.Sprintf("cannot stat output file: %v", err))
+			return
+		}
+		outputSize = info.Size()
+	}
 
-	// Check response size limit (64KB)
-	stdoutB64 := base64.StdEncoding.EncodeToString(stdoutBytes)
-	stderrB64 := base64.StdEncoding.EncodeToString(stderrBytes)
+	stdoutText, stderrText, encoding := encodeOutput(stdout.Bytes(), stderr.Bytes(), req.Encoding)
 
-	if len(stdoutB64)+len(stderrB64) > 65000 {
+	// Check response size limit (64KB)
+	if len(stdoutText)+len(stderrText) > 65000 {
 		e.sendError(token, CmdErrRespTooBig, "stdout+stderr is too big")
 		return
 	}
 
 	e.sendResult(&CmdResultData{
-		Token:    token,
-		ExitCode: exitCode,
-		Stdout:   stdoutB64,
-		Stderr:   stderrB64,
+		Token:      token,
+		ExitCode:   exitCode,
+		Stdout:     stdoutText,
+		Stderr:     stderrText,
+		Encoding:   encoding,
+		OutputFile: outputFile,
+		OutputSize: outputSize,
 	})
 }
 
+// encodeOutput encodes command output as requested, falling back to base64
+// when UTF-8 was requested but the output is not valid UTF-8
+func encodeOutput(stdout, stderr []byte, requested string) (string, string, string) {
+	if requested == CmdEncodingUTF8 && utf8.Valid(stdout) && utf8.Valid(stderr) {
+		return string(stdout), string(stderr), CmdEncodingUTF8
+	}
+
+	return base64.StdEncoding.EncodeToString(stdout),
+		base64.StdEncoding.EncodeToString(stderr),
+		CmdEncodingBase64
+}
+
+// explainNotRunnable describes why the file at path exists but cannot be
+// run. It returns false if the file does not exist, which is reported as
+// command not found.
+func explainNotRunnable(path string) (int, string, bool) {
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return 0, "", false
+	case errors.Is(err, fs.ErrPermission):
+		return CmdErrPermit, path + ": permission denied", true
+	case err != nil:
+		return CmdErrSysErr, err.Error(), true
+	case info.IsDir():
+		return CmdErrBadRequest, path + ": is a directory", true
+	case !info.Mode().IsRegular():
+		return CmdErrBadRequest, path + ": not an executable", true
+	case !hasExecBits(path, info):
+		return CmdErrPermit, path + ": permission denied: not executable", true
+	default:
+		// Executable, but not by the agent's user
+		return CmdErrPermit, path + ": permission denied", true
+	}
+}
+
 // CmdErrorString converts error code to string
 func CmdErrorString(code int) string {
 	switch code {
@@ -163,6 +522,8 @@ func CmdErrorString(code int) string {
 		return "system error"
 	case CmdErrRespTooBig:
 		return "response too large"
+	case CmdErrBadRequest:
+		return "bad request"
 	default:
 		return ""
 	}
@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// How long the server has to confirm a dangerous command
+const cmdConfirmTimeout = time.Minute
+
+// defaultDangerousPatterns match command lines that destroy data
+var defaultDangerousPatterns = []string{
+	`\brm\s+(.*\s)?-[a-zA-Z]*[rR]`,
+	`\bmkfs(\.\w+)?\b`,
+	`\bdd\s+(.*\s)?of=`,
+	`\b(shred|wipefs|blkdiscard)\b`,
+}
+
+var ErrConfirmExpired = errors.New("no pending command with this confirmation nonce")
+
+// pendingCmd is a dangerous command waiting for confirm_cmd
+type pendingCmd struct {
+	cmd   *ExecCmdData
+	timer *time.Timer
+}
+
+// compilePatterns compiles dangerous command patterns. Config.Validate
+// rejects invalid ones, so errors here are skipped.
+func compilePatterns(patterns []string) []*regexp.Regexp {
+	var compiled []*regexp.Regexp
+	for _, p := range patterns {
+		if re, err := regexp.Compile(p); err == nil {
+			compiled = append(compiled, re)
+		}
+	}
+	return compiled
+}
+
+// dangerousMatch returns the pattern a command line matches, or "" if it
+// matches none or confirmation is disabled. The command is matched by its
+// base name so /bin/rm is treated like rm.
+func (e *CommandExecutor) dangerousMatch(cmd *ExecCmdData) string {
+	if e.config == nil || !e.config.ConfirmDangerous {
+		return ""
+	}
+
+	line := strings.Join(append([]string{filepath.Base(cmd.Command)}, cmd.Args...), " ")
+	for _, re := range e.dangerous {
+		if re.MatchString(line) {
+			return re.String()
+		}
+	}
+	return ""
+}
+
+// requestConfirm parks cmd and asks the server to confirm it. Unconfirmed
+// commands are dropped after cmdConfirmTimeout.
+func (e *CommandExecutor) requestConfirm(cmd *ExecCmdData, pattern string) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		e.sendError(cmd.Token, CmdErrSysErr, "cannot generate confirmation nonce")
+		return
+	}
+	nonce := hex.EncodeToString(buf)
+
+	pending := &pendingCmd{cmd: cmd}
+	pending.timer = time.AfterFunc(cmdConfirmTimeout, func() {
+		if _, ok := e.pending.LoadAndDelete(nonce); ok {
+			log.Warn().Str("token", cmd.Token).Msg("dangerous command not confirmed in time")
+			e.sendError(cmd.Token, CmdErrPermit, "confirmation timed out")
+		}
+	})
+	e.pending.Store(nonce, pending)
+
+	log.Warn().
+		Str("token", cmd.Token).
+		Str("command", cmd.Command).
+		Str("pattern", pattern).
+		Msg("dangerous command awaiting confirmation")
+
+	e.sendConfirm(&CmdConfirmRequiredData{
+		Token:     cmd.Token,
+		Nonce:     nonce,
+		Pattern:   pattern,
+		ExpiresIn: int(cmdConfirmTimeout.Seconds()),
+	})
+}
+
+// Confirm runs the command parked under nonce. The token must match the
+// one the command was requested with.
+func (e *CommandExecutor) Confirm(ctx context.Context, token, nonce string) error {
+	value, ok := e.pending.Load(nonce)
+	if !ok || value.(*pendingCmd).cmd.Token != token {
+		return ErrConfirmExpired
+	}
+	if _, ok := e.pending.LoadAndDelete(nonce); !ok {
+		return ErrConfirmExpired
+	}
+
+	pending := value.(*pendingCmd)
+	pending.timer.Stop()
+
+	log.Info().Str("token", token).Str("command", pending.cmd.Command).Msg("dangerous command confirmed")
+	e.execute(ctx, pending.cmd, true)
+	return nil
+}
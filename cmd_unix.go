@@ -8,12 +8,38 @@
 package main
 
 import (
+	"io/fs"
+	"os"
 	"os/exec"
 	"os/user"
 	"strconv"
 	"syscall"
 )
 
+// Default search path for commands when the agent has no PATH
+const defaultCommandPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// cleanEnvKeys are the agent's environment variables kept for commands when
+// Config.CleanCommandEnv is set
+var cleanEnvKeys = []string{"PATH", "HOME", "USER", "LOGNAME", "SHELL", "LANG", "LC_ALL", "TZ", "TMPDIR"}
+
+// userEnv returns the variables describing u, overriding the agent's own
+func userEnv(u *user.User) []string {
+	if u == nil {
+		return nil
+	}
+	return []string{
+		"HOME=" + u.HomeDir,
+		"USER=" + u.Username,
+		"LOGNAME=" + u.Username,
+	}
+}
+
+// hasExecBits reports whether any execute permission bit is set on a file
+func hasExecBits(path string, info fs.FileInfo) bool {
+	return info.Mode().Perm()&0o111 != 0
+}
+
 // setSysProcAttr sets the user/group credentials for command execution on Unix
 func setSysProcAttr(cmd *exec.Cmd, u *user.User) {
 	if u == nil {
@@ -37,3 +63,20 @@ func setSysProcAttr(cmd *exec.Cmd, u *user.User) {
 		},
 	}
 }
+
+// chownOutput gives a command's output file to the user it runs as
+func chownOutput(file *os.File, u *user.User) error {
+	if u == nil {
+		return nil
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+	return file.Chown(uid, gid)
+}
@@ -8,12 +8,56 @@
 package main
 
 import (
+	"io/fs"
+	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
+	"strings"
 )
 
+// Default search path for commands when the agent has no PATH
+const defaultCommandPath = `C:\Windows\system32;C:\Windows;C:\Windows\System32\Wbem`
+
+// cleanEnvKeys are the agent's environment variables kept for commands when
+// Config.CleanCommandEnv is set. Windows programs expect the system
+// directories and profile paths, so the list is longer than on Unix.
+var cleanEnvKeys = []string{
+	"PATH", "PATHEXT", "SystemRoot", "SystemDrive", "windir", "ComSpec",
+	"TEMP", "TMP", "USERNAME", "USERPROFILE", "HOMEDRIVE", "HOMEPATH",
+	"APPDATA", "LOCALAPPDATA", "ProgramData", "ProgramFiles",
+	"NUMBER_OF_PROCESSORS", "PROCESSOR_ARCHITECTURE",
+}
+
+// userEnv is a no-op on Windows, where commands always run as the agent's
+// user
+func userEnv(u *user.User) []string {
+	return nil
+}
+
+// hasExecBits reports whether a file has an extension listed in PATHEXT,
+// which is what makes a file executable on Windows
+func hasExecBits(path string, info fs.FileInfo) bool {
+	exts := os.Getenv("PATHEXT")
+	if exts == "" {
+		exts = ".com;.exe;.bat;.cmd"
+	}
+	ext := filepath.Ext(path)
+	for _, e := range strings.Split(exts, ";") {
+		if e != "" && strings.EqualFold(e, ext) {
+			return true
+		}
+	}
+	return false
+}
+
 // setSysProcAttr is a no-op on Windows
 // Running as a different user requires different mechanisms on Windows
 func setSysProcAttr(cmd *exec.Cmd, u *user.User) {
 	// Not implemented on Windows
 }
+
+// chownOutput is a no-op on Windows, where commands run as the agent's user
+func chownOutput(file *os.File, u *user.User) error {
+	return nil
+}
@@ -4,8 +4,31 @@ package main
 
 import (
 	"fmt"
+	"mime"
+	"net"
 	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Capabilities that can be disabled locally
+const (
+	CapabilityPty      = "terminal"
+	CapabilityExec     = "command execution"
+	CapabilityFileOps  = "file operations"
+	CapabilityCompress = "compression"
+)
+
+// Limits on shell arguments from the config or a spawn request
+const (
+	maxShellArgs   = 32
+	maxShellArgLen = 1024
 )
 
 // Config holds the agent configuration
@@ -14,10 +37,50 @@ type Config struct {
 	DeviceID   string // Unique device identifier
 	Token      string // Authentication token
 	SSL        bool   // Use TLS/SSL connection
-	Insecure   bool   // Skip TLS certificate verification
+	TLSOptions        // Certificate verification settings
 	Reconnect  bool   // Auto-reconnect on disconnect
 	Heartbeat  int    // Heartbeat interval in seconds
 	Debug      bool   // Enable debug logging
+
+	HeartbeatJitter     time.Duration     // Maximum random deviation from the heartbeat interval
+	KeepaliveInterval   time.Duration     // Send a heartbeat after this much outbound silence, 0 disables
+	BackoffResetAfter   time.Duration     // Time a connection must stay registered before the reconnect delay resets
+	ShutdownGracePeriod time.Duration     // Time allowed for in-flight work to finish on shutdown
+	OpTimeout           time.Duration     // Deadline for each file operation, 0 = none
+	Subprotocols        []string          // WebSocket subprotocols offered during handshake
+	Umask               os.FileMode       // Permission bits stripped from created files and folders
+	EnvAllowlist        []string          // Environment variables the server may query
+	PtyEnvPassthrough   []string          // Agent environment variables passed on to terminals (Unix)
+	MatchMaxFiles       int               // Maximum files in a download_matching archive
+	MatchMaxBytes       int64             // Maximum total size of a download_matching archive
+	ControlMaxSize      int64             // Maximum size of an incoming message other than the data message types
+	DataMaxSize         int64             // Maximum size of an incoming upload_file, upload_chunk or patch_file message
+	MaxUploadBytes      int64             // Maximum size of a file written by upload_file, including chunked uploads, 0 = unlimited
+	HealthAddr          string            // Listen address for /healthz and /readyz, empty disables
+	LogFile             string            // Additional log destination, see resolveLogFile
+	TempDir             string            // Spool directory for archives and other scratch files, empty = OS default
+	UsePAM              bool              // Start terminals through login(1) so they get a PAM session (Unix, root only)
+	ShellArgs           []string          // Arguments passed to the terminal shell
+	AllowUserFallback   bool              // Run terminals as the agent's user when the requested user cannot be used
+	MimeOverrides       map[string]string // Extension (".md") to MIME type, checked before the built-in table and the system
+	Labels              map[string]string // Operator-defined key=value tags sent at registration
+	AutoUniqueDeviceID  bool              // Append a random suffix to the device ID if the server reports a conflict
+	ReadOnly            bool              // Refuse every request that could modify the host
+	AllowedMounts       []string          // Absolute directory trees file operations are limited to, empty = unrestricted
+	AllowRoot           bool              // Permit running with euid 0
+	AllowSelfUpdate     bool              // Install updates offered by the server through version_check
+	AllowRemoteRestart  bool              // Let the server restart the agent process
+	CleanCommandEnv     bool              // Run exec_cmd commands with a minimal environment instead of the agent's
+	ConfirmDangerous    bool              // Hold commands matching DangerousPatterns until the server confirms them
+	DangerousPatterns   []string          // Regular expressions matched against "command args..."
+	PtyCompression      bool              // Let the server request deflate-compressed terminal output
+	OpLogLevel          zerolog.Level     // Level of per-request log lines; high-frequency requests are summarised instead
+
+	// Local capability switches, AND-ed with the features the server enabled
+	EnablePty      bool // Terminal sessions
+	EnableExec     bool // Remote command execution
+	EnableFileOps  bool // File manager operations
+	EnableCompress bool // Archive creation
 }
 
 // DefaultConfig returns configuration with sensible defaults
@@ -32,10 +95,30 @@ func DefaultConfig() *Config {
 		DeviceID:   hostname,
 		Token:      "",
 		SSL:        true,
-		Insecure:   false,
 		Reconnect:  true,
 		Heartbeat:  30,
 		Debug:      false,
+
+		TLSOptions: TLSOptions{
+			CACertPath: os.Getenv(caCertEnv),
+		},
+		HeartbeatJitter:     3 * time.Second,
+		BackoffResetAfter:   30 * time.Second,
+		ShutdownGracePeriod: 10 * time.Second,
+		OpTimeout:           30 * time.Minute,
+		EnvAllowlist:        append([]string(nil), defaultEnvAllowlist...),
+		MatchMaxFiles:       1000,
+		MatchMaxBytes:       1 << 30, // 1GB
+		ControlMaxSize:      64 * 1024,
+		DataMaxSize:         16 << 20, // 16MB
+		ShellArgs:           append([]string(nil), defaultShellArgs...),
+		DangerousPatterns:   append([]string(nil), defaultDangerousPatterns...),
+		OpLogLevel:          zerolog.InfoLevel,
+
+		EnablePty:      true,
+		EnableExec:     true,
+		EnableFileOps:  true,
+		EnableCompress: true,
 	}
 }
 
@@ -57,6 +140,281 @@ func (c *Config) Validate() error {
 		c.Heartbeat = 300
 	}
 
+	// Keep jitter within half the interval so heartbeats stay regular
+	if maxJitter := time.Duration(c.Heartbeat) * time.Second / 2; c.HeartbeatJitter > maxJitter {
+		c.HeartbeatJitter = maxJitter
+	}
+	if c.HeartbeatJitter < 0 {
+		c.HeartbeatJitter = 0
+	}
+
+	if c.BackoffResetAfter < 0 {
+		c.BackoffResetAfter = 0
+	}
+
+	if c.KeepaliveInterval < 0 {
+		c.KeepaliveInterval = 0
+	}
+	if c.KeepaliveInterval > 0 && c.KeepaliveInterval < time.Second {
+		c.KeepaliveInterval = time.Second
+	}
+
+	if c.TempDir != "" {
+		if err := checkWritableDir(c.TempDir); err != nil {
+			return fmt.Errorf("temp dir %s is not usable: %w", c.TempDir, err)
+		}
+	}
+
+	// Every command and file operation would run with full privilege
+	if os.Geteuid() == 0 && !c.AllowRoot {
+		return fmt.Errorf("refusing to run as root; use --allow-root if this is intended")
+	}
+
+	if c.UsePAM && runtime.GOOS == "windows" {
+		return fmt.Errorf("PAM login sessions are not supported on Windows")
+	}
+
+	if err := validateShellArgs(c.ShellArgs); err != nil {
+		return err
+	}
+
+	for _, name := range c.PtyEnvPassthrough {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return fmt.Errorf("invalid terminal environment variable name %q", name)
+		}
+	}
+
+	if len(c.Labels) > maxLabels {
+		return fmt.Errorf("too many labels: %d (max %d)", len(c.Labels), maxLabels)
+	}
+	for key, value := range c.Labels {
+		if err := validateLabel(key, value); err != nil {
+			return err
+		}
+	}
+
+	for _, mount := range c.AllowedMounts {
+		if !filepath.IsAbs(mount) {
+			return fmt.Errorf("allowed mount %q must be an absolute path", mount)
+		}
+	}
+
+	for _, p := range c.DangerousPatterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("invalid dangerous command pattern %q: %w", p, err)
+		}
+	}
+
+	if c.ControlMaxSize < minControlMaxSize {
+		c.ControlMaxSize = minControlMaxSize
+	}
+	if c.DataMaxSize < c.ControlMaxSize {
+		c.DataMaxSize = c.ControlMaxSize
+	}
+
+	if c.ShutdownGracePeriod < 0 {
+		c.ShutdownGracePeriod = 0
+	}
+	if c.OpTimeout < 0 {
+		c.OpTimeout = 0
+	}
+
+	return nil
+}
+
+// validateShellArgs rejects shell arguments that cannot be passed to exec
+func validateShellArgs(args []string) error {
+	if len(args) > maxShellArgs {
+		return fmt.Errorf("too many shell arguments (max %d)", maxShellArgs)
+	}
+	for _, arg := range args {
+		if arg == "" {
+			return fmt.Errorf("shell arguments must not be empty")
+		}
+		if len(arg) > maxShellArgLen {
+			return fmt.Errorf("shell argument too long (max %d bytes)", maxShellArgLen)
+		}
+		if strings.ContainsRune(arg, 0) {
+			return fmt.Errorf("shell argument contains a NUL byte")
+		}
+	}
+	return nil
+}
+
+// checkWritableDir verifies that files can be created in dir
+func checkWritableDir(dir string) error {
+	f, err := os.CreateTemp(dir, ".termix-write-test-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// ApplyServerFeatures disables capabilities the server did not enable
+func (c *Config) ApplyServerFeatures(features *ServerFeatures) {
+	if features == nil {
+		return
+	}
+	c.EnablePty = c.EnablePty && features.EnableTerminal
+	c.EnableFileOps = c.EnableFileOps && features.EnableFileManager
+}
+
+// CapabilityEnabled reports whether a local capability is turned on
+func (c *Config) CapabilityEnabled(capability string) bool {
+	switch capability {
+	case CapabilityPty:
+		return c.EnablePty
+	case CapabilityExec:
+		return c.EnableExec
+	case CapabilityFileOps:
+		return c.EnableFileOps
+	case CapabilityCompress:
+		return c.EnableFileOps && c.EnableCompress
+	default:
+		return true
+	}
+}
+
+// stringList is a flag.Value holding a comma-separated or repeated list
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// repeatedList is a flag.Value collecting each occurrence verbatim, for
+// values such as paths and regular expressions that may contain commas
+type repeatedList []string
+
+func (l *repeatedList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, " ")
+}
+
+func (l *repeatedList) Set(value string) error {
+	if value != "" {
+		*l = append(*l, value)
+	}
+	return nil
+}
+
+// argList is a flag.Value holding a whitespace-separated argument list.
+// Unlike stringList each Set replaces the previous value, so the default
+// can be overridden, and an empty value clears it.
+type argList []string
+
+func (l *argList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, " ")
+}
+
+func (l *argList) Set(value string) error {
+	*l = strings.Fields(value)
+	return nil
+}
+
+// mimeMap is a flag.Value collecting repeated ".ext=type" MIME overrides
+type mimeMap map[string]string
+
+func (m *mimeMap) String() string {
+	if m == nil || *m == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*m))
+	for ext, mimeType := range *m {
+		pairs = append(pairs, ext+"="+mimeType)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *mimeMap) Set(value string) error {
+	ext, mimeType, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected .ext=type, got %q", value)
+	}
+	ext = normalizeExt(ext)
+	mimeType = strings.TrimSpace(mimeType)
+	if ext == "." {
+		return fmt.Errorf("missing extension in %q", value)
+	}
+	if _, _, err := mime.ParseMediaType(mimeType); err != nil {
+		return fmt.Errorf("invalid MIME type %q: %w", mimeType, err)
+	}
+
+	if *m == nil {
+		*m = make(map[string]string)
+	}
+	(*m)[ext] = mimeType
+	return nil
+}
+
+// normalizeExt lower-cases an extension and ensures it has a leading dot
+func normalizeExt(ext string) string {
+	ext = strings.ToLower(strings.TrimSpace(ext))
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// logLevel is a flag.Value parsing a zerolog level name like "debug"
+type logLevel zerolog.Level
+
+func (l *logLevel) String() string {
+	if l == nil {
+		return ""
+	}
+	return zerolog.Level(*l).String()
+}
+
+func (l *logLevel) Set(value string) error {
+	level, err := zerolog.ParseLevel(strings.ToLower(strings.TrimSpace(value)))
+	if err != nil {
+		return err
+	}
+	if level == zerolog.NoLevel {
+		return fmt.Errorf("invalid log level %q", value)
+	}
+	*l = logLevel(level)
+	return nil
+}
+
+// octalMode is a flag.Value parsing an octal permission mask like "022"
+type octalMode os.FileMode
+
+func (m *octalMode) String() string {
+	if m == nil {
+		return "0"
+	}
+	return fmt.Sprintf("%03o", uint32(*m))
+}
+
+func (m *octalMode) Set(value string) error {
+	v, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid octal mode %q", value)
+	}
+	if v > 0777 {
+		return fmt.Errorf("mode %q exceeds 0777", value)
+	}
+	*m = octalMode(v)
 	return nil
 }
 
@@ -79,6 +437,45 @@ func Arch() string {
 	return runtime.GOARCH
 }
 
+// NetInterfaces returns the interfaces that are up and have an address
+// other than loopback or link-local
+func NetInterfaces() []NetInterface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var result []NetInterface
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		var cidrs []string
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			cidrs = append(cidrs, ipNet.String())
+		}
+		if len(cidrs) == 0 {
+			continue
+		}
+
+		result = append(result, NetInterface{
+			Name:      iface.Name,
+			MAC:       iface.HardwareAddr.String(),
+			Addresses: cidrs,
+		})
+	}
+	return result
+}
+
 // OSInfo returns OS version info
 func OSInfo() string {
 	return fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH)
@@ -0,0 +1,25 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"flag"
+	"slices"
+	"testing"
+)
+
+func TestDangerousPatternKeepsCommas(t *testing.T) {
+	config := DefaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var((*repeatedList)(&config.DangerousPatterns), "dangerous-pattern", "")
+
+	args := []string{"--dangerous-pattern", `^rm -r[a-z]{0,3}`, "--dangerous-pattern", `chmod (0?777|a\+rwx),?`}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	want := append(slices.Clone(defaultDangerousPatterns), `^rm -r[a-z]{0,3}`, `chmod (0?777|a\+rwx),?`)
+	if !slices.Equal(config.DangerousPatterns, want) {
+		t.Fatalf("patterns = %q, want %q", config.DangerousPatterns, want)
+	}
+}
@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frames queued ahead of the writer before senders block
+const (
+	urgentQueueSize = 64
+	bulkQueueSize   = 16
+)
+
+// bulkTypes are messages that can carry large payloads. They are written
+// after any queued interactive traffic so a big file frame does not hold
+// up terminal output or heartbeats.
+var bulkTypes = map[string]bool{
+	MsgTypeFileContent:         true,
+	MsgTypeFileChunk:           true,
+	MsgTypeStreamChunkResponse: true,
+	MsgTypeFileList:            true,
+	MsgTypeCmdResult:           true,
+	MsgTypeArchiveListing:      true,
+	MsgTypeReadFilesResult:     true,
+}
+
+// outbound is one frame waiting for the writer
+type outbound struct {
+	kind   int // websocket message type
+	data   []byte
+	result chan error
+}
+
+// connWriter is the only goroutine writing to a connection. Senders queue
+// frames and wait for their own frame to be written, so each sender's
+// frames stay in order and write errors are still reported to it, but no
+// lock is held across network I/O. A failed write closes the connection so
+// the read loop notices and the agent reconnects.
+type connWriter struct {
+	conn    *websocket.Conn
+	urgent  chan *outbound
+	bulk    chan *outbound
+	done    chan struct{}
+	once    sync.Once
+	onWrite func() // called after each data frame is written
+}
+
+func newConnWriter(conn *websocket.Conn, onWrite func()) *connWriter {
+	w := &connWriter{
+		conn:    conn,
+		urgent:  make(chan *outbound, urgentQueueSize),
+		bulk:    make(chan *outbound, bulkQueueSize),
+		done:    make(chan struct{}),
+		onWrite: onWrite,
+	}
+	go w.run()
+	return w
+}
+
+// send queues a frame and waits until it has been written
+func (w *connWriter) send(kind int, data []byte, bulk bool) error {
+	frame := &outbound{kind: kind, data: data, result: make(chan error, 1)}
+
+	queue := w.urgent
+	if bulk {
+		queue = w.bulk
+	}
+	select {
+	case queue <- frame:
+	case <-w.done:
+		return websocket.ErrCloseSent
+	}
+
+	select {
+	case err := <-frame.result:
+		return err
+	case <-w.done:
+		select {
+		case err := <-frame.result:
+			return err
+		default:
+			return websocket.ErrCloseSent
+		}
+	}
+}
+
+// close stops the writer and closes the connection. Queued frames are
+// dropped and their senders get websocket.ErrCloseSent.
+func (w *connWriter) close() {
+	w.once.Do(func() {
+		close(w.done)
+		w.conn.Close()
+	})
+}
+
+func (w *connWriter) run() {
+	for {
+		var frame *outbound
+		select {
+		case frame = <-w.urgent:
+		default:
+			select {
+			case frame = <-w.urgent:
+			case frame = <-w.bulk:
+			case <-w.done:
+				return
+			}
+		}
+
+		w.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		err := w.conn.WriteMessage(frame.kind, frame.data)
+		frame.result <- err
+		if err != nil {
+			w.close()
+			return
+		}
+		if frame.kind == websocket.TextMessage && w.onWrite != nil {
+			w.onWrite()
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+)
+
+// Bytes copied between checks of the context in copyContext
+const copyStep = 8 * 1024 * 1024
+
+// Block size for sparse copies. Zero runs shorter than this are written
+// out; filesystems allocate in blocks of 4KB or more anyway.
+const sparseBlockSize = 64 * 1024
+
+var zeroBlock = make([]byte, sparseBlockSize)
+
+// copySparse copies src to dst, seeking over blocks that
+// are entirely zero instead of writing them. Where the filesystem supports
+// holes they are preserved; elsewhere the skipped ranges read back as
+// zeros, so the copy is correct either way.
+func copySparse(ctx context.Context, dst, src *os.File) error {
+	buf := make([]byte, sparseBlockSize)
+	var offset int64
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			block := buf[:n]
+			if bytes.Equal(block, zeroBlock[:n]) {
+				if _, err := dst.Seek(int64(n), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := dst.Write(block); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Seeking past the end does not extend the file, so a trailing hole
+	// only exists once the length is set
+	return dst.Truncate(offset)
+}
+
+// copyContext copies src to dst like io.Copy, stopping with ctx's error
+// between steps once it is done. Each step is an io.CopyN so copies between
+// files keep the kernel's fast paths.
+func copyContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	var written int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+
+		n, err := io.CopyN(dst, src, copyStep)
+		written += n
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
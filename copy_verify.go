@@ -0,0 +1,138 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Directories holding more than this many bytes are verified by file sizes
+// and count only, as re-reading both trees would take too long
+const verifyChecksumCap = 1 << 30 // 1GB
+
+// ErrCopyMismatch is returned when a verified copy differs from its source
+var ErrCopyMismatch = errors.New("copy does not match source")
+
+// verifyCopy checks that dst holds the same content as src. Files are
+// compared by SHA-256; directories by their set of files and sizes, and by
+// checksum as well while the total size is within verifyChecksumCap.
+func verifyCopy(ctx context.Context, src, dst string, isDir bool) error {
+	if !isDir {
+		return compareFileHashes(src, dst)
+	}
+
+	srcFiles, total, err := treeSizes(ctx, src)
+	if err != nil {
+		return err
+	}
+	dstFiles, _, err := treeSizes(ctx, dst)
+	if err != nil {
+		return err
+	}
+
+	if len(srcFiles) != len(dstFiles) {
+		return fmt.Errorf("%w: %d files copied, source has %d", ErrCopyMismatch, len(dstFiles), len(srcFiles))
+	}
+	for rel, size := range srcFiles {
+		dstSize, ok := dstFiles[rel]
+		if !ok {
+			return fmt.Errorf("%w: %s is missing", ErrCopyMismatch, rel)
+		}
+		if dstSize != size {
+			return fmt.Errorf("%w: %s has %d bytes, source has %d", ErrCopyMismatch, rel, dstSize, size)
+		}
+	}
+
+	if total > verifyChecksumCap {
+		return nil
+	}
+	for rel := range srcFiles {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		srcPath, dstPath := filepath.Join(src, rel), filepath.Join(dst, rel)
+		if target, err := os.Readlink(longPath(srcPath)); err == nil {
+			if copied, err := os.Readlink(longPath(dstPath)); err != nil || copied != target {
+				return fmt.Errorf("%w: link %s was not copied", ErrCopyMismatch, rel)
+			}
+			continue
+		}
+		if err := compareFileHashes(srcPath, dstPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeSizes returns the size of every non-directory entry under root by
+// relative path, and their total. Symlinks are sized as links, not by
+// their targets, as copyDir copies them as links.
+func treeSizes(ctx context.Context, root string) (map[string]int64, int64, error) {
+	sizes := make(map[string]int64)
+	var total int64
+
+	err := filepath.WalkDir(longPath(root), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(longPath(root), path)
+		if err != nil {
+			return err
+		}
+		sizes[rel] = info.Size()
+		total += info.Size()
+		return nil
+	})
+	return sizes, total, err
+}
+
+// compareFileHashes returns ErrCopyMismatch if the two files differ
+func compareFileHashes(src, dst string) error {
+	srcSum, err := fileSha256(src)
+	if err != nil {
+		return err
+	}
+	dstSum, err := fileSha256(dst)
+	if err != nil {
+		return err
+	}
+	if srcSum != dstSum {
+		return fmt.Errorf("%w: checksum of %s differs", ErrCopyMismatch, filepath.Base(dst))
+	}
+	return nil
+}
+
+func fileSha256(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	file, err := os.Open(longPath(path))
+	if err != nil {
+		return sum, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
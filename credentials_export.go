@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const (
+	// Environment variable holding the passphrase for credential exports
+	credentialsPassphraseEnv = "TERMIX_CREDENTIALS_PASSPHRASE"
+
+	credentialsExportVersion = 1
+	credentialsKDF           = "pbkdf2-sha256"
+	credentialsKDFIterations = 600000
+	credentialsSaltSize      = 16
+	minPassphraseLen         = 8
+)
+
+var (
+	ErrWrongPassphrase = errors.New("wrong passphrase or corrupt export")
+	ErrBadExport       = errors.New("not a credentials export")
+)
+
+// credentialsExport is the file written by export-credentials. Exactly one
+// of Credentials (plaintext) and Ciphertext (AES-256-GCM under a key derived
+// from the passphrase) is set.
+type credentialsExport struct {
+	Version     int                `json:"version"`
+	Credentials *StoredCredentials `json:"credentials,omitempty"`
+
+	KDF        string `json:"kdf,omitempty"`
+	Iterations int    `json:"iterations,omitempty"`
+	Salt       []byte `json:"salt,omitempty"`
+	Nonce      []byte `json:"nonce,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+}
+
+// exportCredentials serialises creds, encrypting them unless passphrase is
+// empty
+func exportCredentials(creds *StoredCredentials, passphrase string) ([]byte, error) {
+	export := credentialsExport{Version: credentialsExportVersion}
+
+	if passphrase == "" {
+		export.Credentials = creds
+	} else {
+		plaintext, err := json.Marshal(creds)
+		if err != nil {
+			return nil, err
+		}
+
+		export.KDF = credentialsKDF
+		export.Iterations = credentialsKDFIterations
+		export.Salt = make([]byte, credentialsSaltSize)
+		if _, err := rand.Read(export.Salt); err != nil {
+			return nil, err
+		}
+
+		aead, err := credentialsCipher(passphrase, export.Salt, export.Iterations)
+		if err != nil {
+			return nil, err
+		}
+		export.Nonce = make([]byte, aead.NonceSize())
+		if _, err := rand.Read(export.Nonce); err != nil {
+			return nil, err
+		}
+		export.Ciphertext = aead.Seal(nil, export.Nonce, plaintext, nil)
+	}
+
+	return json.MarshalIndent(export, "", "  ")
+}
+
+// importCredentials parses an export, decrypting it with passphrase if it
+// is encrypted. getPassphrase is only called for encrypted exports.
+func importCredentials(data []byte, getPassphrase func() (string, error)) (*StoredCredentials, error) {
+	var export credentialsExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadExport, err)
+	}
+	if export.Version != credentialsExportVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadExport, export.Version)
+	}
+
+	creds := export.Credentials
+	if export.Ciphertext != nil {
+		if export.KDF != credentialsKDF || export.Iterations <= 0 {
+			return nil, fmt.Errorf("%w: unsupported key derivation %q", ErrBadExport, export.KDF)
+		}
+
+		passphrase, err := getPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		aead, err := credentialsCipher(passphrase, export.Salt, export.Iterations)
+		if err != nil {
+			return nil, err
+		}
+		if len(export.Nonce) != aead.NonceSize() {
+			return nil, fmt.Errorf("%w: bad nonce", ErrBadExport)
+		}
+		plaintext, err := aead.Open(nil, export.Nonce, export.Ciphertext, nil)
+		if err != nil {
+			return nil, ErrWrongPassphrase
+		}
+
+		creds = new(StoredCredentials)
+		if err := json.Unmarshal(plaintext, creds); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadExport, err)
+		}
+	}
+
+	if creds == nil || creds.ServerAddr == "" || creds.AgentToken == "" {
+		return nil, fmt.Errorf("%w: missing server address or agent token", ErrBadExport)
+	}
+	return creds, nil
+}
+
+// credentialsCipher derives an AES-256-GCM cipher from passphrase
+func credentialsCipher(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readPassphrase returns the export passphrase from file, the environment,
+// or by prompting on stderr and reading a line from in without echo if it is
+// a terminal
+func readPassphrase(file string, in io.Reader) (string, error) {
+	var passphrase string
+	switch {
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	case os.Getenv(credentialsPassphraseEnv) != "":
+		passphrase = os.Getenv(credentialsPassphraseEnv)
+	default:
+		if in == nil {
+			return "", fmt.Errorf("passphrase required: use --passphrase-file or set %s", credentialsPassphraseEnv)
+		}
+		fmt.Fprint(os.Stderr, "Passphrase: ")
+		line, err := readPassphraseLine(in)
+		if err != nil {
+			return "", fmt.Errorf("failed to read passphrase: %w", err)
+		}
+		passphrase = line
+	}
+
+	if len(passphrase) < minPassphraseLen {
+		return "", fmt.Errorf("passphrase must be at least %d characters", minPassphraseLen)
+	}
+	return passphrase, nil
+}
+
+// readPassphraseLine reads one line from in, turning off echo while it is
+// typed if in is a terminal
+func readPassphraseLine(in io.Reader) (string, error) {
+	if file, ok := in.(*os.File); ok && term.IsTerminal(int(file.Fd())) {
+		line, err := term.ReadPassword(int(file.Fd()))
+		fmt.Fprintln(os.Stderr) // the user's newline was not echoed
+		return string(line), err
+	}
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
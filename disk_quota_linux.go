@@ -0,0 +1,128 @@
+//go:build linux
+// +build linux
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	qGetQuota   = 0x800007 // Q_GETQUOTA
+	usrQuota    = 0        // USRQUOTA
+	quotaBlock  = 1024     // QIF_DQBLKSIZE, unit of the block limits
+	subCmdShift = 8
+)
+
+// ifDqblk mirrors struct if_dqblk from linux/quota.h
+type ifDqblk struct {
+	BHardLimit uint64
+	BSoftLimit uint64
+	CurSpace   uint64
+	IHardLimit uint64
+	ISoftLimit uint64
+	CurInodes  uint64
+	BTime      uint64
+	ITime      uint64
+	Valid      uint32
+	_          uint32
+}
+
+// userQuota returns the agent user's quota on the filesystem holding path,
+// or nil if quotas are not enabled there, cannot be read, or the user has
+// no limits
+func userQuota(path string) *DiskQuota {
+	device := mountDevice(resolvePath(path))
+	if device == "" {
+		return nil
+	}
+	dev, err := syscall.BytePtrFromString(device)
+	if err != nil {
+		return nil
+	}
+
+	var dq ifDqblk
+	_, _, errno := syscall.Syscall6(syscall.SYS_QUOTACTL,
+		uintptr(qGetQuota<<subCmdShift|usrQuota),
+		uintptr(unsafe.Pointer(dev)),
+		uintptr(os.Geteuid()),
+		uintptr(unsafe.Pointer(&dq)),
+		0, 0)
+	if errno != 0 {
+		return nil
+	}
+	if dq.BHardLimit == 0 && dq.BSoftLimit == 0 && dq.IHardLimit == 0 && dq.ISoftLimit == 0 {
+		return nil
+	}
+
+	return &DiskQuota{
+		Used:       dq.CurSpace,
+		Soft:       dq.BSoftLimit * quotaBlock,
+		Hard:       dq.BHardLimit * quotaBlock,
+		InodesUsed: dq.CurInodes,
+		InodesSoft: dq.ISoftLimit,
+		InodesHard: dq.IHardLimit,
+	}
+}
+
+// mountDevice returns the source device of the mount holding path, taken
+// from the longest matching mount point in /proc/self/mountinfo
+func mountDevice(path string) string {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	var device, best string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// id parent major:minor root mountpoint options [optional...] - fstype source superoptions
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+2 >= len(fields) {
+			continue
+		}
+
+		mountPoint := unescapeMountField(fields[4])
+		if hasPathPrefix(path, mountPoint) && len(mountPoint) >= len(best) {
+			best = mountPoint
+			device = unescapeMountField(fields[sep+2])
+		}
+	}
+	return device
+}
+
+// unescapeMountField decodes the octal escapes (\040 for space) the kernel
+// uses in mountinfo fields
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
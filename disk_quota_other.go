@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+// userQuota is only implemented on Linux. On Windows the available space
+// from diskSpace already reflects the user's quota.
+func userQuota(path string) *DiskQuota {
+	return nil
+}
@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// checkFreeSpace verifies that writing size bytes to path, replacing any
+// existing file there, fits on its filesystem. Sends a 507 error and
+// returns false if it does not. If free space cannot be determined the
+// write is allowed to proceed.
+func (f *FileOps) checkFreeSpace(requestID, path string, size int64) bool {
+	need := size
+	if info, err := os.Stat(longPath(path)); err == nil && info.Mode().IsRegular() {
+		need -= info.Size()
+	}
+	if need <= 0 {
+		return true
+	}
+
+	dir := existingDir(path)
+	_, _, avail, err := diskSpace(dir)
+	if err != nil {
+		return true
+	}
+	if uint64(need) > avail {
+		f.sendError(requestID, 507, fmt.Sprintf("Not enough free space: %d bytes needed, %d available", need, avail))
+		f.emitDiskEvent("disk full, write refused", map[string]any{"path": dir, "needed": need, "available": avail})
+		return false
+	}
+
+	if quota := userQuota(dir); quota != nil && quota.Hard > 0 && quota.Used+uint64(need) > quota.Hard {
+		f.sendError(requestID, 507, fmt.Sprintf("Disk quota exceeded: %d bytes needed, %d of %d used", need, quota.Used, quota.Hard))
+		f.emitDiskEvent("disk quota exceeded, write refused", map[string]any{"path": dir, "needed": need, "used": quota.Used, "hard": quota.Hard})
+		return false
+	}
+	return true
+}
+
+// checkMoveSpace verifies that copying src to dst, as a move across
+// filesystems does, fits on dst's filesystem. Sends an error and returns
+// false if it does not.
+func (f *FileOps) checkMoveSpace(ctx context.Context, requestID, src, dst string) bool {
+	size, err := treeSize(ctx, src)
+	if err != nil {
+		f.sendError(requestID, 500, fmt.Sprintf("Failed to size %s: %v", src, err))
+		return false
+	}
+	return f.checkFreeSpace(requestID, dst, size)
+}
+
+// treeSize returns the total size of the regular files at or under path
+func treeSize(ctx context.Context, path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(longPath(path), func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// DiskUsage reports the space on the filesystem holding a path and the
+// agent user's quota there, if one is set
+func (f *FileOps) DiskUsage(data *DiskUsageData) {
+	result := DiskUsageResultData{RequestID: data.RequestID, Path: data.Path}
+	dir := data.Path
+	if _, err := os.Stat(longPath(dir)); err != nil {
+		dir = existingDir(dir)
+	}
+	total, free, avail, err := diskSpace(dir)
+	if err != nil {
+		result.Error = fmt.Sprintf("Failed to get disk usage: %v", err)
+		f.sendFinal(data.RequestID, MsgTypeDiskUsageResult, result)
+		return
+	}
+
+	result.Total = total
+	result.Free = free
+	result.Available = avail
+	result.Quota = userQuota(dir)
+	f.sendFinal(data.RequestID, MsgTypeDiskUsageResult, result)
+}
+
+// existingDir returns the nearest directory containing path that exists
+func existingDir(path string) string {
+	dir := path
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+		if info, err := os.Stat(longPath(dir)); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+import "syscall"
+
+// diskSpace returns the size of the filesystem holding path, its free
+// bytes and the bytes available to unprivileged users
+func diskSpace(path string) (total, free, avail uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, 0, err
+	}
+	bsize := uint64(st.Bsize)
+	return uint64(st.Blocks) * bsize, uint64(st.Bfree) * bsize, uint64(st.Bavail) * bsize, nil
+}
@@ -0,0 +1,34 @@
+//go:build windows
+// +build windows
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceExW = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// diskSpace returns the size of the volume holding path, its free bytes
+// and the bytes available to the agent's user, which already accounts for
+// NTFS quotas
+func diskSpace(path string) (total, free, avail uint64, err error) {
+	p, err := syscall.UTF16PtrFromString(longPath(path))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	ret, _, err := procGetDiskFreeSpaceExW.Call(
+		uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&avail)),
+		uintptr(unsafe.Pointer(&total)),
+		uintptr(unsafe.Pointer(&free)),
+	)
+	if ret == 0 {
+		return 0, 0, 0, err
+	}
+	return total, free, avail, nil
+}
@@ -0,0 +1,148 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Dry runs validate a destructive operation and report what it would do
+// without touching anything. Their results are not remembered for request
+// replay, so the same request ID can be reused for the real operation.
+
+func (f *FileOps) sendDryRun(result FileOpResultData) {
+	result.Success = true
+	result.DryRun = true
+	f.sendFinal(result.RequestID, MsgTypeFileOpResult, result)
+}
+
+// checkDirWritable reports an error if the agent cannot create or remove
+// entries in dir
+func checkDirWritable(dir string) error {
+	info, err := os.Stat(longPath(dir))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	probe, err := newAccessProbe("")
+	if err != nil {
+		return err
+	}
+	if access := probe.check(longPath(dir), info); !access.Write || !access.Execute {
+		return fmt.Errorf("permission denied: cannot modify %s", dir)
+	}
+	return nil
+}
+
+func (f *FileOps) dryRunDeleteItem(data *DeleteItemData) {
+	info, code, err := checkDelete(data.Path, data.IsDirectory)
+	if err != nil {
+		f.sendError(data.RequestID, code, fmt.Sprintf("Failed to delete: %v", err))
+		return
+	}
+	if err := checkDirWritable(filepath.Dir(data.Path)); err != nil {
+		f.sendError(data.RequestID, 403, fmt.Sprintf("Failed to delete: %v", err))
+		return
+	}
+
+	message := fmt.Sprintf("Would delete %s", data.Path)
+	switch {
+	case info.IsDir() && data.IsDirectory:
+		message += " and everything in it"
+	case info.IsDir():
+		message = fmt.Sprintf("Would delete the empty directory %s", data.Path)
+	}
+	f.sendDryRun(FileOpResultData{RequestID: data.RequestID, Message: message, ResultPath: data.Path})
+}
+
+func (f *FileOps) dryRunCopyItem(data *CopyItemData) {
+	if _, err := os.Stat(longPath(data.SourcePath)); err != nil {
+		f.sendError(data.RequestID, 404, fmt.Sprintf("Failed to stat source: %v", err))
+		return
+	}
+	if err := checkDirWritable(data.TargetDir); err != nil {
+		f.sendError(data.RequestID, 403, fmt.Sprintf("Failed to copy: %v", err))
+		return
+	}
+
+	baseName := filepath.Base(data.SourcePath)
+	targetPath, uniqueName := uniqueTarget(data.TargetDir, baseName)
+
+	message := fmt.Sprintf("Would copy %s to %s", data.SourcePath, targetPath)
+	if uniqueName != baseName {
+		message += fmt.Sprintf(" (%s already exists)", baseName)
+	}
+	f.sendDryRun(FileOpResultData{
+		RequestID:  data.RequestID,
+		Message:    message,
+		UniqueName: uniqueName,
+		ResultPath: targetPath,
+	})
+}
+
+func (f *FileOps) dryRunMoveItem(ctx context.Context, data *MoveItemData) {
+	result, code, err := dryRunRename(data.SourcePath, data.TargetPath)
+	if err != nil {
+		f.sendError(data.RequestID, code, fmt.Sprintf("Failed to move: %v", err))
+		return
+	}
+	if result.crossDevice && !f.checkMoveSpace(ctx, data.RequestID, data.SourcePath, data.TargetPath) {
+		return
+	}
+	result.RequestID = data.RequestID
+	result.Message = "Would move " + result.Message
+	f.sendDryRun(result.FileOpResultData)
+}
+
+func (f *FileOps) dryRunRenameItem(data *RenameItemData) {
+	newPath := filepath.Join(filepath.Dir(data.Path), data.NewName)
+	result, code, err := dryRunRename(data.Path, newPath)
+	if err != nil {
+		f.sendError(data.RequestID, code, fmt.Sprintf("Failed to rename: %v", err))
+		return
+	}
+	result.RequestID = data.RequestID
+	result.Message = "Would rename " + result.Message
+	f.sendDryRun(result.FileOpResultData)
+}
+
+// dryRunResult is a dry run's result along with the move it checked
+type dryRunResult struct {
+	FileOpResultData
+	movePlan
+}
+
+// dryRunRename checks that src can be moved to dst, returning the result
+// to report (message without the verb) or an error and its status code
+func dryRunRename(src, dst string) (dryRunResult, int, error) {
+	result := dryRunResult{FileOpResultData: FileOpResultData{ResultPath: filepath.Clean(dst)}}
+
+	plan, code, err := planMove(src, dst)
+	if err != nil {
+		return result, code, err
+	}
+	result.movePlan = plan
+
+	if err := checkDirWritable(filepath.Dir(src)); err != nil {
+		return result, 403, err
+	}
+	if err := checkDirWritable(filepath.Dir(dst)); err != nil {
+		return result, 403, err
+	}
+
+	result.Message = fmt.Sprintf("%s to %s", src, dst)
+	if plan.overwrite {
+		result.WouldOverwrite = true
+		result.Message += ", replacing the existing item"
+	}
+	if plan.crossDevice {
+		result.Message += ", copying it to another filesystem"
+	}
+	return result, 0, nil
+}
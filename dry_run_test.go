@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// outcome returns 0 for a successful last response or its error code
+func outcome(t *testing.T, sent *sentLog) int {
+	t.Helper()
+	switch data := sent.last(t).data.(type) {
+	case FileOpResultData:
+		if !data.Success {
+			t.Fatalf("unsuccessful result %+v", data)
+		}
+		return 0
+	case FileErrorData:
+		return data.Code
+	default:
+		t.Fatalf("unexpected response %+v", data)
+		return -1
+	}
+}
+
+func TestDryRunMatchesRealOperation(t *testing.T) {
+	// Each case lays out a tree under dir and runs an operation on it
+	tests := []struct {
+		name     string
+		files    []string // trailing / makes a directory
+		run      func(f *FileOps, dir string, dryRun bool)
+		wantCode int
+		unixOnly bool
+	}{
+		{
+			name:  "delete empty directory without isDirectory",
+			files: []string{"empty/"},
+			run: func(f *FileOps, dir string, dryRun bool) {
+				f.DeleteItem(&DeleteItemData{RequestID: "del", Path: filepath.Join(dir, "empty"), DryRun: dryRun})
+			},
+		},
+		{
+			name:  "delete full directory without isDirectory",
+			files: []string{"full/", "full/a"},
+			run: func(f *FileOps, dir string, dryRun bool) {
+				f.DeleteItem(&DeleteItemData{RequestID: "del", Path: filepath.Join(dir, "full"), DryRun: dryRun})
+			},
+			wantCode: 409,
+		},
+		{
+			name: "delete missing path",
+			run: func(f *FileOps, dir string, dryRun bool) {
+				f.DeleteItem(&DeleteItemData{RequestID: "del", Path: filepath.Join(dir, "gone"), IsDirectory: true, DryRun: dryRun})
+			},
+			wantCode: 404,
+		},
+		{
+			name:  "move directory onto empty directory",
+			files: []string{"src/", "src/a", "dst/"},
+			run: func(f *FileOps, dir string, dryRun bool) {
+				f.MoveItem(context.Background(), &MoveItemData{RequestID: "mv", SourcePath: filepath.Join(dir, "src"), TargetPath: filepath.Join(dir, "dst"), DryRun: dryRun})
+			},
+			unixOnly: true,
+		},
+		{
+			name:  "move directory onto full directory",
+			files: []string{"src/", "dst/", "dst/a"},
+			run: func(f *FileOps, dir string, dryRun bool) {
+				f.MoveItem(context.Background(), &MoveItemData{RequestID: "mv", SourcePath: filepath.Join(dir, "src"), TargetPath: filepath.Join(dir, "dst"), DryRun: dryRun})
+			},
+			wantCode: 409,
+		},
+		{
+			name:  "move file onto directory",
+			files: []string{"a", "dst/"},
+			run: func(f *FileOps, dir string, dryRun bool) {
+				f.MoveItem(context.Background(), &MoveItemData{RequestID: "mv", SourcePath: filepath.Join(dir, "a"), TargetPath: filepath.Join(dir, "dst"), DryRun: dryRun})
+			},
+			wantCode: 409,
+		},
+		{
+			name:  "rename file onto file",
+			files: []string{"a", "b"},
+			run: func(f *FileOps, dir string, dryRun bool) {
+				f.RenameItem(&RenameItemData{RequestID: "ren", Path: filepath.Join(dir, "a"), NewName: "b", DryRun: dryRun})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.unixOnly && runtime.GOOS == "windows" {
+				t.Skip("Windows cannot rename onto a directory")
+			}
+
+			dir := t.TempDir()
+			for _, name := range tt.files {
+				path := filepath.Join(dir, name)
+				var err error
+				if name[len(name)-1] == '/' {
+					err = os.Mkdir(path, 0755)
+				} else {
+					err = os.WriteFile(path, []byte("x"), 0644)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			f, sent := newTestFileOps(t)
+			tt.run(f, dir, true)
+			if got := outcome(t, sent); got != tt.wantCode {
+				t.Fatalf("dry run code = %d, want %d", got, tt.wantCode)
+			}
+			tt.run(f, dir, false)
+			if got := outcome(t, sent); got != tt.wantCode {
+				t.Fatalf("real operation code = %d, want %d", got, tt.wantCode)
+			}
+		})
+	}
+}
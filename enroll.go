@@ -3,42 +3,61 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
-	"runtime"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
 )
 
+// What Enroll does when the keychain cannot store the agent token
+const (
+	KeychainFallbackFile  = "file"  // write the fallback credentials file
+	KeychainFallbackPrint = "print" // print the credentials for manual storage
+	KeychainFallbackNone  = "none"  // fail the enrollment
+)
+
 // EnrollConfig holds enrollment configuration
 type EnrollConfig struct {
-	Server   string
-	Token    string
-	DeviceID string
-	SSL      bool
-	Insecure bool
+	Server           string
+	Token            string
+	DeviceID         string
+	SSL              bool
+	KeychainFallback string // see KeychainFallback*
+	TLSOptions
+}
+
+// ServerFeatures are the features the server enabled for this agent
+type ServerFeatures struct {
+	EnableTerminal    bool `json:"enableTerminal"`
+	EnableFileManager bool `json:"enableFileManager"`
+	EnableTunnels     bool `json:"enableTunnels"`
 }
 
 // EnrollAckData is the server response to enrollment
 type EnrollAckData struct {
-	Success    bool   `json:"success"`
-	Message    string `json:"message,omitempty"`
-	AgentID    string `json:"agentId,omitempty"`
-	AgentToken string `json:"agentToken,omitempty"`
-	Config     struct {
-		EnableTerminal    bool `json:"enableTerminal"`
-		EnableFileManager bool `json:"enableFileManager"`
-		EnableTunnels     bool `json:"enableTunnels"`
-	} `json:"config,omitempty"`
+	Success    bool           `json:"success"`
+	Message    string         `json:"message,omitempty"`
+	AgentID    string         `json:"agentId,omitempty"`
+	AgentToken string         `json:"agentToken,omitempty"`
+	Config     ServerFeatures `json:"config,omitempty"`
 }
 
-// Enroll connects to server with install token and retrieves agent token
-func Enroll(cfg *EnrollConfig) error {
+// enrollAckTimeout bounds the wait for the server's register_ack, and
+// enrollProgressInterval is how often the wait is reported meanwhile
+const (
+	enrollAckTimeout       = 30 * time.Second
+	enrollProgressInterval = 5 * time.Second
+)
+
+// Enroll connects to server with install token and retrieves agent token.
+// Cancelling ctx aborts the enrollment promptly, including while waiting
+// for the server to respond.
+func Enroll(ctx context.Context, cfg *EnrollConfig) error {
 	if cfg.DeviceID == "" {
 		hostname, _ := os.Hostname()
 		if hostname == "" {
@@ -60,33 +79,37 @@ func Enroll(cfg *EnrollConfig) error {
 	}
 
 	if cfg.SSL {
-		dialer.TLSClientConfig = &tls.Config{
-			InsecureSkipVerify: cfg.Insecure,
+		tlsConfig, err := buildTLSConfig(cfg.TLSOptions)
+		if err != nil {
+			return err
 		}
+		dialer.TLSClientConfig = tlsConfig
 	}
 
 	header := http.Header{}
 	header.Set("Authorization", "Bearer "+cfg.Token)
 
-	conn, _, err := dialer.Dial(url, header)
+	fmt.Printf("Connecting to %s...\n", cfg.Server)
+	conn, _, err := dialer.DialContext(ctx, url, header)
 	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("enrollment cancelled: %w", ctx.Err())
+		}
 		return fmt.Errorf("failed to connect: %w", err)
 	}
 	defer conn.Close()
 
+	// Closing the connection unblocks the read below on cancellation
+	stopClose := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stopClose()
+
+	fingerprint := peerFingerprint(conn)
+	if fingerprint != "" {
+		fmt.Printf("Server certificate SHA-256: %s\n", fingerprint)
+	}
+
 	// Send registration with install token
-	hostname, _ := os.Hostname()
-	regData := RegisterData{
-		DeviceID:  cfg.DeviceID,
-		Token:     cfg.Token,
-		Hostname:  hostname,
-		Platform:  Platform(),
-		OS:        OSInfo(),
-		Arch:      Arch(),
-		GoVersion: runtime.Version(),
-	}
-
-	msg, err := MarshalMessage(MsgTypeRegister, regData)
+	msg, err := MarshalMessage(MsgTypeRegister, newRegisterData(cfg.DeviceID, cfg.Token, nil))
 	if err != nil {
 		return fmt.Errorf("failed to marshal registration: %w", err)
 	}
@@ -96,9 +119,15 @@ func Enroll(cfg *EnrollConfig) error {
 	}
 
 	// Wait for response
-	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	fmt.Println("Connected, waiting for server acknowledgment...")
+	conn.SetReadDeadline(time.Now().Add(enrollAckTimeout))
+	stopProgress := enrollProgress(time.Now())
 	_, respData, err := conn.ReadMessage()
+	stopProgress()
 	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("enrollment cancelled: %w", ctx.Err())
+		}
 		return fmt.Errorf("failed to read response: %w", err)
 	}
 
@@ -127,10 +156,21 @@ func Enroll(cfg *EnrollConfig) error {
 		AgentID:    ackData.AgentID,
 		DeviceID:   cfg.DeviceID,
 		SSL:        cfg.SSL,
+
+		CACertPath:        cfg.CACertPath,
+		PinnedCertSHA256:  cfg.PinnedCertSHA256,
+		ServerFingerprint: fingerprint,
+		Features:          &ackData.Config,
 	}
 
+	storedIn := "system keychain"
 	if err := SaveCredentials(creds); err != nil {
-		return fmt.Errorf("failed to store credentials in keychain: %w", err)
+		// The server already registered the agent, so losing the token here
+		// would waste the install token and orphan the server-side record
+		storedIn, err = saveCredentialsFallback(cfg.KeychainFallback, creds, err)
+		if err != nil {
+			return err
+		}
 	}
 
 	log.Info().
@@ -141,8 +181,62 @@ func Enroll(cfg *EnrollConfig) error {
 	fmt.Println("Enrollment successful!")
 	fmt.Printf("Agent ID: %s\n", ackData.AgentID)
 	fmt.Printf("Server: %s\n", cfg.Server)
-	fmt.Println("\nCredentials stored in system keychain.")
+	fmt.Printf("\nCredentials stored in %s.\n", storedIn)
 	fmt.Println("Run 'termix-agent' to connect.")
 
 	return nil
 }
+
+// enrollProgress reports how long enrollment has been waiting for the
+// server until the returned function is called
+func enrollProgress(start time.Time) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(enrollProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				waited := time.Since(start).Round(time.Second)
+				fmt.Printf("Still waiting for server acknowledgment (%s of %s, Ctrl-C to abort)...\n", waited, enrollAckTimeout)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// saveCredentialsFallback handles a keychain write failure according to
+// mode. It returns a description of where the credentials were stored.
+func saveCredentialsFallback(mode string, creds *StoredCredentials, keychainErr error) (string, error) {
+	log.Warn().Err(keychainErr).Str("fallback", mode).Msg("failed to store credentials in keychain")
+
+	switch mode {
+	case KeychainFallbackNone:
+		return "", fmt.Errorf("failed to store credentials in keychain: %w", keychainErr)
+
+	case KeychainFallbackFile:
+		path, err := SaveCredentialsFile(creds)
+		if err == nil {
+			fmt.Printf("Warning: system keychain unavailable (%v).\n", keychainErr)
+			fmt.Printf("The agent token is stored unencrypted in %s (mode 0600).\n", path)
+			return path, nil
+		}
+		log.Error().Err(err).Msg("failed to write credentials file")
+	}
+
+	// Last resort: hand the credentials to the operator rather than lose them
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to store credentials in keychain: %w", keychainErr)
+	}
+
+	path, _ := credentialsFilePath()
+	fmt.Println("The server accepted this agent, but its credentials could not be stored.")
+	fmt.Printf("To use them, save the following to %s with mode 0600:\n\n", path)
+	fmt.Println(string(data))
+	fmt.Println()
+
+	return "", fmt.Errorf("failed to store credentials in keychain: %w", keychainErr)
+}
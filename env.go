@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+// defaultEnvAllowlist is the set of environment variables the server may
+// query when no allowlist is configured
+var defaultEnvAllowlist = []string{"PATH", "LANG", "LC_*", "TERM", "SHELL", "HOME", "USER", "TZ"}
+
+// sensitiveEnvMarkers flag variable names that likely hold secrets. These are
+// only returned when listed by exact name, never through a wildcard pattern.
+var sensitiveEnvMarkers = []string{"TOKEN", "SECRET", "KEY", "PASSWORD", "CREDENTIAL"}
+
+// LookupEnv returns the requested environment variables, reporting names
+// outside the allowlist as denied and absent ones as unset
+func LookupEnv(allowlist, names []string) []EnvVar {
+	vars := make([]EnvVar, 0, len(names))
+	for _, name := range names {
+		if !envAllowed(allowlist, name) {
+			vars = append(vars, EnvVar{Name: name, Denied: true})
+			continue
+		}
+
+		value, set := os.LookupEnv(name)
+		vars = append(vars, EnvVar{Name: name, Value: value, Set: set})
+	}
+	return vars
+}
+
+// envAllowed checks a variable name against the allowlist
+func envAllowed(allowlist []string, name string) bool {
+	sensitive := isSensitiveEnv(name)
+
+	for _, pattern := range allowlist {
+		if pattern == name {
+			return true
+		}
+		if sensitive {
+			continue
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isSensitiveEnv(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, marker := range sensitiveEnvMarkers {
+		if strings.Contains(upper, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// diskEventInterval limits how often a full disk is reported, since every
+// write that fails the free space check would otherwise raise one
+const diskEventInterval = time.Minute
+
+// newAgentEvent builds an event stamped with the current time
+func newAgentEvent(category, severity, message string, fields map[string]any) AgentEventData {
+	return AgentEventData{
+		Category: category,
+		Severity: severity,
+		Message:  message,
+		Fields:   fields,
+		Time:     time.Now().Format(time.RFC3339),
+	}
+}
+
+// emitEvent sends an event to the server. Events are not queued: one
+// raised while disconnected is only logged.
+func (a *Agent) emitEvent(category, severity, message string, fields map[string]any) {
+	if !a.registered.Load() {
+		log.Debug().Str("category", category).Str("message", message).Msg("not connected, dropping agent event")
+		return
+	}
+	if err := a.sendMessage(MsgTypeAgentEvent, newAgentEvent(category, severity, message, fields)); err != nil {
+		log.Debug().Err(err).Str("category", category).Msg("failed to send agent event")
+	}
+}
+
+// emitDiskEvent reports a write refused for lack of space, at most once
+// per diskEventInterval
+func (f *FileOps) emitDiskEvent(message string, fields map[string]any) {
+	now := time.Now().UnixNano()
+	last := f.diskEventAt.Load()
+	if now-last < int64(diskEventInterval) || !f.diskEventAt.CompareAndSwap(last, now) {
+		return
+	}
+	f.sendResult(MsgTypeAgentEvent, newAgentEvent(EventCategoryDisk, EventSeverityCritical, message, fields))
+}
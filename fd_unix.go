@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// fdUsage returns the number of open file descriptors and the soft
+// RLIMIT_NOFILE. ok is false if either cannot be determined.
+func fdUsage() (open int, limit uint64, ok bool) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return 0, 0, false
+	}
+
+	dir := "/dev/fd"
+	if runtime.GOOS == "linux" {
+		dir = "/proc/self/fd"
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	// Don't count the descriptor used to read the directory
+	return len(entries) - 1, uint64(rlim.Cur), true
+}
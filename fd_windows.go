@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+// fdUsage is not tracked on Windows, where handles are not limited by ulimit
+func fdUsage() (open int, limit uint64, ok bool) {
+	return 0, 0, false
+}
@@ -5,8 +5,12 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"mime"
@@ -16,27 +20,81 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	defaultDownloadChunkSize = 32 * 1024
+	maxDownloadChunkSize     = 1024 * 1024
+
+	// Bounds for stream_chunk. The server may read one file with several
+	// concurrent requests, but each holds a descriptor and a buffer.
+	maxStreamChunkSize         = 8 * 1024 * 1024
+	maxConcurrentChunksPerFile = 8
+
+	// list_archive returns at most maxArchiveEntries, archiveListingBatch
+	// per frame
+	maxArchiveEntries   = 10000
+	archiveListingBatch = 500
+
+	// read_files limits
+	maxReadFiles         = 64
+	defaultReadFilesEach = 64 * 1024
+	maxReadFilesEach     = 1024 * 1024
+	maxReadFilesTotal    = 4 * 1024 * 1024
+
+	// delete_items limits
+	maxDeleteItems         = 1000
+	deleteItemsConcurrency = 4
+)
+
 // FileOps handles file operations for the agent
 type FileOps struct {
-	sendResult func(msgType string, data interface{})
+	config      *Config
+	sendResult  func(msgType string, data interface{})
+	completed   *resultCache // results of mutating operations by request ID
+	listings    flightGroup[[]FileItem]
+	progress    *streamProgress
+	hashes      *streamHashes
+	uploads     *uploads
+	started     *startedFiles // files created by upload_file, see writeAt
+	archives    *tempArchives // agent-created archives awaiting stream_chunk
+	chunkReads  keyLimiter    // in-flight stream_chunk reads per file
+	chunkWrites serialQueue   // orders upload_chunk writes per upload
+
+	diskEventAt atomic.Int64 // unix nanos of the last disk event, see emitDiskEvent
 }
 
 // NewFileOps creates a new FileOps handler
-func NewFileOps(sendResult func(msgType string, data interface{})) *FileOps {
+func NewFileOps(config *Config, sendResult func(msgType string, data interface{})) *FileOps {
 	return &FileOps{
+		config:     config,
 		sendResult: sendResult,
+		completed:  newResultCache(resultCacheSize),
+		progress:   newStreamProgress(),
+		hashes:     newStreamHashes(),
+		uploads:    newUploads(),
+		started:    newStartedFiles(),
+		archives:   newTempArchives(),
+		chunkReads: keyLimiter{limit: maxConcurrentChunksPerFile},
 	}
 }
 
+// perm masks a permission mode with the configured umask. The process umask
+// is still applied by the OS on top, so the stricter of the two wins.
+func (f *FileOps) perm(mode os.FileMode) os.FileMode {
+	return mode &^ f.config.Umask
+}
+
 // sendError sends a file error response
 func (f *FileOps) sendError(requestID string, code int, message string) {
-	f.sendResult(MsgTypeFileError, FileErrorData{
+	f.sendFinal(requestID, MsgTypeFileError, FileErrorData{
 		RequestID: requestID,
 		Code:      code,
 		Message:   message,
@@ -45,7 +103,7 @@ func (f *FileOps) sendError(requestID string, code int, message string) {
 
 // sendOpResult sends a file operation result
 func (f *FileOps) sendOpResult(requestID string, success bool, message string, uniqueName string) {
-	f.sendResult(MsgTypeFileOpResult, FileOpResultData{
+	f.sendFinal(requestID, MsgTypeFileOpResult, FileOpResultData{
 		RequestID:  requestID,
 		Success:    success,
 		Message:    message,
@@ -53,31 +111,150 @@ func (f *FileOps) sendOpResult(requestID string, success bool, message string, u
 	})
 }
 
+// sendPathResult sends a successful result for an operation that leaves the
+// item at resultPath
+func (f *FileOps) sendPathResult(requestID, message, resultPath string) {
+	f.sendFinal(requestID, MsgTypeFileOpResult, FileOpResultData{
+		RequestID:  requestID,
+		Success:    true,
+		Message:    message,
+		ResultPath: filepath.Clean(resultPath),
+	})
+}
+
+// sendFinal sends the final response for a request, remembering it if the
+// request is a mutating operation so a retry can be answered from cache.
+// Nothing is sent if the request was already answered, as when an
+// operation finishes after it was reported as timed out.
+func (f *FileOps) sendFinal(requestID, msgType string, data interface{}) {
+	if !f.completed.complete(requestID, msgType, data) {
+		log.Debug().Str("requestId", requestID).Str("type", msgType).Msg("dropping result for request already answered")
+		return
+	}
+	f.sendResult(msgType, data)
+}
+
+// alreadyHandled reports whether a mutating operation was seen before, in
+// which case the cached result is re-sent instead of applying it twice.
+// A retry arriving while the original is still running is dropped; the
+// original's response carries the same request ID.
+func (f *FileOps) alreadyHandled(requestID string) bool {
+	if requestID == "" {
+		return false
+	}
+
+	cached, fresh := f.completed.begin(requestID)
+	if fresh {
+		return false
+	}
+
+	if cached.done {
+		log.Info().Str("requestId", requestID).Msg("replaying result for repeated request")
+		f.sendResult(cached.msgType, cached.data)
+	} else {
+		log.Info().Str("requestId", requestID).Msg("ignoring repeated request still in progress")
+	}
+	return true
+}
+
+// resolveOwner looks up the user a created item should belong to. An empty
+// username keeps the agent's own user. Sends an error and returns false if
+// the request cannot be honored.
+func (f *FileOps) resolveOwner(requestID, username string) (*fileOwner, bool) {
+	if username == "" {
+		return nil, true
+	}
+
+	owner, err := lookupOwner(username)
+	if err == ErrNotPrivileged {
+		f.sendError(requestID, 403, fmt.Sprintf("Cannot create as %s: %v", username, err))
+		return nil, false
+	}
+	if err != nil {
+		f.sendError(requestID, 400, fmt.Sprintf("Cannot create as %s: %v", username, err))
+		return nil, false
+	}
+
+	return owner, true
+}
+
+// chownCreated assigns a created item to the resolved owner, if any.
+// Sends an error and returns false on failure.
+func (f *FileOps) chownCreated(requestID, path string, owner *fileOwner) bool {
+	if owner == nil {
+		return true
+	}
+
+	if err := applyOwner(path, owner); err != nil {
+		f.sendError(requestID, 500, fmt.Sprintf("Created but failed to change owner: %v", err))
+		return false
+	}
+	return true
+}
+
 // ListFiles lists the contents of a directory
-func (f *FileOps) ListFiles(data *ListFilesData) {
+func (f *FileOps) ListFiles(ctx context.Context, data *ListFilesData) {
 	log.Debug().Str("path", data.Path).Msg("listing files")
 
-	path := data.Path
-	if path == "" {
-		path = "/"
+	path := expandPath(data.Path)
+
+	if !validSortBy(data.SortBy) {
+		f.sendError(data.RequestID, 400, fmt.Sprintf("Unknown sort key %q", data.SortBy))
+		return
 	}
 
-	// Expand home directory
-	if strings.HasPrefix(path, "~") {
-		homeDir, err := os.UserHomeDir()
-		if err == nil {
-			path = filepath.Join(homeDir, path[1:])
+	var probe *accessProbe
+	if data.IncludeAccess {
+		var err error
+		if probe, err = newAccessProbe(data.AccessUser); err != nil {
+			f.sendError(data.RequestID, 400, err.Error())
+			return
 		}
 	}
 
-	entries, err := os.ReadDir(path)
+	// Identical listings already in flight share a single directory read
+	key := path
+	if data.IncludeXattrs {
+		key += "\x00xattrs"
+	}
+	if data.IncludeAccess {
+		key += "\x00access\x00" + data.AccessUser
+	}
+	files, err := f.listings.Do(key, func() ([]FileItem, error) {
+		return f.readDirItems(ctx, path, data.IncludeXattrs, probe)
+	})
 	if err != nil {
 		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to read directory: %v", err))
 		return
 	}
 
+	result := FileListData{
+		RequestID: data.RequestID,
+		Path:      path,
+		Files:     sortedFileItems(files, data.SortBy, data.SortDesc, data.DirsFirst),
+	}
+	if probe != nil {
+		if info, err := os.Stat(longPath(path)); err == nil {
+			result.Access = probe.check(longPath(path), info)
+		}
+	}
+	f.sendFinal(data.RequestID, MsgTypeFileList, result)
+}
+
+// readDirItems reads a directory and converts its entries to FileItems,
+// probing each entry's access if probe is set
+func (f *FileOps) readDirItems(ctx context.Context, path string, includeXattrs bool, probe *accessProbe) ([]FileItem, error) {
+	entries, err := os.ReadDir(longPath(path))
+	if err != nil {
+		return nil, err
+	}
+
 	files := make([]FileItem, 0, len(entries))
 	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		info, err := entry.Info()
 		if err != nil {
 			continue
@@ -85,53 +262,266 @@ func (f *FileOps) ListFiles(data *ListFilesData) {
 
 		fullPath := filepath.Join(path, entry.Name())
 		item := f.fileInfoToItem(fullPath, info)
+		if includeXattrs && item.Type != "link" {
+			item.Xattrs, item.SecurityContext = readXattrs(longPath(fullPath))
+		}
+		if probe != nil {
+			item.Access = probe.check(longPath(fullPath), info)
+		}
 		files = append(files, item)
 	}
 
-	f.sendResult(MsgTypeFileList, FileListData{
-		RequestID: data.RequestID,
-		Path:      path,
-		Files:     files,
-	})
+	return files, nil
+}
+
+// ReadFiles returns the contents of several small files, reporting errors
+// per file. Sizes are not trusted from stat since /proc and /sys files
+// report zero; each file is read up to its limit instead.
+func (f *FileOps) ReadFiles(ctx context.Context, data *ReadFilesData) {
+	log.Debug().Strs("paths", data.Paths).Msg("reading files")
+
+	if len(data.Paths) == 0 {
+		f.sendError(data.RequestID, 400, "No files to read")
+		return
+	}
+	if len(data.Paths) > maxReadFiles {
+		f.sendError(data.RequestID, 400, fmt.Sprintf("Too many files (max %d)", maxReadFiles))
+		return
+	}
+
+	each := data.MaxBytesEach
+	if each <= 0 {
+		each = defaultReadFilesEach
+	}
+	each = min(each, maxReadFilesEach)
+
+	result := ReadFilesResultData{RequestID: data.RequestID, Files: make([]ReadFileResult, len(data.Paths))}
+	remaining := int64(maxReadFilesTotal)
+	for i, path := range data.Paths {
+		file := &result.Files[i]
+		file.Path = path
+
+		if err := ctx.Err(); err != nil {
+			file.Error = err.Error()
+			continue
+		}
+		if remaining <= 0 {
+			file.Error = "total size limit reached"
+			continue
+		}
+
+		content, truncated, err := readFileHead(path, min(each, remaining))
+		if err != nil {
+			file.Error = err.Error()
+			continue
+		}
+		remaining -= int64(len(content))
+		file.Content = base64.StdEncoding.EncodeToString(content)
+		file.Truncated = truncated
+	}
+
+	f.sendFinal(data.RequestID, MsgTypeReadFilesResult, result)
+}
+
+// readFileHead reads at most limit bytes of a regular file, reporting
+// whether there was more
+func readFileHead(path string, limit int64) ([]byte, bool, error) {
+	// Checked before opening, since opening a FIFO blocks until a writer
+	// appears and a device may have side effects
+	if info, err := os.Stat(longPath(path)); err != nil {
+		return nil, false, err
+	} else if !info.Mode().IsRegular() {
+		return nil, false, fmt.Errorf("not a regular file")
+	}
+
+	file, err := os.Open(longPath(path))
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, false, fmt.Errorf("not a regular file")
+	}
+
+	content, err := io.ReadAll(io.LimitReader(file, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(content)) > limit {
+		return content[:limit], true, nil
+	}
+	return content, false, nil
 }
 
 // DownloadFile reads a file and sends its contents
-func (f *FileOps) DownloadFile(data *DownloadFileData) {
-	log.Debug().Str("path", data.Path).Msg("downloading file")
+func (f *FileOps) DownloadFile(ctx context.Context, data *DownloadFileData) {
+	log.Debug().
+		Str("path", data.Path).
+		Bool("chunked", data.Chunked).
+		Bool("hash", data.Hash).
+		Msg("downloading file")
 
-	content, err := os.ReadFile(data.Path)
+	if data.Chunked {
+		f.downloadChunked(ctx, data)
+		return
+	}
+
+	file, err := os.Open(longPath(data.Path))
 	if err != nil {
 		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to read file: %v", err))
 		return
 	}
+	defer file.Close()
 
 	// Get file info for size
-	info, err := os.Stat(data.Path)
+	info, err := file.Stat()
 	if err != nil {
 		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to stat file: %v", err))
 		return
 	}
 
-	// Detect MIME type
-	mimeType := mime.TypeByExtension(filepath.Ext(data.Path))
-	if mimeType == "" {
-		mimeType = "application/octet-stream"
+	// Encode while reading so the raw content is never held in full; the
+	// builder's String() hands over its buffer without another copy
+	var content strings.Builder
+	content.Grow(base64.StdEncoding.EncodedLen(int(info.Size())))
+
+	encoder := base64.NewEncoder(base64.StdEncoding, &content)
+	var dst io.Writer = encoder
+	var hasher hash.Hash
+	if data.Hash {
+		hasher = sha256.New()
+		dst = io.MultiWriter(encoder, hasher)
+	}
+
+	n, err := copyContext(ctx, dst, file)
+	if err == nil {
+		err = encoder.Close()
+	}
+	if err != nil {
+		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to read file: %v", err))
+		return
+	}
+
+	result := FileContentData{
+		RequestID: data.RequestID,
+		Path:      data.Path,
+		FileName:  filepath.Base(data.Path),
+		Content:   content.String(),
+		MimeType:  f.detectMimeType(data.Path),
+		Size:      n,
+	}
+	if hasher != nil {
+		result.Sha256 = hex.EncodeToString(hasher.Sum(nil))
+	}
+	f.sendFinal(data.RequestID, MsgTypeFileContent, result)
+}
+
+// downloadChunked sends a file as a sequence of file_content_chunk frames
+func (f *FileOps) downloadChunked(ctx context.Context, data *DownloadFileData) {
+	file, err := os.Open(longPath(data.Path))
+	if err != nil {
+		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to open file: %v", err))
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to stat file: %v", err))
+		return
+	}
+
+	if info.IsDir() {
+		f.sendError(data.RequestID, 400, "Cannot download a directory")
+		return
+	}
+
+	chunkSize := data.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultDownloadChunkSize
+	}
+	if chunkSize > maxDownloadChunkSize {
+		chunkSize = maxDownloadChunkSize
 	}
 
-	f.sendResult(MsgTypeFileContent, FileContentData{
+	frame := FileContentChunkData{
 		RequestID: data.RequestID,
 		Path:      data.Path,
 		FileName:  filepath.Base(data.Path),
-		Content:   base64.StdEncoding.EncodeToString(content),
-		MimeType:  mimeType,
+		MimeType:  f.detectMimeType(data.Path),
 		Size:      info.Size(),
-	})
+	}
+
+	var hasher hash.Hash
+	if data.Hash {
+		hasher = sha256.New()
+	}
+
+	buf := make([]byte, chunkSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to read file: %v", err))
+			return
+		}
+
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			if hasher != nil {
+				hasher.Write(buf[:n])
+			}
+			frame.Data = base64.StdEncoding.EncodeToString(buf[:n])
+			f.sendResult(MsgTypeFileChunk, frame)
+			frame.Seq++
+			frame.Offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to read file: %v", err))
+			return
+		}
+	}
+
+	frame.Data = ""
+	frame.Final = true
+	if hasher != nil {
+		frame.Sha256 = hex.EncodeToString(hasher.Sum(nil))
+	}
+	f.sendFinal(data.RequestID, MsgTypeFileChunk, frame)
+
+	log.Debug().
+		Str("path", data.Path).
+		Int("chunks", frame.Seq).
+		Int64("size", frame.Offset).
+		Msg("chunked download completed")
 }
 
 // UploadFile writes content to a file
 func (f *FileOps) UploadFile(data *UploadFileData) {
 	log.Debug().Str("path", data.Path).Str("fileName", data.FileName).Msg("uploading file")
 
+	if f.alreadyHandled(data.RequestID) {
+		return
+	}
+
+	owner, ok := f.resolveOwner(data.RequestID, data.AsUser)
+	if !ok {
+		return
+	}
+
+	// Checked before decoding so an oversized upload is rejected without a
+	// second buffer for the decoded content; the base64 message itself is
+	// already in memory, bounded by Config.DataMaxSize
+	if !f.checkUploadSize(data.RequestID, int64(base64.StdEncoding.DecodedLen(len(data.Content)))) {
+		return
+	}
+
 	content, err := base64.StdEncoding.DecodeString(data.Content)
 	if err != nil {
 		f.sendError(data.RequestID, 400, fmt.Sprintf("Invalid base64 content: %v", err))
@@ -140,19 +530,112 @@ func (f *FileOps) UploadFile(data *UploadFileData) {
 
 	fullPath := filepath.Join(data.Path, data.FileName)
 
-	err = os.WriteFile(fullPath, content, 0644)
+	if data.WriteAt {
+		f.writeAt(data.RequestID, fullPath, data.Offset, content, owner)
+		return
+	}
+
+	if !f.checkFreeSpace(data.RequestID, fullPath, int64(len(content))) {
+		return
+	}
+
+	_, statErr := os.Lstat(longPath(fullPath))
+	err = os.WriteFile(longPath(fullPath), content, f.perm(0644))
 	if err != nil {
 		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to write file: %v", err))
 		return
 	}
+	if os.IsNotExist(statErr) {
+		f.started.add(fullPath)
+	}
+
+	if !f.chownCreated(data.RequestID, fullPath, owner) {
+		return
+	}
 
 	f.sendOpResult(data.RequestID, true, "File uploaded successfully", "")
 }
 
+// checkUploadSize rejects an upload that would leave a file larger than
+// Config.MaxUploadBytes with a 413 error
+func (f *FileOps) checkUploadSize(reqID string, size int64) bool {
+	limit := f.config.MaxUploadBytes
+	if limit <= 0 || size <= limit {
+		return true
+	}
+	f.sendError(reqID, 413, fmt.Sprintf("Upload too large: %d bytes exceeds the limit of %d", size, limit))
+	return false
+}
+
+// writeAt overwrites part of an existing regular file in place, growing it
+// when the region runs past the end, and gives it to owner if set. The
+// offset may not leave a gap.
+func (f *FileOps) writeAt(reqID, path string, offset int64, content []byte, owner *fileOwner) {
+	file, err := os.OpenFile(longPath(path), os.O_WRONLY, 0)
+	if err != nil {
+		f.sendError(reqID, 500, fmt.Sprintf("Failed to open file: %v", err))
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		f.sendError(reqID, 500, fmt.Sprintf("Failed to stat file: %v", err))
+		return
+	}
+	if !info.Mode().IsRegular() {
+		f.sendError(reqID, 400, "Can only write to regular files")
+		return
+	}
+	if offset < 0 || offset > info.Size() {
+		f.sendError(reqID, 400, fmt.Sprintf("Offset %d outside file of size %d", offset, info.Size()))
+		return
+	}
+	// Chunked uploads are bounded by the size the file would grow to. A
+	// file the upload itself created is incomplete without the rest, so it
+	// is removed rather than left behind.
+	if !f.checkUploadSize(reqID, max(info.Size(), offset+int64(len(content)))) {
+		if f.started.take(path) {
+			file.Close()
+			os.Remove(longPath(path))
+		}
+		return
+	}
+	if !f.checkFreeSpace(reqID, path, offset+int64(len(content))) {
+		return
+	}
+
+	if _, err := file.WriteAt(content, offset); err != nil {
+		f.sendError(reqID, 500, fmt.Sprintf("Failed to write file: %v", err))
+		return
+	}
+	if err := file.Close(); err != nil {
+		f.sendError(reqID, 500, fmt.Sprintf("Failed to write file: %v", err))
+		return
+	}
+
+	f.started.touch(path)
+
+	if !f.chownCreated(reqID, path, owner) {
+		return
+	}
+
+	f.sendOpResult(reqID, true, "File region written successfully", "")
+}
+
 // CreateFile creates an empty file or with optional content
 func (f *FileOps) CreateFile(data *CreateFileData) {
 	log.Debug().Str("path", data.Path).Str("fileName", data.FileName).Msg("creating file")
 
+	if f.alreadyHandled(data.RequestID) {
+		return
+	}
+
+	owner, ok := f.resolveOwner(data.RequestID, data.AsUser)
+	if !ok {
+		return
+	}
+
 	fullPath := filepath.Join(data.Path, data.FileName)
 
 	var content []byte
@@ -165,27 +648,85 @@ func (f *FileOps) CreateFile(data *CreateFileData) {
 		}
 	}
 
-	err := os.WriteFile(fullPath, content, 0644)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if data.Overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	if !f.checkFreeSpace(data.RequestID, fullPath, int64(len(content))) {
+		return
+	}
+
+	err := writeNewFile(longPath(fullPath), flags, content, f.perm(0644))
+	if os.IsExist(err) {
+		if info, statErr := os.Stat(longPath(fullPath)); statErr == nil && info.IsDir() {
+			f.sendError(data.RequestID, 409, "A folder with this name already exists")
+		} else {
+			f.sendError(data.RequestID, 409, "File already exists")
+		}
+		return
+	}
 	if err != nil {
 		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to create file: %v", err))
 		return
 	}
 
+	if !f.chownCreated(data.RequestID, fullPath, owner) {
+		return
+	}
+
 	f.sendOpResult(data.RequestID, true, "File created successfully", "")
 }
 
+// writeNewFile is os.WriteFile with explicit open flags
+func writeNewFile(path string, flags int, content []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, flags, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 // CreateFolder creates a new directory
 func (f *FileOps) CreateFolder(data *CreateFolderData) {
 	log.Debug().Str("path", data.Path).Str("folderName", data.FolderName).Msg("creating folder")
 
+	if f.alreadyHandled(data.RequestID) {
+		return
+	}
+
+	owner, ok := f.resolveOwner(data.RequestID, data.AsUser)
+	if !ok {
+		return
+	}
+
 	fullPath := filepath.Join(data.Path, data.FolderName)
 
-	err := os.MkdirAll(fullPath, 0755)
+	if info, err := os.Stat(longPath(fullPath)); err == nil {
+		switch {
+		case !info.IsDir():
+			f.sendError(data.RequestID, 409, "A file with this name already exists")
+			return
+		case !data.Overwrite:
+			f.sendError(data.RequestID, 409, "Folder already exists")
+			return
+		}
+	}
+
+	err := os.MkdirAll(longPath(fullPath), f.perm(0755))
 	if err != nil {
 		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to create folder: %v", err))
 		return
 	}
 
+	if !f.chownCreated(data.RequestID, fullPath, owner) {
+		return
+	}
+
 	f.sendOpResult(data.RequestID, true, "Folder created successfully", "")
 }
 
@@ -193,11 +734,25 @@ func (f *FileOps) CreateFolder(data *CreateFolderData) {
 func (f *FileOps) DeleteItem(data *DeleteItemData) {
 	log.Debug().Str("path", data.Path).Bool("isDirectory", data.IsDirectory).Msg("deleting item")
 
+	if data.DryRun {
+		f.dryRunDeleteItem(data)
+		return
+	}
+
+	if f.alreadyHandled(data.RequestID) {
+		return
+	}
+
+	if _, code, err := checkDelete(data.Path, data.IsDirectory); err != nil {
+		f.sendError(data.RequestID, code, fmt.Sprintf("Failed to delete: %v", err))
+		return
+	}
+
 	var err error
 	if data.IsDirectory {
-		err = os.RemoveAll(data.Path)
+		err = os.RemoveAll(longPath(data.Path))
 	} else {
-		err = os.Remove(data.Path)
+		err = os.Remove(longPath(data.Path))
 	}
 
 	if err != nil {
@@ -208,64 +763,223 @@ func (f *FileOps) DeleteItem(data *DeleteItemData) {
 	f.sendOpResult(data.RequestID, true, "Deleted successfully", "")
 }
 
+// checkDelete checks that DeleteItem can remove path, returning its info
+// or an error and its status code. Without isDirectory only a file or an
+// empty directory is removed, as os.Remove does. Shared with the dry run.
+func checkDelete(path string, isDirectory bool) (os.FileInfo, int, error) {
+	info, err := os.Lstat(longPath(path))
+	if err != nil {
+		return nil, statusForStatError(err), err
+	}
+	if info.IsDir() && !isDirectory {
+		empty, err := dirEmpty(path)
+		if err != nil {
+			return nil, 500, err
+		}
+		if !empty {
+			return nil, 409, fmt.Errorf("%s is a directory that is not empty", path)
+		}
+	}
+	return info, 0, nil
+}
+
+// statusForStatError maps a failed stat of a request's path to a status code
+func statusForStatError(err error) int {
+	switch {
+	case os.IsNotExist(err):
+		return 404
+	case os.IsPermission(err):
+		return 403
+	default:
+		return 500
+	}
+}
+
+// dirEmpty reports whether the directory at path has no entries
+func dirEmpty(path string) (bool, error) {
+	dir, err := os.Open(longPath(path))
+	if err != nil {
+		return false, err
+	}
+	defer dir.Close()
+
+	if _, err := dir.Readdirnames(1); err != io.EOF {
+		return false, err
+	}
+	return true, nil
+}
+
+// DeleteItems deletes several paths with bounded concurrency, reporting
+// each outcome separately so one failure does not stop the rest
+func (f *FileOps) DeleteItems(ctx context.Context, data *DeleteItemsData) {
+	log.Debug().Int("count", len(data.Paths)).Msg("deleting items")
+
+	if f.alreadyHandled(data.RequestID) {
+		return
+	}
+
+	if len(data.Paths) == 0 {
+		f.sendError(data.RequestID, 400, "No paths to delete")
+		return
+	}
+	if len(data.Paths) > maxDeleteItems {
+		f.sendError(data.RequestID, 400, fmt.Sprintf("Too many paths (max %d)", maxDeleteItems))
+		return
+	}
+
+	results := make([]DeleteItemResult, len(data.Paths))
+	sem := make(chan struct{}, deleteItemsConcurrency)
+	var wg sync.WaitGroup
+	for i, target := range data.Paths {
+		results[i].Path = target.Path
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := deleteTarget(target); err != nil {
+				results[i].Error = err.Error()
+			} else {
+				results[i].Success = true
+			}
+		}()
+	}
+	wg.Wait()
+
+	result := DeleteItemsResultData{RequestID: data.RequestID, Results: results}
+	for _, r := range results {
+		if r.Success {
+			result.Deleted++
+		} else {
+			result.Failed++
+		}
+	}
+	f.sendFinal(data.RequestID, MsgTypeDeleteItemsResult, result)
+}
+
+// deleteTarget removes one delete_items path. Directories are removed with
+// their contents only if Recursive is set.
+func deleteTarget(target DeleteTarget) error {
+	if target.Path == "" {
+		return fmt.Errorf("empty path")
+	}
+	if target.IsDirectory && target.Recursive {
+		if _, err := os.Lstat(longPath(target.Path)); err != nil {
+			return err
+		}
+		return os.RemoveAll(longPath(target.Path))
+	}
+	return os.Remove(longPath(target.Path))
+}
+
 // CopyItem copies a file or directory
-func (f *FileOps) CopyItem(data *CopyItemData) {
+func (f *FileOps) CopyItem(ctx context.Context, data *CopyItemData) {
 	log.Debug().Str("source", data.SourcePath).Str("target", data.TargetDir).Msg("copying item")
 
-	srcInfo, err := os.Stat(data.SourcePath)
+	if data.DryRun {
+		f.dryRunCopyItem(data)
+		return
+	}
+
+	if f.alreadyHandled(data.RequestID) {
+		return
+	}
+
+	srcInfo, err := os.Stat(longPath(data.SourcePath))
 	if err != nil {
 		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to stat source: %v", err))
 		return
 	}
 
-	baseName := filepath.Base(data.SourcePath)
-	targetPath := filepath.Join(data.TargetDir, baseName)
+	targetPath, uniqueName := uniqueTarget(data.TargetDir, filepath.Base(data.SourcePath))
+
+	if srcInfo.IsDir() {
+		err = f.copyDir(ctx, data.SourcePath, targetPath, data.Sparse)
+	} else {
+		err = f.copyFile(ctx, data.SourcePath, targetPath, data.Sparse)
+	}
+
+	if err != nil {
+		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to copy: %v", err))
+		return
+	}
+
+	if data.Verify {
+		if err := verifyCopy(ctx, data.SourcePath, targetPath, srcInfo.IsDir()); err != nil {
+			f.sendError(data.RequestID, 500, fmt.Sprintf("Copy to %s failed verification: %v", targetPath, err))
+			return
+		}
+	}
+
+	f.sendOpResult(data.RequestID, true, "Copied successfully", uniqueName)
+}
+
+// uniqueTarget returns a path in dir for baseName that does not exist yet,
+// numbering the name ("name (1).ext") on conflict, and the name used
+func uniqueTarget(dir, baseName string) (string, string) {
+	targetPath := filepath.Join(dir, baseName)
 
-	// Handle name conflicts
 	uniqueName := baseName
 	counter := 1
 	for {
-		if _, err := os.Stat(targetPath); os.IsNotExist(err) {
+		if _, err := os.Stat(longPath(targetPath)); os.IsNotExist(err) {
 			break
 		}
 		ext := filepath.Ext(baseName)
 		nameWithoutExt := strings.TrimSuffix(baseName, ext)
 		uniqueName = fmt.Sprintf("%s (%d)%s", nameWithoutExt, counter, ext)
-		targetPath = filepath.Join(data.TargetDir, uniqueName)
+		targetPath = filepath.Join(dir, uniqueName)
 		counter++
 	}
+	return targetPath, uniqueName
+}
 
-	if srcInfo.IsDir() {
-		err = copyDir(data.SourcePath, targetPath)
-	} else {
-		err = copyFile(data.SourcePath, targetPath)
-	}
+// MoveItem moves a file or directory
+func (f *FileOps) MoveItem(ctx context.Context, data *MoveItemData) {
+	log.Debug().Str("source", data.SourcePath).Str("target", data.TargetPath).Msg("moving item")
 
-	if err != nil {
-		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to copy: %v", err))
+	if data.DryRun {
+		f.dryRunMoveItem(ctx, data)
 		return
 	}
 
-	f.sendOpResult(data.RequestID, true, "Copied successfully", uniqueName)
-}
+	if f.alreadyHandled(data.RequestID) {
+		return
+	}
 
-// MoveItem moves a file or directory
-func (f *FileOps) MoveItem(data *MoveItemData) {
-	log.Debug().Str("source", data.SourcePath).Str("target", data.TargetPath).Msg("moving item")
+	plan, code, err := planMove(data.SourcePath, data.TargetPath)
+	if err != nil {
+		f.sendError(data.RequestID, code, fmt.Sprintf("Failed to move: %v", err))
+		return
+	}
+	if plan.crossDevice && !f.checkMoveSpace(ctx, data.RequestID, data.SourcePath, data.TargetPath) {
+		return
+	}
 
-	err := os.Rename(data.SourcePath, data.TargetPath)
+	err = os.Rename(longPath(data.SourcePath), longPath(data.TargetPath))
 	if err != nil {
 		// If rename fails (cross-device), try copy + delete
-		srcInfo, statErr := os.Stat(data.SourcePath)
+		srcInfo, statErr := os.Stat(longPath(data.SourcePath))
 		if statErr != nil {
 			f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to move: %v", err))
 			return
 		}
 
 		if srcInfo.IsDir() {
-			err = copyDir(data.SourcePath, data.TargetPath)
+			err = f.copyDir(ctx, data.SourcePath, data.TargetPath, false)
 		} else {
-			err = copyFile(data.SourcePath, data.TargetPath)
+			err = f.copyFile(ctx, data.SourcePath, data.TargetPath, false)
 		}
 
 		if err != nil {
@@ -274,9 +988,9 @@ func (f *FileOps) MoveItem(data *MoveItemData) {
 		}
 
 		if srcInfo.IsDir() {
-			err = os.RemoveAll(data.SourcePath)
+			err = os.RemoveAll(longPath(data.SourcePath))
 		} else {
-			err = os.Remove(data.SourcePath)
+			err = os.Remove(longPath(data.SourcePath))
 		}
 
 		if err != nil {
@@ -284,32 +998,126 @@ func (f *FileOps) MoveItem(data *MoveItemData) {
 		}
 	}
 
-	f.sendOpResult(data.RequestID, true, "Moved successfully", "")
+	f.sendPathResult(data.RequestID, "Moved successfully", data.TargetPath)
+}
+
+// movePlan is what moving or renaming an item will do
+type movePlan struct {
+	overwrite   bool // an existing file or empty directory is replaced
+	crossDevice bool // the target is on another filesystem, so the item is copied then removed
+}
+
+// planMove checks that src can be moved to dst the way a rename allows,
+// returning what the move will do or an error and its status code. Shared
+// by MoveItem, RenameItem and their dry runs.
+func planMove(src, dst string) (movePlan, int, error) {
+	var plan movePlan
+
+	srcInfo, err := os.Lstat(longPath(src))
+	if err != nil {
+		return plan, statusForStatError(err), err
+	}
+
+	dstInfo, err := os.Lstat(longPath(dst))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return plan, statusForStatError(err), err
+	case os.SameFile(srcInfo, dstInfo):
+		// Renaming onto itself, e.g. a case change on Windows
+	case dstInfo.IsDir() && !srcInfo.IsDir():
+		return plan, 409, fmt.Errorf("%s already exists and is a directory", dst)
+	case srcInfo.IsDir() && !dstInfo.IsDir():
+		return plan, 409, fmt.Errorf("%s already exists and is a file", dst)
+	case srcInfo.IsDir():
+		empty, err := dirEmpty(dst)
+		if err != nil {
+			return plan, 500, err
+		}
+		if !empty || !renameReplacesDirs {
+			return plan, 409, fmt.Errorf("%s already exists and is a directory that cannot be replaced", dst)
+		}
+		plan.overwrite = true
+	default:
+		plan.overwrite = true
+	}
+
+	plan.crossDevice = !sameFilesystem(longPath(src), longPath(existingDir(dst)))
+	return plan, 0, nil
 }
 
 // RenameItem renames a file or directory
 func (f *FileOps) RenameItem(data *RenameItemData) {
 	log.Debug().Str("path", data.Path).Str("newName", data.NewName).Msg("renaming item")
 
+	if data.DryRun {
+		f.dryRunRenameItem(data)
+		return
+	}
+
+	if f.alreadyHandled(data.RequestID) {
+		return
+	}
+
 	dir := filepath.Dir(data.Path)
 	newPath := filepath.Join(dir, data.NewName)
 
-	err := os.Rename(data.Path, newPath)
+	if _, code, err := planMove(data.Path, newPath); err != nil {
+		f.sendError(data.RequestID, code, fmt.Sprintf("Failed to rename: %v", err))
+		return
+	}
+
+	err := os.Rename(longPath(data.Path), longPath(newPath))
 	if err != nil {
 		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to rename: %v", err))
 		return
 	}
 
-	f.sendOpResult(data.RequestID, true, "Renamed successfully", "")
+	f.sendPathResult(data.RequestID, "Renamed successfully", newPath)
+}
+
+// Chmod sets the permission bits of a file or folder. Only the 0777 bits
+// may be given; setuid, setgid and sticky are refused rather than masked.
+func (f *FileOps) Chmod(data *ChmodData) {
+	log.Debug().Str("path", data.Path).Str("mode", data.Mode).Msg("changing permissions")
+
+	if f.alreadyHandled(data.RequestID) {
+		return
+	}
+
+	mode, err := strconv.ParseUint(strings.TrimSpace(data.Mode), 8, 32)
+	if err != nil {
+		f.sendError(data.RequestID, 400, fmt.Sprintf("Invalid mode %q: expected octal permission bits such as 0755", data.Mode))
+		return
+	}
+	if mode > 0777 {
+		f.sendError(data.RequestID, 400, fmt.Sprintf("Invalid mode %q: only permission bits up to 0777 can be set", data.Mode))
+		return
+	}
+
+	err = os.Chmod(longPath(data.Path), os.FileMode(mode))
+	switch {
+	case os.IsNotExist(err):
+		f.sendError(data.RequestID, 404, fmt.Sprintf("Failed to change permissions: %v", err))
+		return
+	case os.IsPermission(err):
+		f.sendError(data.RequestID, 403, fmt.Sprintf("Failed to change permissions: %v", err))
+		return
+	case err != nil:
+		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to change permissions: %v", err))
+		return
+	}
+
+	f.sendOpResult(data.RequestID, true, "Permissions changed successfully", "")
 }
 
 // StreamFileInfo returns file metadata for streaming
 func (f *FileOps) StreamFileInfo(data *StreamFileInfoData) {
 	log.Debug().Str("path", data.Path).Msg("stream file info request")
 
-	info, err := os.Stat(data.Path)
+	info, err := os.Stat(longPath(data.Path))
 	if err != nil {
-		f.sendResult(MsgTypeStreamFileInfoResponse, StreamFileInfoResponseData{
+		f.sendFinal(data.RequestID, MsgTypeStreamFileInfoResponse, StreamFileInfoResponseData{
 			RequestID: data.RequestID,
 			Path:      data.Path,
 			Error:     fmt.Sprintf("Failed to stat file: %v", err),
@@ -318,7 +1126,7 @@ func (f *FileOps) StreamFileInfo(data *StreamFileInfoData) {
 	}
 
 	if info.IsDir() {
-		f.sendResult(MsgTypeStreamFileInfoResponse, StreamFileInfoResponseData{
+		f.sendFinal(data.RequestID, MsgTypeStreamFileInfoResponse, StreamFileInfoResponseData{
 			RequestID: data.RequestID,
 			Path:      data.Path,
 			Error:     "Cannot stream a directory",
@@ -326,19 +1134,35 @@ func (f *FileOps) StreamFileInfo(data *StreamFileInfoData) {
 		return
 	}
 
-	// Detect MIME type
-	mimeType := mime.TypeByExtension(filepath.Ext(data.Path))
-	if mimeType == "" {
-		mimeType = "application/octet-stream"
+	if data.Progress {
+		f.progress.start(data.RequestID, data.Path, info.Size())
 	}
 
-	f.sendResult(MsgTypeStreamFileInfoResponse, StreamFileInfoResponseData{
+	result := StreamFileInfoResponseData{
 		RequestID: data.RequestID,
 		Path:      data.Path,
 		FileName:  filepath.Base(data.Path),
-		MimeType:  mimeType,
+		MimeType:  f.detectMimeType(data.Path),
 		Size:      info.Size(),
-	})
+		Version:   fileVersion(info),
+	}
+
+	// An empty file has nothing to stream, so its hash is known now
+	if data.Hash {
+		if info.Size() == 0 {
+			result.Sha256 = sha256Hex(nil)
+		} else {
+			f.hashes.start(data.RequestID, data.Path, info.Size(), result.Version)
+		}
+	}
+
+	f.sendFinal(data.RequestID, MsgTypeStreamFileInfoResponse, result)
+}
+
+// fileVersion returns a token that changes whenever the file is replaced or
+// modified, so chunked downloads can detect a file changing underneath them
+func fileVersion(info fs.FileInfo) string {
+	return fmt.Sprintf("%x-%x-%x", fileID(info), info.Size(), info.ModTime().UnixNano())
 }
 
 // StreamChunk reads and returns a chunk of a file
@@ -349,7 +1173,27 @@ func (f *FileOps) StreamChunk(data *StreamChunkData) {
 		Int64("length", data.Length).
 		Msg("stream chunk request")
 
-	file, err := os.Open(data.Path)
+	if data.Offset < 0 || data.Length < 0 {
+		f.sendResult(MsgTypeStreamChunkResponse, StreamChunkResponseData{
+			RequestID: data.RequestID,
+			Error:     "Offset and length must not be negative",
+		})
+		return
+	}
+	length := min(data.Length, maxStreamChunkSize)
+
+	key := filepath.Clean(data.Path)
+	if !f.chunkReads.acquire(key) {
+		f.sendResult(MsgTypeStreamChunkResponse, StreamChunkResponseData{
+			RequestID: data.RequestID,
+			Error:     fmt.Sprintf("Too many concurrent chunk reads for this file (max %d)", maxConcurrentChunksPerFile),
+			Busy:      true,
+		})
+		return
+	}
+	defer f.chunkReads.release(key)
+
+	file, err := os.Open(longPath(data.Path))
 	if err != nil {
 		f.sendResult(MsgTypeStreamChunkResponse, StreamChunkResponseData{
 			RequestID: data.RequestID,
@@ -359,6 +1203,11 @@ func (f *FileOps) StreamChunk(data *StreamChunkData) {
 	}
 	defer file.Close()
 
+	if changed, err := versionChanged(file, data.Version); err != nil || changed {
+		f.sendChunkChanged(data, err)
+		return
+	}
+
 	// Seek to offset
 	_, err = file.Seek(data.Offset, io.SeekStart)
 	if err != nil {
@@ -369,36 +1218,105 @@ func (f *FileOps) StreamChunk(data *StreamChunkData) {
 		return
 	}
 
-	// Read chunk
-	chunk := make([]byte, data.Length)
-	n, err := io.ReadFull(file, chunk)
-	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+	// Read chunk
+	chunk := make([]byte, length)
+	n, err := io.ReadFull(file, chunk)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		f.sendResult(MsgTypeStreamChunkResponse, StreamChunkResponseData{
+			RequestID: data.RequestID,
+			Error:     fmt.Sprintf("Failed to read: %v", err),
+		})
+		return
+	}
+
+	// Only return actual bytes read
+	chunk = chunk[:n]
+
+	// A write that raced with the read would change the version too
+	if changed, err := versionChanged(file, data.Version); err != nil || changed {
+		f.sendChunkChanged(data, err)
+		return
+	}
+
+	// The hash is checked against the version from stream_file_info even
+	// when the chunk request itself carries none
+	var version string
+	if data.TransferID != "" {
+		info, err := file.Stat()
+		if err != nil {
+			f.sendChunkChanged(data, err)
+			return
+		}
+		version = fileVersion(info)
+	}
+
+	f.sendResult(MsgTypeStreamChunkResponse, StreamChunkResponseData{
+		RequestID: data.RequestID,
+		Offset:    data.Offset,
+		Length:    int64(n),
+		Data:      base64.StdEncoding.EncodeToString(chunk),
+	})
+
+	if f.archives.owns(data.Path) {
+		if info, err := file.Stat(); err == nil {
+			f.archives.served(data.Path, data.Offset+int64(n), info.Size())
+		}
+	}
+
+	if data.TransferID != "" {
+		if progress, due := f.progress.served(data.TransferID, int64(n)); due {
+			f.sendResult(MsgTypeStreamProgress, progress)
+		}
+		if sum, done := f.hashes.served(data.TransferID, data.Offset, chunk, version); done {
+			f.sendResult(MsgTypeStreamFileHash, sum)
+		}
+	}
+}
+
+// versionChanged reports whether file no longer matches version. An empty
+// version is never considered changed.
+func versionChanged(file *os.File, version string) (bool, error) {
+	if version == "" {
+		return false, nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	return fileVersion(info) != version, nil
+}
+
+// sendChunkChanged reports a failed version check for a stream_chunk. A
+// change also ends the transfer's hash, if one was requested.
+func (f *FileOps) sendChunkChanged(data *StreamChunkData, err error) {
+	if err != nil {
 		f.sendResult(MsgTypeStreamChunkResponse, StreamChunkResponseData{
 			RequestID: data.RequestID,
-			Error:     fmt.Sprintf("Failed to read: %v", err),
+			Error:     fmt.Sprintf("Failed to stat file: %v", err),
 		})
 		return
 	}
-
-	// Only return actual bytes read
-	chunk = chunk[:n]
-
 	f.sendResult(MsgTypeStreamChunkResponse, StreamChunkResponseData{
 		RequestID: data.RequestID,
-		Offset:    data.Offset,
-		Length:    int64(n),
-		Data:      base64.StdEncoding.EncodeToString(chunk),
+		Error:     "File changed since stream_file_info",
+		Changed:   true,
 	})
+
+	if data.TransferID != "" {
+		if sum, ok := f.hashes.changed(data.TransferID); ok {
+			f.sendResult(MsgTypeStreamFileHash, sum)
+		}
+	}
 }
 
 // GetDirStats calculates directory statistics (size, file count, folder count)
-func (f *FileOps) GetDirStats(data *GetDirStatsData) {
+func (f *FileOps) GetDirStats(ctx context.Context, data *GetDirStatsData) {
 	log.Debug().Str("path", data.Path).Msg("getting directory stats")
 
-	info, err := os.Stat(data.Path)
+	info, err := os.Stat(longPath(data.Path))
 	if err != nil {
 		log.Error().Err(err).Str("path", data.Path).Msg("failed to stat path for dir stats")
-		f.sendResult(MsgTypeDirStats, DirStatsData{
+		f.sendFinal(data.RequestID, MsgTypeDirStats, DirStatsData{
 			RequestID: data.RequestID,
 			Path:      data.Path,
 			Error:     fmt.Sprintf("Failed to stat path: %v", err),
@@ -408,7 +1326,7 @@ func (f *FileOps) GetDirStats(data *GetDirStatsData) {
 
 	// If it's a file, just return its size
 	if !info.IsDir() {
-		f.sendResult(MsgTypeDirStats, DirStatsData{
+		f.sendFinal(data.RequestID, MsgTypeDirStats, DirStatsData{
 			RequestID:   data.RequestID,
 			Path:        data.Path,
 			TotalSize:   info.Size(),
@@ -423,7 +1341,11 @@ func (f *FileOps) GetDirStats(data *GetDirStatsData) {
 	var fileCount int64
 	var folderCount int64
 
-	err = filepath.Walk(data.Path, func(path string, info os.FileInfo, err error) error {
+	root := longPath(data.Path)
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
 		if err != nil {
 			// Skip files/dirs we can't access
 			return nil
@@ -431,7 +1353,7 @@ func (f *FileOps) GetDirStats(data *GetDirStatsData) {
 
 		if info.IsDir() {
 			// Don't count the root directory itself
-			if path != data.Path {
+			if path != root {
 				folderCount++
 			}
 		} else {
@@ -443,7 +1365,7 @@ func (f *FileOps) GetDirStats(data *GetDirStatsData) {
 
 	if err != nil {
 		log.Error().Err(err).Str("path", data.Path).Msg("failed to walk directory for stats")
-		f.sendResult(MsgTypeDirStats, DirStatsData{
+		f.sendFinal(data.RequestID, MsgTypeDirStats, DirStatsData{
 			RequestID: data.RequestID,
 			Path:      data.Path,
 			Error:     fmt.Sprintf("Failed to walk directory: %v", err),
@@ -458,7 +1380,7 @@ func (f *FileOps) GetDirStats(data *GetDirStatsData) {
 		Int64("folderCount", folderCount).
 		Msg("directory stats calculated")
 
-	f.sendResult(MsgTypeDirStats, DirStatsData{
+	f.sendFinal(data.RequestID, MsgTypeDirStats, DirStatsData{
 		RequestID:   data.RequestID,
 		Path:        data.Path,
 		TotalSize:   totalSize,
@@ -468,13 +1390,17 @@ func (f *FileOps) GetDirStats(data *GetDirStatsData) {
 }
 
 // CompressFiles compresses files into an archive
-func (f *FileOps) CompressFiles(data *CompressFilesData) {
+func (f *FileOps) CompressFiles(ctx context.Context, data *CompressFilesData) {
 	log.Debug().
 		Strs("paths", data.Paths).
 		Str("archiveName", data.ArchiveName).
 		Str("format", data.Format).
 		Msg("compressing files")
 
+	if f.alreadyHandled(data.RequestID) {
+		return
+	}
+
 	if len(data.Paths) == 0 {
 		log.Warn().Msg("compress request with no files")
 		f.sendError(data.RequestID, 400, "No files to compress")
@@ -491,25 +1417,29 @@ func (f *FileOps) CompressFiles(data *CompressFilesData) {
 		fileNames = append(fileNames, filepath.Base(p))
 	}
 
-	// Determine archive path
-	archivePath := data.ArchiveName
-	if !strings.Contains(archivePath, "/") {
-		archivePath = filepath.Join(workingDir, archivePath)
+	format := data.Format
+	if format == "" {
+		format = "zip"
+	}
+
+	// The archive is always created next to the sources
+	archiveName, err := archiveFileName(data.ArchiveName, format)
+	if err != nil {
+		log.Warn().Err(err).Str("archiveName", data.ArchiveName).Msg("invalid archive name")
+		f.sendError(data.RequestID, 400, fmt.Sprintf("Invalid archive name: %v", err))
+		return
 	}
+	archivePath := filepath.Join(workingDir, archiveName)
 
 	// Build compression command based on format
 	var cmd *exec.Cmd
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
 	defer cancel()
 
-	format := data.Format
-	if format == "" {
-		format = "zip"
-	}
-
 	switch format {
 	case "zip":
-		args := append([]string{"-r", archivePath}, fileNames...)
+		// -y stores symlinks as links instead of the files they point to
+		args := append([]string{"-r", "-y", archivePath}, fileNames...)
 		cmd = exec.CommandContext(ctx, "zip", args...)
 	case "tar.gz", "tgz":
 		args := append([]string{"-czf", archivePath}, fileNames...)
@@ -524,7 +1454,7 @@ func (f *FileOps) CompressFiles(data *CompressFilesData) {
 		args := append([]string{"-cf", archivePath}, fileNames...)
 		cmd = exec.CommandContext(ctx, "tar", args...)
 	case "7z":
-		args := append([]string{"a", archivePath}, fileNames...)
+		args := append([]string{"a", "-snl", archivePath}, fileNames...)
 		cmd = exec.CommandContext(ctx, "7z", args...)
 	default:
 		log.Warn().Str("format", format).Msg("unsupported compression format")
@@ -534,11 +1464,26 @@ func (f *FileOps) CompressFiles(data *CompressFilesData) {
 
 	cmd.Dir = workingDir
 
+	if data.SkipIfUpToDate {
+		if info, err := os.Stat(longPath(archivePath)); err == nil && info.Mode().IsRegular() &&
+			!modifiedSince(ctx, data.Paths, info.ModTime()) {
+			log.Debug().Str("archivePath", archivePath).Msg("archive up to date, skipping compression")
+			f.sendFinal(data.RequestID, MsgTypeFileOpResult, FileOpResultData{
+				RequestID:  data.RequestID,
+				Success:    true,
+				Message:    fmt.Sprintf("Skipped, %s is up to date", archivePath),
+				ResultPath: archivePath,
+				Skipped:    true,
+			})
+			return
+		}
+	}
+
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
 		errMsg := stderr.String()
 		if errMsg == "" {
@@ -563,6 +1508,287 @@ func (f *FileOps) CompressFiles(data *CompressFilesData) {
 	f.sendOpResult(data.RequestID, true, fmt.Sprintf("Created %s", archivePath), "")
 }
 
+// errModified stops the walk in modifiedSince at the first newer entry
+var errModified = errors.New("modified")
+
+// modifiedSince reports whether any of paths, or anything beneath them, was
+// modified after t. Entries that cannot be read count as modified so the
+// caller errs on the side of doing the work.
+func modifiedSince(ctx context.Context, paths []string, t time.Time) bool {
+	for _, root := range paths {
+		err := filepath.Walk(longPath(root), func(path string, info os.FileInfo, err error) error {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if err != nil {
+				return err
+			}
+			if info.ModTime().After(t) {
+				return errModified
+			}
+			return nil
+		})
+		if err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// DownloadMatching archives all files matching a glob under a root path and
+// reports the archive location so the server can stream it
+func (f *FileOps) DownloadMatching(ctx context.Context, data *DownloadMatchingData) {
+	fail := func(msg string) {
+		log.Warn().Str("rootPath", data.RootPath).Str("glob", data.Glob).Msg(msg)
+		f.sendFinal(data.RequestID, MsgTypeDownloadMatchingResponse, DownloadMatchingResponseData{
+			RequestID: data.RequestID,
+			Error:     msg,
+		})
+	}
+
+	if data.Glob == "" {
+		fail("No glob pattern given")
+		return
+	}
+	if _, err := filepath.Match(data.Glob, ""); err != nil {
+		fail(fmt.Sprintf("Invalid glob pattern: %v", err))
+		return
+	}
+
+	format := data.ArchiveFormat
+	if format == "" {
+		format = "zip"
+	}
+	ext, ok := nativeArchiveFormats[format]
+	if !ok {
+		fail(fmt.Sprintf("Unsupported archive format: %s", format))
+		return
+	}
+
+	// Match against the relative path when the pattern has a directory part
+	matchPath := strings.Contains(data.Glob, "/")
+
+	var matches []string
+	var totalSize int64
+	errLimit := errors.New("limit exceeded")
+
+	root := longPath(data.RootPath)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil || !d.Type().IsRegular() {
+			// Skip unreadable entries, directories, links and special files
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+
+		name := d.Name()
+		if matchPath {
+			name = filepath.ToSlash(rel)
+		}
+		if ok, _ := filepath.Match(data.Glob, name); !ok {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		matches = append(matches, rel)
+		totalSize += info.Size()
+		if len(matches) > f.config.MatchMaxFiles || totalSize > f.config.MatchMaxBytes {
+			return errLimit
+		}
+		return nil
+	})
+
+	if err == errLimit {
+		fail(fmt.Sprintf("Too many matching files (limits: %d files, %d bytes)",
+			f.config.MatchMaxFiles, f.config.MatchMaxBytes))
+		return
+	}
+	if err != nil {
+		fail(fmt.Sprintf("Failed to search %s: %v", data.RootPath, err))
+		return
+	}
+	if len(matches) == 0 {
+		fail("No files matched")
+		return
+	}
+
+	archive, err := os.CreateTemp(f.config.TempDir, "termix-download-*"+ext)
+	if err != nil {
+		fail(fmt.Sprintf("Failed to create archive: %v", err))
+		return
+	}
+	archivePath := archive.Name()
+
+	err = writeArchive(ctx, archive, format, root, matches)
+	if closeErr := archive.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(archivePath)
+		fail(fmt.Sprintf("Failed to write archive: %v", err))
+		return
+	}
+
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		os.Remove(archivePath)
+		fail(fmt.Sprintf("Failed to stat archive: %v", err))
+		return
+	}
+
+	// Streamable despite lying outside any scope, and deleted once done
+	f.archives.add(archivePath)
+
+	log.Debug().
+		Str("archivePath", archivePath).
+		Int("fileCount", len(matches)).
+		Int64("size", info.Size()).
+		Msg("matching files archived")
+
+	f.sendFinal(data.RequestID, MsgTypeDownloadMatchingResponse, DownloadMatchingResponseData{
+		RequestID:   data.RequestID,
+		ArchivePath: archivePath,
+		FileName:    "download" + ext,
+		MimeType:    f.detectMimeType(archivePath),
+		Size:        info.Size(),
+		FileCount:   len(matches),
+	})
+}
+
+// PatchFile applies byte-range edits to a file atomically, rejecting the
+// patch if the file no longer matches the checksum the edits were based on
+func (f *FileOps) PatchFile(data *PatchFileData) {
+	log.Debug().Str("path", data.Path).Int("edits", len(data.Edits)).Msg("patching file")
+
+	if f.alreadyHandled(data.RequestID) {
+		return
+	}
+
+	info, err := os.Stat(longPath(data.Path))
+	if err != nil {
+		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to stat file: %v", err))
+		return
+	}
+	if !info.Mode().IsRegular() {
+		f.sendError(data.RequestID, 400, "Can only patch regular files")
+		return
+	}
+
+	original, err := os.ReadFile(longPath(data.Path))
+	if err != nil {
+		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to read file: %v", err))
+		return
+	}
+
+	if sha256Hex(original) != normalizeFingerprint(data.BaseSha256) {
+		f.sendError(data.RequestID, 409, "File changed since the patch was created")
+		return
+	}
+
+	patched, err := applyEdits(original, data.Edits)
+	if err != nil {
+		f.sendError(data.RequestID, 400, fmt.Sprintf("Invalid patch: %v", err))
+		return
+	}
+
+	if err := writeFileAtomic(data.Path, patched, info.Mode().Perm()); err != nil {
+		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to write file: %v", err))
+		return
+	}
+
+	f.sendFinal(data.RequestID, MsgTypePatchFileResult, PatchFileResultData{
+		RequestID: data.RequestID,
+		Path:      data.Path,
+		Sha256:    sha256Hex(patched),
+		Size:      int64(len(patched)),
+	})
+}
+
+// FileQuickStats reports size, line count, encoding and line endings so the
+// editor can decide how to load a file
+func (f *FileOps) FileQuickStats(data *FileQuickStatsData) {
+	log.Debug().Str("path", data.Path).Msg("getting file quick stats")
+
+	file, err := os.Open(longPath(data.Path))
+	if err != nil {
+		f.sendError(data.RequestID, 404, fmt.Sprintf("Failed to open file: %v", err))
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to stat file: %v", err))
+		return
+	}
+	if !info.Mode().IsRegular() {
+		f.sendError(data.RequestID, 400, "Can only get stats for regular files")
+		return
+	}
+
+	stats, err := scanTextStats(file)
+	if err != nil {
+		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to read file: %v", err))
+		return
+	}
+
+	f.sendFinal(data.RequestID, MsgTypeFileQuickStatsResult, FileQuickStatsResultData{
+		RequestID:       data.RequestID,
+		Path:            data.Path,
+		Size:            info.Size(),
+		LineCount:       stats.Lines,
+		EndsWithNewline: stats.EndsWithNewline,
+		Encoding:        stats.Encoding,
+		LineEnding:      stats.LineEnding,
+	})
+}
+
+// ListArchive streams the entries of a zip or tar archive in batches so
+// the UI can preview it before extracting
+func (f *FileOps) ListArchive(ctx context.Context, data *ListArchiveData) {
+	log.Debug().Str("archivePath", data.ArchivePath).Msg("listing archive")
+
+	frame := ArchiveListingData{
+		RequestID:   data.RequestID,
+		ArchivePath: data.ArchivePath,
+		Entries:     make([]ArchiveEntry, 0, archiveListingBatch),
+	}
+
+	truncated, err := listArchive(ctx, data.ArchivePath, maxArchiveEntries, func(entry ArchiveEntry) {
+		frame.Entries = append(frame.Entries, entry)
+		if len(frame.Entries) == archiveListingBatch {
+			f.sendResult(MsgTypeArchiveListing, frame)
+			frame.Seq++
+			frame.Entries = make([]ArchiveEntry, 0, archiveListingBatch)
+		}
+	})
+	switch {
+	case errors.Is(err, ErrUnsupportedArchive):
+		f.sendError(data.RequestID, 400, "Can only list zip, tar, tar.gz and tar.bz2 archives")
+		return
+	case os.IsNotExist(err):
+		f.sendError(data.RequestID, 404, fmt.Sprintf("Failed to open archive: %v", err))
+		return
+	case err != nil:
+		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to read archive: %v", err))
+		return
+	}
+
+	frame.Final = true
+	frame.Truncated = truncated
+	f.sendFinal(data.RequestID, MsgTypeArchiveListing, frame)
+}
+
 // fileInfoToItem converts os.FileInfo to FileItem
 func (f *FileOps) fileInfoToItem(path string, info fs.FileInfo) FileItem {
 	item := FileItem{
@@ -573,13 +1799,25 @@ func (f *FileOps) fileInfoToItem(path string, info fs.FileInfo) FileItem {
 		Permissions: info.Mode().Perm().String(),
 	}
 
+	// JSON cannot carry arbitrary bytes, so names that are not UTF-8 are
+	// escaped for display. Path is left as is and its exact bytes sent in
+	// RawPath, since an escaped path would name a different file.
+	if !utf8.ValidString(item.Name) {
+		item.NameInvalid = true
+		item.NameBytes = []byte(item.Name)
+		item.Name = escapeInvalidUTF8(item.Name)
+	}
+	if !utf8.ValidString(item.Path) {
+		item.RawPath = []byte(item.Path)
+	}
+
 	// Determine type
 	mode := info.Mode()
 	if mode&os.ModeSymlink != 0 {
 		item.Type = "link"
 		// Try to resolve symlink target
-		if target, err := os.Readlink(path); err == nil {
-			item.LinkTarget = target
+		if target, err := os.Readlink(longPath(path)); err == nil {
+			item.LinkTarget = escapeInvalidUTF8(target)
 		}
 	} else if info.IsDir() {
 		item.Type = "directory"
@@ -610,8 +1848,134 @@ func (f *FileOps) fileInfoToItem(path string, info fs.FileInfo) FileItem {
 
 // Helper functions
 
-func copyFile(src, dst string) error {
-	sourceFile, err := os.Open(src)
+// applyEdits applies sorted, non-overlapping edits to content
+func applyEdits(content []byte, edits []FileEdit) ([]byte, error) {
+	size := int64(len(content))
+	out := make([]byte, 0, len(content))
+
+	var pos int64
+	for i, edit := range edits {
+		if edit.Offset < pos || edit.Length < 0 || edit.Offset+edit.Length > size {
+			return nil, fmt.Errorf("edit %d out of range or overlapping (offset %d, length %d, size %d)",
+				i, edit.Offset, edit.Length, size)
+		}
+
+		replacement, err := base64.StdEncoding.DecodeString(edit.Replacement)
+		if err != nil {
+			return nil, fmt.Errorf("edit %d: invalid base64 replacement: %v", i, err)
+		}
+
+		out = append(out, content[pos:edit.Offset]...)
+		out = append(out, replacement...)
+		pos = edit.Offset + edit.Length
+	}
+
+	return append(out, content[pos:]...), nil
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it
+// into place, so readers never observe a partially written file. The temp
+// file deliberately ignores Config.TempDir so the rename stays on the same
+// filesystem. A symlink is followed so its target is replaced rather than
+// the link, and an existing file keeps its mode and owner; perm only applies
+// to a new file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if resolved, err := filepath.EvalSymlinks(longPath(path)); err == nil {
+		path = resolved
+	}
+	existing, err := os.Stat(longPath(path))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(longPath(path)), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	mode := perm
+	if existing != nil {
+		mode = existing.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil && existing != nil {
+		err = copyOwner(tmp, existing)
+	}
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, longPath(path))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// sha256Hex returns the lowercase hex SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// builtinMimeTypes covers common types that the host's mime.types often
+// lacks or gets wrong, so results are consistent across hosts
+var builtinMimeTypes = map[string]string{
+	".md":    "text/markdown; charset=utf-8",
+	".ts":    "text/typescript; charset=utf-8",
+	".tsx":   "text/tsx; charset=utf-8",
+	".jsx":   "text/jsx; charset=utf-8",
+	".mjs":   "text/javascript; charset=utf-8",
+	".json":  "application/json",
+	".yaml":  "application/yaml",
+	".yml":   "application/yaml",
+	".toml":  "application/toml",
+	".go":    "text/x-go; charset=utf-8",
+	".rs":    "text/x-rust; charset=utf-8",
+	".py":    "text/x-python; charset=utf-8",
+	".sh":    "application/x-sh",
+	".log":   "text/plain; charset=utf-8",
+	".webp":  "image/webp",
+	".avif":  "image/avif",
+	".svg":   "image/svg+xml",
+	".wasm":  "application/wasm",
+	".woff2": "font/woff2",
+	".webm":  "video/webm",
+	".mp4":   "video/mp4",
+	".opus":  "audio/opus",
+}
+
+// detectMimeType returns the MIME type for a path based on its extension,
+// preferring configured overrides, then builtinMimeTypes, then the system
+func (f *FileOps) detectMimeType(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if mimeType, ok := f.config.MimeOverrides[ext]; ok {
+		return mimeType
+	}
+	if mimeType, ok := builtinMimeTypes[ext]; ok {
+		return mimeType
+	}
+
+	mimeType := mime.TypeByExtension(ext)
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	return mimeType
+}
+
+// copyFile copies a regular file. With sparse, runs of zeros are skipped
+// rather than written so holes in the source stay holes in the copy.
+func (f *FileOps) copyFile(ctx context.Context, src, dst string, sparse bool) error {
+	sourceFile, err := os.Open(longPath(src))
 	if err != nil {
 		return err
 	}
@@ -622,45 +1986,91 @@ func copyFile(src, dst string) error {
 		return err
 	}
 
-	destFile, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, srcInfo.Mode())
+	destFile, err := os.OpenFile(longPath(dst), os.O_RDWR|os.O_CREATE|os.O_TRUNC, f.perm(srcInfo.Mode()))
 	if err != nil {
 		return err
 	}
 	defer destFile.Close()
 
-	_, err = io.Copy(destFile, sourceFile)
+	if sparse {
+		return copySparse(ctx, destFile, sourceFile)
+	}
+	_, err = copyContext(ctx, destFile, sourceFile)
 	return err
 }
 
-func copyDir(src, dst string) error {
-	srcInfo, err := os.Stat(src)
+// copyDir copies a directory tree. Symlinks inside it are recreated as
+// links rather than followed, so copying a tree within the path scope
+// cannot pull in content from outside it.
+func (f *FileOps) copyDir(ctx context.Context, src, dst string, sparse bool) error {
+	srcInfo, err := os.Stat(longPath(src))
 	if err != nil {
 		return err
 	}
 
-	if err := os.MkdirAll(dst, srcInfo.Mode()); err != nil {
+	if err := os.MkdirAll(longPath(dst), f.perm(srcInfo.Mode())); err != nil {
 		return err
 	}
 
-	entries, err := os.ReadDir(src)
+	entries, err := os.ReadDir(longPath(src))
 	if err != nil {
 		return err
 	}
 
 	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		srcPath := filepath.Join(src, entry.Name())
 		dstPath := filepath.Join(dst, entry.Name())
 
-		if entry.IsDir() {
-			if err := copyDir(srcPath, dstPath); err != nil {
-				return err
-			}
-		} else {
-			if err := copyFile(srcPath, dstPath); err != nil {
-				return err
-			}
+		info, err := os.Lstat(longPath(srcPath))
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			err = copySymlink(srcPath, dstPath)
+		case info.IsDir():
+			err = f.copyDir(ctx, srcPath, dstPath, sparse)
+		default:
+			err = f.copyFile(ctx, srcPath, dstPath, sparse)
+		}
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
+
+// copySymlink creates dst as a link with the same target as the link src
+func copySymlink(src, dst string) error {
+	target, err := os.Readlink(longPath(src))
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, longPath(dst))
+}
+
+// escapeInvalidUTF8 replaces each byte of s that is not part of a valid
+// UTF-8 sequence with \xNN
+func escapeInvalidUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			fmt.Fprintf(&b, "\\x%02x", s[i])
+		} else {
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
@@ -0,0 +1,176 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lastChunk returns the most recent stream_chunk_response
+func lastChunk(t *testing.T, sent *sentLog) StreamChunkResponseData {
+	t.Helper()
+	resp, ok := sent.last(t).data.(StreamChunkResponseData)
+	if !ok {
+		t.Fatalf("response = %+v, want a stream_chunk_response", sent.last(t).data)
+	}
+	return resp
+}
+
+func TestStreamChunkDetectsModifiedFile(t *testing.T) {
+	f, sent := newTestFileOps(t)
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f.StreamFileInfo(&StreamFileInfoData{RequestID: "info", Path: path})
+	info, ok := sent.last(t).data.(StreamFileInfoResponseData)
+	if !ok || info.Version == "" {
+		t.Fatalf("stream_file_info response = %+v, want a version", sent.last(t).data)
+	}
+
+	chunk := &StreamChunkData{RequestID: "info", TransferID: "info", Path: path, Offset: 0, Length: 5, Version: info.Version}
+	f.StreamChunk(chunk)
+	if resp := lastChunk(t, sent); resp.Error != "" || resp.Data != base64.StdEncoding.EncodeToString([]byte("hello")) {
+		t.Fatalf("chunk before the change = %+v", resp)
+	}
+
+	// Same size, new content and modification time
+	if err := os.WriteFile(path, []byte("HELLO WORLD"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	chunk.Offset = 5
+	f.StreamChunk(chunk)
+	if resp := lastChunk(t, sent); !resp.Changed || resp.Data != "" {
+		t.Fatalf("chunk after the change = %+v, want Changed and no data", resp)
+	}
+
+	// Without a version the chunk is served as before
+	chunk.Version = ""
+	f.StreamChunk(chunk)
+	if resp := lastChunk(t, sent); resp.Changed || resp.Error != "" {
+		t.Fatalf("unversioned chunk = %+v", resp)
+	}
+}
+
+func TestConcurrentStreamChunks(t *testing.T) {
+	f, sent := newTestFileOps(t)
+	const parts, partSize = 32, 64 << 10
+
+	content := make([]byte, parts*partSize)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	path := filepath.Join(t.TempDir(), "large.bin")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	request := func(part int) {
+		f.StreamChunk(&StreamChunkData{
+			RequestID: fmt.Sprint(part),
+			Path:      path,
+			Offset:    int64(part * partSize),
+			Length:    partSize,
+		})
+	}
+
+	// Fire every part at once; each is either served or refused as busy
+	var wg sync.WaitGroup
+	for part := range parts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request(part)
+		}()
+	}
+	wg.Wait()
+
+	got := make([][]byte, parts)
+	var retry []int
+	for _, msg := range sent.msgs {
+		resp := msg.data.(StreamChunkResponseData)
+		var part int
+		fmt.Sscan(resp.RequestID, &part)
+		switch {
+		case resp.Busy:
+			retry = append(retry, part)
+		case resp.Error != "":
+			t.Fatalf("part %d: %s", part, resp.Error)
+		default:
+			got[part], _ = base64.StdEncoding.DecodeString(resp.Data)
+		}
+	}
+	if len(sent.msgs) != parts {
+		t.Fatalf("got %d responses for %d requests", len(sent.msgs), parts)
+	}
+
+	// Busy parts succeed once retried
+	for _, part := range retry {
+		request(part)
+		resp := lastChunk(t, sent)
+		if resp.Error != "" {
+			t.Fatalf("retried part %d: %s", part, resp.Error)
+		}
+		got[part], _ = base64.StdEncoding.DecodeString(resp.Data)
+	}
+	if !bytes.Equal(bytes.Join(got, nil), content) {
+		t.Fatal("reassembled parts differ from the file")
+	}
+	if len(f.chunkReads.active) != 0 {
+		t.Fatalf("%d files still hold chunk read slots", len(f.chunkReads.active))
+	}
+
+	// With every slot for the file taken, further reads are refused
+	for range maxConcurrentChunksPerFile {
+		f.chunkReads.acquire(path)
+	}
+	request(0)
+	if resp := lastChunk(t, sent); !resp.Busy {
+		t.Fatalf("read past the per-file limit = %+v, want busy", resp)
+	}
+}
+
+// BenchmarkDownloadFile compares the streaming encoder in DownloadFile with
+// reading the whole file before encoding it; B/op shows the peak saved
+func BenchmarkDownloadFile(b *testing.B) {
+	const size = 100 << 20
+	path := filepath.Join(b.TempDir(), "large.bin")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("0123456789abcdef"), size/16), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("streaming", func(b *testing.B) {
+		f := NewFileOps(&Config{}, func(string, interface{}) {})
+		b.Cleanup(f.Cleanup)
+		b.SetBytes(size)
+		b.ReportAllocs()
+		for b.Loop() {
+			f.DownloadFile(context.Background(), &DownloadFileData{RequestID: "dl", Path: path})
+		}
+	})
+
+	b.Run("read then encode", func(b *testing.B) {
+		b.SetBytes(size)
+		b.ReportAllocs()
+		for b.Loop() {
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_ = base64.StdEncoding.EncodeToString(raw)
+		}
+	})
+}
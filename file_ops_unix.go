@@ -0,0 +1,193 @@
+//go:build !windows
+// +build !windows
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// ErrNotPrivileged is returned when an operation requires running as root
+var ErrNotPrivileged = errors.New("agent is not running with root privileges")
+
+// fileOwner is a resolved uid/gid pair to assign to created items
+type fileOwner struct {
+	uid int
+	gid int
+}
+
+// lookupOwner resolves a username for chown, failing early if the agent
+// cannot change ownership or the user does not exist
+func lookupOwner(username string) (*fileOwner, error) {
+	if os.Geteuid() != 0 {
+		return nil, ErrNotPrivileged
+	}
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %q", username)
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid for user %q", username)
+	}
+
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid for user %q", username)
+	}
+
+	return &fileOwner{uid: uid, gid: gid}, nil
+}
+
+// applyOwner changes ownership of a created item without following symlinks
+func applyOwner(path string, owner *fileOwner) error {
+	return os.Lchown(path, owner.uid, owner.gid)
+}
+
+// fileID returns the inode number of info, or 0 if unknown
+func fileID(info fs.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
+
+// rename(2) replaces an empty directory at the target with a directory
+const renameReplacesDirs = true
+
+// sameFilesystem reports whether a and b are on the same filesystem, so a
+// rename between them cannot fail with EXDEV. Paths that cannot be checked
+// are assumed to be.
+func sameFilesystem(a, b string) bool {
+	var statA, statB syscall.Stat_t
+	if syscall.Stat(a, &statA) != nil || syscall.Stat(b, &statB) != nil {
+		return true
+	}
+	return statA.Dev == statB.Dev
+}
+
+// longPath is a no-op outside Windows, which has no MAX_PATH limit
+func longPath(path string) string {
+	return path
+}
+
+// access(2) mode bits
+const (
+	accessExecute = 1
+	accessWrite   = 2
+	accessRead    = 4
+)
+
+// accessProbe works out what a user may do with a path. The agent's own
+// user is probed with access(2), which also accounts for read-only mounts
+// and ACLs; other users are judged from the mode bits alone.
+type accessProbe struct {
+	self bool
+	uid  int
+	gids map[int]bool
+}
+
+// newAccessProbe returns a probe for username, or for the agent's user if
+// username is empty
+func newAccessProbe(username string) (*accessProbe, error) {
+	if username == "" {
+		return &accessProbe{self: true}, nil
+	}
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %q", username)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid for user %q", username)
+	}
+	if uid == os.Getuid() {
+		return &accessProbe{self: true}, nil
+	}
+
+	probe := &accessProbe{uid: uid, gids: make(map[int]bool)}
+	groups, _ := u.GroupIds()
+	for _, g := range append(groups, u.Gid) {
+		if gid, err := strconv.Atoi(g); err == nil {
+			probe.gids[gid] = true
+		}
+	}
+	return probe, nil
+}
+
+// check reports the access the probe's user has to path, whose (not
+// followed) FileInfo is info
+func (p *accessProbe) check(path string, info fs.FileInfo) *FileAccess {
+	if p.self {
+		return &FileAccess{
+			Read:    syscall.Access(path, accessRead) == nil,
+			Write:   syscall.Access(path, accessWrite) == nil,
+			Execute: syscall.Access(path, accessExecute) == nil,
+		}
+	}
+
+	// Permissions of a symlink are those of its target
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Stat(path)
+		if err != nil {
+			return &FileAccess{}
+		}
+		info = target
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return &FileAccess{}
+	}
+
+	mode := uint32(info.Mode().Perm())
+	if p.uid == 0 {
+		return &FileAccess{Read: true, Write: true, Execute: info.IsDir() || mode&0111 != 0}
+	}
+
+	var bits uint32
+	switch {
+	case int(stat.Uid) == p.uid:
+		bits = mode >> 6
+	case p.gids[int(stat.Gid)]:
+		bits = mode >> 3
+	default:
+		bits = mode
+	}
+	return &FileAccess{
+		Read:    bits&accessRead != 0,
+		Write:   bits&accessWrite != 0,
+		Execute: bits&accessExecute != 0,
+	}
+}
+
+// copyOwner gives file the owner and group of info. It is a no-op when they
+// already match, so files the agent may write but not chown still work.
+func copyOwner(file *os.File, info fs.FileInfo) error {
+	want, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	current, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if have, ok := current.Sys().(*syscall.Stat_t); ok && have.Uid == want.Uid && have.Gid == want.Gid {
+		return nil
+	}
+	if err := file.Chown(int(want.Uid), int(want.Gid)); err != nil {
+		return fmt.Errorf("cannot keep the file's owner: %w", err)
+	}
+	return nil
+}
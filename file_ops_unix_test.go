@@ -0,0 +1,115 @@
+//go:build !windows
+// +build !windows
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWriteAtAppliesOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing owners needs root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+
+	f, sent := newTestFileOps(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "data.bin"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f.UploadFile(&UploadFileData{
+		RequestID: "w1",
+		Path:      dir,
+		FileName:  "data.bin",
+		Content:   base64.StdEncoding.EncodeToString([]byte(" world")),
+		WriteAt:   true,
+		Offset:    5,
+		AsUser:    "nobody",
+	})
+	if result, ok := sent.last(t).data.(FileOpResultData); !ok || !result.Success {
+		t.Fatalf("write result = %+v", sent.last(t).data)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := int(info.Sys().(*syscall.Stat_t).Uid); got != uid {
+		t.Fatalf("owner uid = %d, want %d", got, uid)
+	}
+}
+
+func TestReadFileHeadRefusesFIFO(t *testing.T) {
+	fifo := filepath.Join(t.TempDir(), "pipe")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Skipf("cannot create FIFO: %v", err)
+	}
+
+	// Opening a FIFO without a writer would block forever
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := readFileHead(fifo, 1024)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("reading a FIFO succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("readFileHead blocked on a FIFO")
+	}
+}
+
+func TestFileItemInvalidUTF8(t *testing.T) {
+	dir := t.TempDir()
+	name := "bad\xff.txt"
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Skipf("filesystem refuses non-UTF-8 names: %v", err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, _ := newTestFileOps(t)
+	item := f.fileInfoToItem(path, info)
+
+	if item.Path != path {
+		t.Errorf("Path = %q, want the exact path %q", item.Path, path)
+	}
+	if item.Name != `bad\xff.txt` || !item.NameInvalid {
+		t.Errorf("Name = %q, NameInvalid = %v; want it escaped for display", item.Name, item.NameInvalid)
+	}
+
+	// The exact bytes survive the trip through JSON
+	encoded, err := json.Marshal(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded FileItem
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded.RawPath) != path || string(decoded.NameBytes) != name {
+		t.Errorf("rawPath = %q, nameBytes = %q; want %q, %q", decoded.RawPath, decoded.NameBytes, path, name)
+	}
+}
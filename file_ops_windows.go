@@ -0,0 +1,109 @@
+//go:build windows
+// +build windows
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxShortPath is the longest directory path Windows accepts without the
+// extended-length prefix (MAX_PATH less room for an 8.3 file name)
+const maxShortPath = 248
+
+// ErrNotPrivileged is returned when an operation requires running as root
+var ErrNotPrivileged = errors.New("changing file ownership is not supported on Windows")
+
+// fileOwner is unused on Windows
+type fileOwner struct{}
+
+// lookupOwner is not supported on Windows
+func lookupOwner(username string) (*fileOwner, error) {
+	return nil, ErrNotPrivileged
+}
+
+// applyOwner is not supported on Windows
+func applyOwner(path string, owner *fileOwner) error {
+	return ErrNotPrivileged
+}
+
+// fileID is not available from a Windows FileInfo without reopening the
+// file, so versions rely on size and modification time alone
+func fileID(info fs.FileInfo) uint64 {
+	return 0
+}
+
+// MoveFileEx cannot replace a directory, even an empty one
+const renameReplacesDirs = false
+
+// sameFilesystem reports whether a and b are on the same volume, so a rename
+// between them does not need a copy
+func sameFilesystem(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return true
+	}
+	return strings.EqualFold(filepath.VolumeName(absA), filepath.VolumeName(absB))
+}
+
+// longPath converts UNC paths and overlong absolute paths to the
+// extended-length form (\\?\C:\... or \\?\UNC\server\share\...), which
+// is not subject to MAX_PATH. Other paths are returned unchanged.
+func longPath(path string) string {
+	if strings.HasPrefix(path, `\\?\`) || strings.HasPrefix(path, `\\.\`) {
+		return path
+	}
+
+	// The extended-length form disables normalisation, so clean first
+	cleaned := filepath.Clean(path)
+	if strings.HasPrefix(cleaned, `\\`) {
+		return `\\?\UNC\` + cleaned[2:]
+	}
+	if len(cleaned) >= maxShortPath && filepath.IsAbs(cleaned) {
+		return `\\?\` + cleaned
+	}
+	return path
+}
+
+// Extensions Windows runs directly
+var executableExts = map[string]bool{".exe": true, ".com": true, ".bat": true, ".cmd": true}
+
+// accessProbe works out what the agent's user may do with a path. ACLs
+// are not evaluated; only the read-only attribute is taken into account.
+type accessProbe struct{}
+
+// newAccessProbe returns a probe for the agent's user. Probing for another
+// user is not supported on Windows.
+func newAccessProbe(username string) (*accessProbe, error) {
+	if username != "" && !strings.EqualFold(username, currentUsername()) {
+		return nil, errors.New("access checks for other users are not supported on Windows")
+	}
+	return &accessProbe{}, nil
+}
+
+// check reports the access the agent's user has to path, whose FileInfo
+// is info
+func (p *accessProbe) check(path string, info fs.FileInfo) *FileAccess {
+	if info.IsDir() {
+		// The read-only attribute does not apply to directories
+		return &FileAccess{Read: true, Write: true, Execute: true}
+	}
+	return &FileAccess{
+		Read:    true,
+		Write:   info.Mode().Perm()&0200 != 0,
+		Execute: executableExts[strings.ToLower(filepath.Ext(path))],
+	}
+}
+
+// copyOwner is a no-op on Windows, where the replacement inherits the
+// directory's ACL
+func copyOwner(file *os.File, info fs.FileInfo) error {
+	return nil
+}
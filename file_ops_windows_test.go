@@ -0,0 +1,58 @@
+//go:build windows
+// +build windows
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLongPath(t *testing.T) {
+	deep := `C:\data\` + strings.Repeat(`segment\`, 40) + "file.txt"
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"short", `C:\data\file.txt`, `C:\data\file.txt`},
+		{"overlong", deep, `\\?\` + deep},
+		{"overlong uncleaned", `C:\data\.\` + deep[len(`C:\data\`):], `\\?\` + deep},
+		{"unc", `\\server\share\dir\file.txt`, `\\?\UNC\server\share\dir\file.txt`},
+		{"unc uncleaned", `\\server\share\dir\..\file.txt`, `\\?\UNC\server\share\file.txt`},
+		{"already extended", `\\?\C:\data\file.txt`, `\\?\C:\data\file.txt`},
+		{"device", `\\.\pipe\agent`, `\\.\pipe\agent`},
+		{"relative overlong", strings.Repeat(`segment\`, 40), strings.Repeat(`segment\`, 40)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := longPath(tt.path); got != tt.want {
+				t.Errorf("longPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLongPathReachesDeepFiles(t *testing.T) {
+	dir := t.TempDir()
+	for len(dir) < maxShortPath+20 {
+		dir = filepath.Join(dir, strings.Repeat("d", 50))
+	}
+	if err := os.MkdirAll(longPath(dir), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(longPath(path), []byte("deep"), 0644); err != nil {
+		t.Fatalf("write %d-character path: %v", len(path), err)
+	}
+	got, err := os.ReadFile(longPath(path))
+	if err != nil || string(got) != "deep" {
+		t.Fatalf("read back %q, %v", got, err)
+	}
+}
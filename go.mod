@@ -7,6 +7,8 @@ require (
 	github.com/gorilla/websocket v1.5.3
 	github.com/qsocket/conpty-go v0.0.0-20230315180542-d8f8596877dc
 	github.com/rs/zerolog v1.34.0
+	github.com/zalando/go-keyring v0.2.6
+	golang.org/x/term v0.25.0
 )
 
 require (
@@ -15,6 +17,5 @@ require (
 	github.com/godbus/dbus/v5 v5.1.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
-	github.com/zalando/go-keyring v0.2.6 // indirect
 	golang.org/x/sys v0.26.0 // indirect
 )
@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// startHealthServer serves liveness and readiness probes on HealthAddr:
+// /healthz is always 200 while the process runs, /readyz is 200 only while
+// connected and registered with the server
+func (a *Agent) startHealthServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !a.registered.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("not connected\n"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	})
+
+	a.healthServer = &http.Server{
+		Addr:              a.config.HealthAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		log.Info().Str("addr", a.config.HealthAddr).Msg("health server listening")
+		if err := a.healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Msg("health server failed")
+		}
+	}()
+}
+
+// stopHealthServer shuts down the health server if it was started
+func (a *Agent) stopHealthServer() {
+	if a.healthServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := a.healthServer.Shutdown(ctx); err != nil {
+		log.Warn().Err(err).Msg("health server shutdown failed")
+	}
+}
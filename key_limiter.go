@@ -0,0 +1,76 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import "sync"
+
+// keyLimiter bounds how many operations may run at once for each key. The
+// zero value allows nothing; set limit before use.
+type keyLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	active map[string]int
+}
+
+// acquire reserves a slot for key, reporting false if all are in use.
+// Every successful acquire must be paired with release.
+func (l *keyLimiter) acquire(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active[key] >= l.limit {
+		return false
+	}
+	if l.active == nil {
+		l.active = make(map[string]int)
+	}
+	l.active[key]++
+	return true
+}
+
+// release frees a slot reserved by acquire
+func (l *keyLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active[key]--; l.active[key] <= 0 {
+		delete(l.active, key)
+	}
+}
+
+// serialQueue runs operations for the same key one at a time, in the order
+// they joined. The zero value is ready to use.
+type serialQueue struct {
+	mu    sync.Mutex
+	tails map[string]chan struct{} // closed when the last joined turn leaves
+}
+
+// join takes the next turn for key. It must be called in arrival order, e.g.
+// from the message loop; the returned wait blocks until every earlier turn
+// has left, and leave must be called once the operation is done.
+func (q *serialQueue) join(key string) (wait, leave func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.tails == nil {
+		q.tails = make(map[string]chan struct{})
+	}
+	prev := q.tails[key]
+	done := make(chan struct{})
+	q.tails[key] = done
+
+	wait = func() {
+		if prev != nil {
+			<-prev
+		}
+	}
+	leave = func() {
+		q.mu.Lock()
+		if q.tails[key] == done {
+			delete(q.tails, key)
+		}
+		q.mu.Unlock()
+		close(done)
+	}
+	return wait, leave
+}
@@ -4,13 +4,25 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/zalando/go-keyring"
 )
 
 const (
 	keychainService = "termix-agent"
+
+	// Fallback store for hosts without a keychain, under os.UserConfigDir
+	credentialsFileName = "credentials.json"
+)
+
+var (
+	ErrNotEnrolled         = errors.New("no stored credentials")
+	ErrKeychainUnavailable = errors.New("keychain unavailable")
+	ErrCredentialsCorrupt  = errors.New("stored credentials are corrupt")
 )
 
 // StoredCredentials holds persisted agent credentials
@@ -20,6 +32,11 @@ type StoredCredentials struct {
 	AgentID    string `json:"agentId"`
 	DeviceID   string `json:"deviceId"`
 	SSL        bool   `json:"ssl"`
+
+	CACertPath        string          `json:"caCertPath,omitempty"`
+	PinnedCertSHA256  string          `json:"pinnedCertSha256,omitempty"`
+	ServerFingerprint string          `json:"serverFingerprint,omitempty"` // recorded at enrollment (TOFU)
+	Features          *ServerFeatures `json:"features,omitempty"`          // nil for agents enrolled before features were stored
 }
 
 // SaveCredentials stores agent credentials in OS keychain
@@ -33,26 +50,110 @@ func SaveCredentials(creds *StoredCredentials) error {
 	return keyring.Set(keychainService, username, string(data))
 }
 
-// LoadCredentials retrieves agent credentials from OS keychain
+// SaveCredentialsFile stores agent credentials in the fallback file, readable
+// only by the current user, and returns its path
+func SaveCredentialsFile(creds *StoredCredentials) (string, error) {
+	path, err := credentialsFilePath()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	return path, writeFileAtomic(path, data, 0600)
+}
+
+// SaveServerFingerprint replaces the trusted server fingerprint in the
+// stored credentials
+func SaveServerFingerprint(fingerprint string) error {
+	return UpdateCredentials(func(creds *StoredCredentials) {
+		creds.ServerFingerprint = fingerprint
+	})
+}
+
+// UpdateCredentials applies update to the stored credentials, writing them
+// back to the keychain or, if that fails, to an existing fallback file
+func UpdateCredentials(update func(creds *StoredCredentials)) error {
+	creds, err := LoadCredentials()
+	if err != nil {
+		return err
+	}
+
+	update(creds)
+	if err := SaveCredentials(creds); err != nil {
+		if path, pathErr := credentialsFilePath(); pathErr != nil || !fileExists(path) {
+			return err
+		}
+		_, err = SaveCredentialsFile(creds)
+		return err
+	}
+	return nil
+}
+
+// LoadCredentials retrieves agent credentials from the OS keychain, or from
+// the fallback file when the keychain has none or cannot be used
 func LoadCredentials() (*StoredCredentials, error) {
 	username := getKeychainUser()
 	data, err := keyring.Get(keychainService, username)
+	if errors.Is(err, keyring.ErrNotFound) {
+		err = ErrNotEnrolled
+	} else if err != nil {
+		err = fmt.Errorf("%w: %v", ErrKeychainUnavailable, err)
+	}
+
 	if err != nil {
-		return nil, err
+		fileData, fileErr := readCredentialsFile()
+		if fileErr != nil {
+			return nil, err
+		}
+		data = string(fileData)
 	}
 
 	var creds StoredCredentials
 	if err := json.Unmarshal([]byte(data), &creds); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrCredentialsCorrupt, err)
 	}
 
 	return &creds, nil
 }
 
-// DeleteCredentials removes stored credentials
+// DeleteCredentials removes stored credentials from the keychain and the
+// fallback file. It returns ErrNotEnrolled if neither held any, and an error
+// if either could not be checked or removed, even when the other was.
 func DeleteCredentials() error {
+	var errs []error
+	found := false
+
 	username := getKeychainUser()
-	return keyring.Delete(keychainService, username)
+	switch err := keyring.Delete(keychainService, username); {
+	case err == nil:
+		found = true
+	case !errors.Is(err, keyring.ErrNotFound):
+		errs = append(errs, fmt.Errorf("%w: %v", ErrKeychainUnavailable, err))
+	}
+
+	if path, err := credentialsFilePath(); err == nil {
+		switch err := os.Remove(path); {
+		case err == nil:
+			found = true
+		case !os.IsNotExist(err):
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if !found {
+		return ErrNotEnrolled
+	}
+	return nil
 }
 
 // HasStoredCredentials checks if credentials exist
@@ -61,6 +162,28 @@ func HasStoredCredentials() bool {
 	return err == nil
 }
 
+// credentialsFilePath returns the location of the fallback credentials file
+func credentialsFilePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, keychainService, credentialsFileName), nil
+}
+
+func readCredentialsFile() ([]byte, error) {
+	path, err := credentialsFilePath()
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
 func getKeychainUser() string {
 	hostname, _ := os.Hostname()
 	if hostname == "" {
@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	maxLabels        = 32
+	maxLabelKeyLen   = 63
+	maxLabelValueLen = 128
+)
+
+var (
+	// Keys start with an alphanumeric; "/" allows prefixes like team/owner
+	labelKeyPattern   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+	labelValuePattern = regexp.MustCompile(`^[A-Za-z0-9._:/@-]*$`)
+)
+
+// validateLabel checks a label against the length and charset limits
+func validateLabel(key, value string) error {
+	if key == "" || len(key) > maxLabelKeyLen {
+		return fmt.Errorf("label key %q must be 1 to %d characters", key, maxLabelKeyLen)
+	}
+	if !labelKeyPattern.MatchString(key) {
+		return fmt.Errorf("label key %q must start with a letter or digit and contain only letters, digits, '.', '_', '-' and '/'", key)
+	}
+	if len(value) > maxLabelValueLen {
+		return fmt.Errorf("label %q value is longer than %d characters", key, maxLabelValueLen)
+	}
+	if !labelValuePattern.MatchString(value) {
+		return fmt.Errorf("label %q value may only contain letters, digits, '.', '_', '-', ':', '/' and '@'", key)
+	}
+	return nil
+}
+
+// labelMap is a flag.Value collecting repeated or comma-separated key=value
+// labels. A later value for the same key replaces the earlier one.
+type labelMap map[string]string
+
+func (m *labelMap) String() string {
+	if m == nil || *m == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*m))
+	for key, value := range *m {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (m *labelMap) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("expected key=value, got %q", pair)
+		}
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		if err := validateLabel(key, val); err != nil {
+			return err
+		}
+
+		if *m == nil {
+			*m = make(map[string]string)
+		}
+		(*m)[key] = val
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"cmp"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// validSortBy reports whether by is empty or one of the SortBy* keys
+func validSortBy(by string) bool {
+	switch by {
+	case "", SortByName, SortBySize, SortByModTime, SortByType:
+		return true
+	}
+	return false
+}
+
+// typeRank orders entries for SortByType
+var typeRank = map[string]int{"directory": 0, "link": 1, "file": 2}
+
+// sortedFileItems returns items in the requested order. items comes from
+// os.ReadDir, already sorted by name, and may be shared with concurrent
+// identical listings, so any other order is applied to a copy.
+func sortedFileItems(items []FileItem, by string, desc, dirsFirst bool) []FileItem {
+	if (by == "" || by == SortByName) && !desc && !dirsFirst {
+		return items
+	}
+
+	type sortItem struct {
+		item    FileItem
+		modTime time.Time
+	}
+	sorted := make([]sortItem, len(items))
+	for i, item := range items {
+		sorted[i].item = item
+		if by == SortByModTime {
+			sorted[i].modTime, _ = time.Parse(time.RFC3339, item.ModTime)
+		}
+	}
+
+	slices.SortStableFunc(sorted, func(a, b sortItem) int {
+		if dirsFirst {
+			aDir, bDir := a.item.Type == "directory", b.item.Type == "directory"
+			if aDir != bDir {
+				if aDir {
+					return -1
+				}
+				return 1
+			}
+		}
+
+		var c int
+		switch by {
+		case SortBySize:
+			c = cmp.Compare(a.item.Size, b.item.Size)
+		case SortByModTime:
+			c = a.modTime.Compare(b.modTime)
+		case SortByType:
+			c = cmp.Or(
+				cmp.Compare(typeRank[a.item.Type], typeRank[b.item.Type]),
+				strings.Compare(strings.ToLower(filepath.Ext(a.item.Name)), strings.ToLower(filepath.Ext(b.item.Name))),
+			)
+		}
+		c = cmp.Or(c, strings.Compare(a.item.Name, b.item.Name))
+		if desc {
+			return -c
+		}
+		return c
+	})
+
+	result := make([]FileItem, len(sorted))
+	for i := range sorted {
+		result[i] = sorted[i].item
+	}
+	return result
+}
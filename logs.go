@@ -0,0 +1,128 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// logFileEnv names the environment variable used as the default log file
+const logFileEnv = "TERMIX_LOG_FILE"
+
+const (
+	logTailBlockSize    = 4096
+	logFollowInterval   = 500 * time.Millisecond
+	defaultLogTailLines = 50
+)
+
+// resolveLogFile returns the log file path from the flag value, falling back
+// to the environment. Both the agent and the logs command resolve it this way.
+func resolveLogFile(path string) string {
+	if path != "" {
+		return path
+	}
+	return os.Getenv(logFileEnv)
+}
+
+// tailLines returns the content of the last n lines of the file and the
+// offset just past it
+func tailLines(file *os.File, n int) ([]byte, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	size := info.Size()
+	if n <= 0 {
+		return nil, size, nil
+	}
+
+	// Read backwards block by block until enough newlines are found
+	offset := size
+	var buf []byte
+	for offset > 0 && bytes.Count(buf, []byte("\n")) <= n {
+		readSize := int64(logTailBlockSize)
+		if offset < readSize {
+			readSize = offset
+		}
+		offset -= readSize
+
+		block := make([]byte, readSize)
+		if _, err := file.ReadAt(block, offset); err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		buf = append(block, buf...)
+	}
+
+	// Drop everything before the last n lines (ignoring a trailing newline)
+	trimmed := bytes.TrimSuffix(buf, []byte("\n"))
+	for i := 0; i < n; i++ {
+		idx := bytes.LastIndexByte(trimmed, '\n')
+		if idx < 0 {
+			return buf, size, nil
+		}
+		trimmed = trimmed[:idx]
+	}
+
+	return buf[min(len(trimmed)+1, len(buf)):], size, nil
+}
+
+// followLog prints data appended to the file from offset until interrupted,
+// starting over if the file is truncated or rotated
+func followLog(path string, offset int64, out io.Writer) error {
+	for {
+		time.Sleep(logFollowInterval)
+
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			continue
+		}
+
+		if info.Size() < offset {
+			offset = 0
+		}
+
+		if info.Size() > offset {
+			if _, err := file.Seek(offset, io.SeekStart); err == nil {
+				n, err := io.Copy(out, file)
+				offset += n
+				if err != nil {
+					file.Close()
+					return err
+				}
+			}
+		}
+
+		file.Close()
+	}
+}
+
+// printLogs prints the last lines of the agent log, optionally following it
+func printLogs(path string, lines int, follow bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	content, offset, err := tailLines(file, lines)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read log file: %w", err)
+	}
+
+	os.Stdout.Write(content)
+
+	if !follow {
+		return nil
+	}
+	return followLog(path, offset, os.Stdout)
+}
@@ -0,0 +1,46 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTailLines(t *testing.T) {
+	tests := []struct {
+		content string
+		n       int
+		want    string
+	}{
+		{"", 0, ""},
+		{"", 5, ""},
+		{"a\nb\n", 0, ""},
+		{"a\nb", 0, ""},
+		{"a\nb\nc\n", 2, "b\nc\n"},
+		{"a\nb\nc", 2, "b\nc"},
+		{"a\nb\n", 10, "a\nb\n"},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "log")
+		if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, offset, err := tailLines(file, tt.n)
+		file.Close()
+		if err != nil {
+			t.Fatalf("tailLines(%q, %d): %v", tt.content, tt.n, err)
+		}
+		if string(got) != tt.want || offset != int64(len(tt.content)) {
+			t.Errorf("tailLines(%q, %d) = %q, %d; want %q, %d",
+				tt.content, tt.n, got, offset, tt.want, len(tt.content))
+		}
+	}
+}
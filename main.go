@@ -3,8 +3,11 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"syscall"
@@ -32,6 +35,15 @@ func main() {
 		case "status":
 			runStatus()
 			return
+		case "logs":
+			runLogs()
+			return
+		case "export-credentials":
+			runExportCredentials()
+			return
+		case "import-credentials":
+			runImportCredentials()
+			return
 		case "version", "--version", "-v":
 			fmt.Printf("termix-agent %s (commit: %s, built: %s)\n", version, commit, date)
 			return
@@ -49,11 +61,14 @@ func printMainHelp() {
 	fmt.Fprintf(os.Stderr, "termix-agent - Termix Terminal Agent\n\n")
 	fmt.Fprintf(os.Stderr, "Usage: %s <command> [options]\n\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "Commands:\n")
-	fmt.Fprintf(os.Stderr, "  enroll     Enroll this agent with a Termix server\n")
-	fmt.Fprintf(os.Stderr, "  unenroll   Remove stored credentials and unenroll\n")
-	fmt.Fprintf(os.Stderr, "  status     Show enrollment status\n")
-	fmt.Fprintf(os.Stderr, "  version    Show version information\n")
-	fmt.Fprintf(os.Stderr, "  help       Show this help message\n")
+	fmt.Fprintf(os.Stderr, "  enroll              Enroll this agent with a Termix server\n")
+	fmt.Fprintf(os.Stderr, "  unenroll            Remove stored credentials and unenroll\n")
+	fmt.Fprintf(os.Stderr, "  status              Show enrollment status\n")
+	fmt.Fprintf(os.Stderr, "  logs                Show the agent's log file\n")
+	fmt.Fprintf(os.Stderr, "  export-credentials  Export stored credentials for migration or backup\n")
+	fmt.Fprintf(os.Stderr, "  import-credentials  Store credentials from an export\n")
+	fmt.Fprintf(os.Stderr, "  version             Show version information\n")
+	fmt.Fprintf(os.Stderr, "  help                Show this help message\n")
 	fmt.Fprintf(os.Stderr, "\nRun '%s <command> --help' for more information on a command.\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "\nIf no command is given, the agent will connect using stored credentials.\n")
 }
@@ -66,6 +81,9 @@ func runEnroll() {
 	deviceID := enrollCmd.String("id", "", "Device ID (default: hostname)")
 	ssl := enrollCmd.Bool("ssl", true, "Use TLS/SSL")
 	insecure := enrollCmd.Bool("insecure", false, "Skip TLS verification")
+	caCert := enrollCmd.String("ca-cert", os.Getenv(caCertEnv), "PEM bundle of trusted CAs (env "+caCertEnv+")")
+	pinSHA256 := enrollCmd.String("pin-sha256", "", "Expected SHA-256 fingerprint of the server certificate")
+	keychainFallback := enrollCmd.String("keychain-fallback", KeychainFallbackFile, "If the keychain cannot store credentials: file, print or none")
 	debug := enrollCmd.Bool("debug", false, "Enable debug logging")
 
 	enrollCmd.Usage = func() {
@@ -79,7 +97,7 @@ func runEnroll() {
 
 	enrollCmd.Parse(os.Args[2:])
 
-	setupLogging(*debug)
+	setupLogging(*debug, "")
 
 	if *server == "" || *token == "" {
 		fmt.Fprintf(os.Stderr, "Error: --server and --token are required\n\n")
@@ -87,36 +105,60 @@ func runEnroll() {
 		os.Exit(1)
 	}
 
+	switch *keychainFallback {
+	case KeychainFallbackFile, KeychainFallbackPrint, KeychainFallbackNone:
+	default:
+		fmt.Fprintf(os.Stderr, "Error: --keychain-fallback must be file, print or none\n\n")
+		enrollCmd.Usage()
+		os.Exit(1)
+	}
+
 	cfg := &EnrollConfig{
-		Server:   *server,
-		Token:    *token,
-		DeviceID: *deviceID,
-		SSL:      *ssl,
-		Insecure: *insecure,
+		Server:           *server,
+		Token:            *token,
+		DeviceID:         *deviceID,
+		SSL:              *ssl,
+		KeychainFallback: *keychainFallback,
+		TLSOptions: TLSOptions{
+			Insecure:         *insecure,
+			CACertPath:       *caCert,
+			PinnedCertSHA256: *pinSHA256,
+		},
 	}
 
-	if err := Enroll(cfg); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := Enroll(ctx, cfg); err != nil {
 		log.Fatal().Err(err).Msg("enrollment failed")
 	}
 }
 
 func runUnenroll() {
 	fmt.Println("Removing stored credentials...")
-	if err := DeleteCredentials(); err != nil {
-		fmt.Printf("Warning: %v\n", err)
-		fmt.Println("Credentials may not have been stored.")
-	} else {
+	switch err := DeleteCredentials(); {
+	case errors.Is(err, ErrNotEnrolled):
+		fmt.Println("No stored credentials found.")
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Error: failed to remove credentials: %v\n", err)
+		os.Exit(1)
+	default:
 		fmt.Println("Credentials removed successfully.")
 	}
 }
 
 func runStatus() {
 	creds, err := LoadCredentials()
-	if err != nil {
+	if errors.Is(err, ErrNotEnrolled) {
 		fmt.Println("Status: Not enrolled")
 		fmt.Println("\nRun 'termix-agent enroll' to enroll this agent.")
 		return
 	}
+	if err != nil {
+		fmt.Println("Status: Unknown")
+		printCredentialsError(err)
+		return
+	}
 
 	fmt.Println("Status: Enrolled")
 	fmt.Printf("Server: %s\n", creds.ServerAddr)
@@ -126,15 +168,187 @@ func runStatus() {
 	fmt.Println("\nRun 'termix-agent' to connect.")
 }
 
+func runLogs() {
+	logsCmd := flag.NewFlagSet("logs", flag.ExitOnError)
+
+	logFile := logsCmd.String("log-file", "", "Log file path (env "+logFileEnv+")")
+	lines := logsCmd.Int("n", defaultLogTailLines, "Number of lines to show")
+	follow := logsCmd.Bool("f", false, "Follow the log as it grows")
+
+	logsCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: termix-agent logs [options]\n\n")
+		fmt.Fprintf(os.Stderr, "Show the last lines of the agent's log file.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		logsCmd.PrintDefaults()
+	}
+
+	logsCmd.Parse(os.Args[2:])
+
+	path := resolveLogFile(*logFile)
+	if path == "" {
+		fmt.Fprintf(os.Stderr, "Error: file logging is not configured.\n")
+		fmt.Fprintf(os.Stderr, "Run the agent with --log-file or set %s.\n", logFileEnv)
+		os.Exit(1)
+	}
+
+	if err := printLogs(path, *lines, *follow); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runExportCredentials() {
+	exportCmd := flag.NewFlagSet("export-credentials", flag.ExitOnError)
+
+	out := exportCmd.String("o", "", "Write the export to this file instead of stdout")
+	confirm := exportCmd.Bool("confirm", false, "Confirm exporting the agent token")
+	plaintext := exportCmd.Bool("plaintext", false, "Do not encrypt the export")
+	passphraseFile := exportCmd.String("passphrase-file", "", "Read the passphrase from this file (env "+credentialsPassphraseEnv+")")
+
+	exportCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: termix-agent export-credentials --confirm [options]\n\n")
+		fmt.Fprintf(os.Stderr, "Export the stored credentials, encrypted with a passphrase, so the agent\n")
+		fmt.Fprintf(os.Stderr, "can be moved to another host without enrolling again.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		exportCmd.PrintDefaults()
+	}
+
+	exportCmd.Parse(os.Args[2:])
+
+	if !*confirm {
+		fmt.Fprintf(os.Stderr, "Error: the export contains the agent token, which grants access as this agent.\n")
+		fmt.Fprintf(os.Stderr, "Pass --confirm to export it anyway.\n\n")
+		exportCmd.Usage()
+		os.Exit(1)
+	}
+
+	creds, err := LoadCredentials()
+	if err != nil {
+		printCredentialsError(err)
+		os.Exit(1)
+	}
+
+	passphrase := ""
+	if !*plaintext {
+		passphrase, err = readPassphrase(*passphraseFile, os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	data, err := exportCredentials(creds, passphrase)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *out == "" {
+		fmt.Println(string(data))
+		return
+	}
+	if err := writeFileAtomic(*out, append(data, '\n'), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Credentials exported to %s.\n", *out)
+}
+
+func runImportCredentials() {
+	importCmd := flag.NewFlagSet("import-credentials", flag.ExitOnError)
+
+	passphraseFile := importCmd.String("passphrase-file", "", "Read the passphrase from this file (env "+credentialsPassphraseEnv+")")
+	force := importCmd.Bool("force", false, "Replace credentials that are already stored")
+
+	importCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: termix-agent import-credentials [options] <file|->\n\n")
+		fmt.Fprintf(os.Stderr, "Store credentials from 'termix-agent export-credentials'.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		importCmd.PrintDefaults()
+	}
+
+	importCmd.Parse(os.Args[2:])
+
+	if importCmd.NArg() != 1 {
+		importCmd.Usage()
+		os.Exit(1)
+	}
+
+	if HasStoredCredentials() && !*force {
+		fmt.Fprintf(os.Stderr, "Error: this host is already enrolled. Pass --force to replace its credentials.\n")
+		os.Exit(1)
+	}
+
+	// The passphrase can only be prompted for when stdin is not the export
+	var data []byte
+	var err error
+	var prompt io.Reader = os.Stdin
+	if path := importCmd.Arg(0); path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+		prompt = nil
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	creds, err := importCredentials(data, func() (string, error) {
+		return readPassphrase(*passphraseFile, prompt)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	storedIn := "system keychain"
+	if err := SaveCredentials(creds); err != nil {
+		log.Warn().Err(err).Msg("failed to store credentials in keychain")
+		storedIn, err = SaveCredentialsFile(creds)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to store credentials: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Println("Credentials imported.")
+	fmt.Printf("Server: %s\n", creds.ServerAddr)
+	fmt.Printf("Device ID: %s\n", creds.DeviceID)
+	fmt.Printf("\nCredentials stored in %s.\n", storedIn)
+	fmt.Println("Stop the agent on the old host before running 'termix-agent' here.")
+}
+
+// printCredentialsError explains a credential load failure other than
+// "not enrolled", steering users away from needlessly re-enrolling
+func printCredentialsError(err error) {
+	fmt.Printf("Error: %v\n", err)
+
+	switch {
+	case errors.Is(err, ErrKeychainUnavailable):
+		fmt.Println("\nThe system keychain could not be accessed. Your credentials are")
+		fmt.Println("probably still stored, so do not re-enroll. Check that the keychain")
+		fmt.Println("is unlocked and, on Linux, that a Secret Service provider is running")
+		fmt.Println("on the session D-Bus, then try again.")
+	case errors.Is(err, ErrCredentialsCorrupt):
+		fmt.Println("\nThe stored credentials could not be decoded. Run")
+		fmt.Println("'termix-agent unenroll' and enroll again.")
+	}
+}
+
 func runAgent() {
 	// Check for stored credentials first
 	creds, err := LoadCredentials()
-	if err != nil {
+	if errors.Is(err, ErrNotEnrolled) {
 		fmt.Println("Not enrolled. Please enroll first:")
 		fmt.Println("  termix-agent enroll --server <host:port> --token <install-token>")
 		fmt.Println("\nRun 'termix-agent help' for more information.")
 		os.Exit(1)
 	}
+	if err != nil {
+		printCredentialsError(err)
+		os.Exit(1)
+	}
 
 	config := DefaultConfig()
 
@@ -143,15 +357,61 @@ func runAgent() {
 	config.Token = creds.AgentToken
 	config.DeviceID = creds.DeviceID
 	config.SSL = creds.SSL
+	if creds.CACertPath != "" {
+		config.CACertPath = creds.CACertPath
+	}
+	config.PinnedCertSHA256 = creds.PinnedCertSHA256
+	config.TrustedFingerprint = creds.ServerFingerprint
 
 	// Allow CLI overrides
 	flag.StringVar(&config.ServerAddr, "server", config.ServerAddr, "Server address")
 	flag.StringVar(&config.DeviceID, "id", config.DeviceID, "Device ID")
+	flag.BoolVar(&config.AutoUniqueDeviceID, "auto-unique-id", config.AutoUniqueDeviceID, "Append a random suffix to the device ID if it is already in use")
 	flag.BoolVar(&config.SSL, "ssl", config.SSL, "Use TLS/SSL")
 	flag.BoolVar(&config.Insecure, "insecure", config.Insecure, "Skip TLS verification")
+	flag.StringVar(&config.CACertPath, "ca-cert", config.CACertPath, "PEM bundle of trusted CAs (env "+caCertEnv+")")
+	flag.StringVar(&config.PinnedCertSHA256, "pin-sha256", config.PinnedCertSHA256, "Expected SHA-256 fingerprint of the server certificate")
+	flag.BoolVar(&config.VerifyFingerprint, "verify-fingerprint", config.VerifyFingerprint, "Refuse to connect if the server certificate changed since enrollment")
+	flag.BoolVar(&config.AcceptFingerprint, "accept-fingerprint", false, "With --verify-fingerprint, trust the server's current certificate and store its fingerprint")
 	flag.BoolVar(&config.Reconnect, "reconnect", config.Reconnect, "Auto-reconnect")
 	flag.IntVar(&config.Heartbeat, "heartbeat", config.Heartbeat, "Heartbeat interval")
+	flag.DurationVar(&config.HeartbeatJitter, "heartbeat-jitter", config.HeartbeatJitter, "Maximum random deviation from the heartbeat interval")
+	flag.DurationVar(&config.BackoffResetAfter, "backoff-reset-after", config.BackoffResetAfter, "How long a connection must stay registered before the reconnect delay resets")
+	flag.DurationVar(&config.KeepaliveInterval, "keepalive", config.KeepaliveInterval, "Send a heartbeat after this much outbound silence (0 disables)")
 	flag.BoolVar(&config.Debug, "debug", config.Debug, "Enable debug logging")
+	flag.Var((*logLevel)(&config.OpLogLevel), "op-log-level", "Log level for individual requests (e.g. debug to keep them out of production logs)")
+	flag.StringVar(&config.LogFile, "log-file", config.LogFile, "Also write logs to this file (env "+logFileEnv+")")
+	flag.Var((*stringList)(&config.Subprotocols), "subprotocol", "WebSocket subprotocol to offer (repeatable or comma-separated)")
+	flag.Var((*octalMode)(&config.Umask), "umask", "Octal permission bits to strip from created files and folders (e.g. 027)")
+	flag.Var((*stringList)(&config.EnvAllowlist), "env-allow", "Additional environment variable (or pattern) the server may query")
+	flag.Var((*stringList)(&config.PtyEnvPassthrough), "pty-env", "Agent environment variable passed on to terminals (repeatable)")
+	flag.IntVar(&config.MatchMaxFiles, "match-max-files", config.MatchMaxFiles, "Maximum files in a glob download archive")
+	flag.Int64Var(&config.MatchMaxBytes, "match-max-bytes", config.MatchMaxBytes, "Maximum total bytes in a glob download archive")
+	flag.Int64Var(&config.ControlMaxSize, "control-max-size", config.ControlMaxSize, "Maximum size in bytes of an incoming control message")
+	flag.Int64Var(&config.MaxUploadBytes, "max-upload-bytes", config.MaxUploadBytes, "Maximum size in bytes of an uploaded file, including chunked uploads (0 = unlimited)")
+	flag.Int64Var(&config.DataMaxSize, "data-max-size", config.DataMaxSize, "Maximum size in bytes of an incoming upload_file, upload_chunk or patch_file message")
+	flag.StringVar(&config.TempDir, "temp-dir", config.TempDir, "Directory for temporary archives and spool files")
+	flag.Var((*mimeMap)(&config.MimeOverrides), "mime-type", "MIME type override as .ext=type (repeatable)")
+	flag.Var((*labelMap)(&config.Labels), "label", "Agent label as key=value, sent to the server for grouping (repeatable or comma-separated)")
+	flag.Var((*argList)(&config.ShellArgs), "shell-args", "Whitespace-separated arguments passed to the terminal shell (empty for none)")
+	flag.BoolVar(&config.PtyCompression, "pty-compression", config.PtyCompression, "Allow the server to request compressed terminal output")
+	flag.BoolVar(&config.ConfirmDangerous, "confirm-dangerous", config.ConfirmDangerous, "Require server confirmation before running commands that match a dangerous pattern")
+	flag.Var((*repeatedList)(&config.DangerousPatterns), "dangerous-pattern", "Additional regular expression marking a command as dangerous (repeatable, commas are part of the pattern)")
+	flag.BoolVar(&config.CleanCommandEnv, "clean-command-env", config.CleanCommandEnv, "Run commands with a minimal environment instead of inheriting the agent's")
+	flag.BoolVar(&config.AllowRemoteRestart, "allow-remote-restart", config.AllowRemoteRestart, "Let the server restart the agent process")
+	flag.BoolVar(&config.AllowSelfUpdate, "allow-self-update", config.AllowSelfUpdate, "Install agent updates offered by the server (checksum verified, https only)")
+	flag.BoolVar(&config.AllowUserFallback, "allow-user-fallback", config.AllowUserFallback, "Run terminals as the agent's user if the requested user is unknown or cannot be switched to")
+	flag.BoolVar(&config.UsePAM, "use-pam", config.UsePAM, "Start terminals through login(1) to open a PAM session (requires root)")
+	flag.StringVar(&config.HealthAddr, "health-addr", config.HealthAddr, "Listen address for /healthz and /readyz (e.g. :8080)")
+	flag.DurationVar(&config.OpTimeout, "op-timeout", config.OpTimeout, "Deadline for each file operation, 0 disables")
+	flag.DurationVar(&config.ShutdownGracePeriod, "shutdown-grace", config.ShutdownGracePeriod, "Time to let in-flight work finish on shutdown")
+	flag.BoolVar(&config.EnablePty, "enable-pty", config.EnablePty, "Allow terminal sessions")
+	flag.BoolVar(&config.EnableExec, "enable-exec", config.EnableExec, "Allow remote command execution")
+	flag.BoolVar(&config.EnableFileOps, "enable-file-ops", config.EnableFileOps, "Allow file manager operations")
+	flag.BoolVar(&config.EnableCompress, "enable-compress", config.EnableCompress, "Allow archive creation")
+	flag.BoolVar(&config.AllowRoot, "allow-root", config.AllowRoot, "Allow running as root (every command and file operation gets full privilege)")
+	flag.BoolVar(&config.ReadOnly, "read-only", config.ReadOnly, "Refuse all requests that could modify the host")
+	flag.Var((*repeatedList)(&config.AllowedMounts), "allowed-mount", "Directory tree file operations are limited to (repeatable)")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: termix-agent [options]\n\n")
@@ -162,12 +422,19 @@ func runAgent() {
 
 	flag.Parse()
 
-	setupLogging(config.Debug)
+	// Server features can only narrow what the host operator allows
+	config.ApplyServerFeatures(creds.Features)
+
+	setupLogging(config.Debug, config.LogFile)
 
 	if err := config.Validate(); err != nil {
 		log.Fatal().Err(err).Msg("invalid configuration")
 	}
 
+	if os.Geteuid() == 0 {
+		log.Warn().Msg("running as root: the server can run any command with full privilege")
+	}
+
 	log.Info().
 		Str("server", config.ServerAddr).
 		Str("deviceId", config.DeviceID).
@@ -190,15 +457,35 @@ func runAgent() {
 		log.Fatal().Err(err).Msg("agent error")
 	}
 
+	if agent.RestartRequested() {
+		log.Info().Msg("restarting termix-agent")
+		if err := reexec(); err != nil {
+			log.Fatal().Err(err).Msg("failed to restart")
+		}
+		return
+	}
+
 	log.Info().Msg("termix-agent stopped")
 }
 
-func setupLogging(debug bool) {
+func setupLogging(debug bool, logFile string) {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	if debug {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	} else {
 		zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	}
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	var out io.Writer = zerolog.ConsoleWriter{Out: os.Stderr}
+
+	if path := resolveLogFile(logFile); path != "" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: cannot open log file %s: %v\n", path, err)
+		} else {
+			out = zerolog.MultiLevelWriter(out, zerolog.ConsoleWriter{Out: file, NoColor: true})
+		}
+	}
+
+	log.Logger = log.Output(out)
 }
@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// opSummaryInterval is how often counts of high-frequency requests are logged
+const opSummaryInterval = time.Minute
+
+// highFrequencyTypes are requests a busy UI sends in bursts. They are only
+// logged individually at debug level and otherwise summarised periodically.
+var highFrequencyTypes = map[string]bool{
+	MsgTypeListFiles:      true,
+	MsgTypeStreamFileInfo: true,
+	MsgTypeStreamChunk:    true,
+	MsgTypeGetDirStats:    true,
+	MsgTypeFileQuickStats: true,
+	MsgTypeCmdStdin:       true,
+}
+
+// opCounter counts handled requests by type between summaries
+type opCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (c *opCounter) add(msgType string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+	c.counts[msgType]++
+}
+
+// take returns the counts so far and resets them
+func (c *opCounter) take() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := c.counts
+	c.counts = nil
+	return counts
+}
+
+// opLog starts the log event for a request handler at the configured
+// operation log level, or at debug level for high-frequency requests
+func (a *Agent) opLog(msgType string) *zerolog.Event {
+	if highFrequencyTypes[msgType] {
+		return log.Debug()
+	}
+	return log.WithLevel(a.config.OpLogLevel)
+}
+
+// opSummaryLoop periodically logs how many high-frequency requests were
+// handled, in place of logging each one
+func (a *Agent) opSummaryLoop() {
+	ticker := time.NewTicker(opSummaryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.stopChan:
+			return
+		case <-ticker.C:
+			counts := a.opCounts.take()
+			if len(counts) == 0 {
+				continue
+			}
+
+			event := log.WithLevel(a.config.OpLogLevel).Dur("interval", opSummaryInterval)
+			for msgType, n := range counts {
+				event = event.Int(msgType, n)
+			}
+			event.Msg("handled requests")
+		}
+	}
+}
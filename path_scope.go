@@ -0,0 +1,213 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// ErrOutOfScope is returned for file operations outside the path scope the
+// server set for this connection
+var ErrOutOfScope = errors.New("path is outside the allowed scope")
+
+// pathScope restricts file operations to a set of directory trees. Paths
+// are compared after resolving symlinks, so a link inside the scope cannot
+// be used to reach outside it.
+type pathScope struct {
+	prefixes []string
+}
+
+// newPathScope returns a scope for the given absolute prefixes, or nil
+// (unrestricted) if there are none
+func newPathScope(prefixes []string) *pathScope {
+	var scope pathScope
+	for _, prefix := range prefixes {
+		if prefix == "" || !filepath.IsAbs(prefix) {
+			continue
+		}
+		scope.prefixes = append(scope.prefixes, resolvePath(prefix))
+	}
+	if len(scope.prefixes) == 0 {
+		return nil
+	}
+	return &scope
+}
+
+// allows reports whether path lies within one of the scope's prefixes
+func (s *pathScope) allows(path string) bool {
+	if s == nil {
+		return true
+	}
+
+	resolved := resolvePath(path)
+	for _, prefix := range s.prefixes {
+		if hasPathPrefix(resolved, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePath makes path absolute and resolves symlinks in the longest
+// existing part of it, so paths of files yet to be created also resolve
+func resolvePath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+
+	var rest []string
+	for {
+		if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...)
+		}
+		parent := filepath.Dir(abs)
+		if parent == abs {
+			return filepath.Join(append([]string{abs}, rest...)...)
+		}
+		rest = append([]string{filepath.Base(abs)}, rest...)
+		abs = parent
+	}
+}
+
+// hasPathPrefix reports whether path is prefix or lies below it
+func hasPathPrefix(path, prefix string) bool {
+	if runtime.GOOS == "windows" {
+		path, prefix = strings.ToLower(path), strings.ToLower(prefix)
+	}
+	if path == prefix {
+		return true
+	}
+	if !strings.HasSuffix(prefix, string(os.PathSeparator)) {
+		prefix += string(os.PathSeparator)
+	}
+	return strings.HasPrefix(path, prefix)
+}
+
+// listedPaths extracts a "paths" list given either as strings or as
+// objects with a "path" field (delete_items)
+func listedPaths(raw json.RawMessage) []string {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	var paths []string
+	if json.Unmarshal(raw, &paths) == nil {
+		return paths
+	}
+
+	var targets []struct {
+		Path string `json:"path"`
+	}
+	if json.Unmarshal(raw, &targets) == nil {
+		for _, t := range targets {
+			paths = append(paths, t.Path)
+		}
+	}
+	return paths
+}
+
+// expandPath applies the shorthands file operations accept: an empty path
+// lists the root and a leading "~" is the agent user's home directory
+func expandPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	if strings.HasPrefix(path, "~") {
+		if homeDir, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(homeDir, path[1:])
+		}
+	}
+	return path
+}
+
+// requestPaths extracts every path a file operation request would read or
+// write, including those it derives from names. Each path is returned both
+// as sent and as expandPath would rewrite it, so the check holds whichever
+// form the operation ends up using. A payload that is not a JSON object is
+// an error rather than a request without paths.
+func requestPaths(msg *Message) ([]string, error) {
+	var fields struct {
+		Path        *string         `json:"path"`
+		FileName    string          `json:"fileName"`
+		FolderName  string          `json:"folderName"`
+		NewName     string          `json:"newName"`
+		SourcePath  string          `json:"sourcePath"`
+		TargetDir   string          `json:"targetDir"`
+		TargetPath  string          `json:"targetPath"`
+		RootPath    string          `json:"rootPath"`
+		ArchivePath string          `json:"archivePath"`
+		ArchiveName string          `json:"archiveName"`
+		RawPaths    json.RawMessage `json:"paths"`
+	}
+	if len(msg.Data) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal(msg.Data, &fields); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadPayload, err)
+	}
+	listed := listedPaths(fields.RawPaths)
+
+	// An explicit empty path means the root, see expandPath
+	var path string
+	if fields.Path != nil {
+		path = expandPath(*fields.Path)
+	}
+
+	paths := append([]string{
+		path,
+		fields.SourcePath,
+		fields.TargetDir,
+		fields.TargetPath,
+		fields.RootPath,
+		fields.ArchivePath,
+	}, listed...)
+
+	if fields.Path != nil {
+		paths = append(paths, *fields.Path)
+	}
+	if fields.FileName != "" {
+		paths = append(paths, filepath.Join(path, fields.FileName))
+	}
+	if fields.FolderName != "" {
+		paths = append(paths, filepath.Join(path, fields.FolderName))
+	}
+	if fields.NewName != "" {
+		paths = append(paths, filepath.Join(filepath.Dir(path), fields.NewName))
+	}
+	if fields.ArchiveName != "" && len(listed) > 0 {
+		// compress_files writes the archive next to the first source
+		paths = append(paths, filepath.Join(filepath.Dir(listed[0]), fields.ArchiveName))
+	}
+
+	checked := make([]string, 0, 2*len(paths))
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		checked = append(checked, p)
+		if expanded := expandPath(p); expanded != p {
+			checked = append(checked, expanded)
+		}
+	}
+	return checked, nil
+}
+
+// allowsAll reports whether every path is within every scope, returning
+// the first path that is not
+func allowsAll(paths []string, scopes ...*pathScope) (string, bool) {
+	for _, path := range paths {
+		for _, scope := range scopes {
+			if !scope.allows(path) {
+				return path, false
+			}
+		}
+	}
+	return "", true
+}
@@ -0,0 +1,238 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func scopeMessage(t *testing.T, msgType string, data any) *Message {
+	t.Helper()
+	raw, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Message{Type: msgType, Data: raw}
+}
+
+func TestPathScopeTraversal(t *testing.T) {
+	root := t.TempDir()
+	allowed := filepath.Join(root, "data")
+	if err := os.Mkdir(allowed, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	scope := newPathScope([]string{allowed})
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{allowed, true},
+		{filepath.Join(allowed, "file.txt"), true},
+		{filepath.Join(allowed, "sub", "..", "file.txt"), true},
+		{filepath.Join(allowed, "..", "etc", "passwd"), false},
+		{filepath.Join(allowed, "..", "data-other", "file.txt"), false},
+		{allowed + "-other", false},
+		{root, false},
+	}
+	for _, tt := range tests {
+		if got := scope.allows(tt.path); got != tt.want {
+			t.Errorf("allows(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPathScopeSymlinkEscape(t *testing.T) {
+	root := t.TempDir()
+	allowed := filepath.Join(root, "data")
+	outside := filepath.Join(root, "secret")
+	for _, dir := range []string{allowed, outside} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(allowed, "link")); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+	scope := newPathScope([]string{allowed})
+
+	for _, path := range []string{
+		filepath.Join(allowed, "link"),
+		filepath.Join(allowed, "link", "existing.txt"),
+		filepath.Join(allowed, "link", "new", "file.txt"),
+	} {
+		if scope.allows(path) {
+			t.Errorf("allows(%q) = true through a symlink leaving the scope", path)
+		}
+	}
+
+	// A link to the allowed tree from outside is judged by its target
+	if err := os.Symlink(allowed, filepath.Join(outside, "back")); err != nil {
+		t.Fatal(err)
+	}
+	if !scope.allows(filepath.Join(outside, "back", "file.txt")) {
+		t.Error("link into the scope was refused")
+	}
+
+	// Copying or compressing an allowed tree that holds an outward link
+	// keeps the link rather than the content it points to
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tree := filepath.Join(allowed, "tree")
+	if err := os.Mkdir(tree, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(tree, "link")); err != nil {
+		t.Fatal(err)
+	}
+	f, sent := newTestFileOps(t)
+
+	t.Run("copy_item", func(t *testing.T) {
+		target := filepath.Join(allowed, "copies")
+		if err := os.Mkdir(target, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		f.CopyItem(context.Background(), &CopyItemData{RequestID: "copy", SourcePath: tree, TargetDir: target, Verify: true})
+		if result, ok := sent.last(t).data.(FileOpResultData); !ok || !result.Success {
+			t.Fatalf("copy result = %+v", sent.last(t).data)
+		}
+
+		copied := filepath.Join(target, "tree", "link")
+		info, err := os.Lstat(copied)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Fatalf("copied link = %v, %v; want a symlink", info, err)
+		}
+		if scope.allows(filepath.Join(copied, "secret.txt")) {
+			t.Error("copied link reaches outside the scope")
+		}
+	})
+
+	t.Run("compress_files", func(t *testing.T) {
+		if _, err := exec.LookPath("zip"); err != nil {
+			t.Skip("zip not installed")
+		}
+		f.CompressFiles(context.Background(), &CompressFilesData{RequestID: "zip", Paths: []string{tree}, ArchiveName: "tree.zip"})
+		if result, ok := sent.last(t).data.(FileOpResultData); !ok || !result.Success {
+			t.Fatalf("compress result = %+v", sent.last(t).data)
+		}
+
+		zr, err := zip.OpenReader(filepath.Join(allowed, "tree.zip"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		for _, file := range zr.File {
+			if strings.Contains(file.Name, "secret") {
+				t.Errorf("archive holds %s from outside the scope", file.Name)
+			}
+			if file.Name == "tree/link" && file.Mode()&os.ModeSymlink == 0 {
+				t.Errorf("tree/link archived as %v, want a symlink", file.Mode())
+			}
+		}
+	})
+}
+
+func TestRequestPathsExpandsShorthands(t *testing.T) {
+	scope := newPathScope([]string{t.TempDir()})
+
+	for _, path := range []string{"", "~", "~/.ssh"} {
+		paths, err := requestPaths(scopeMessage(t, MsgTypeListFiles, map[string]string{
+			"requestId": "r1",
+			"path":      path,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := allowsAll(paths, scope); ok {
+			t.Errorf("list_files of %q passed a scope that excludes it", path)
+		}
+	}
+
+	// Messages without a path field have nothing to check
+	paths, err := requestPaths(scopeMessage(t, MsgTypeUploadChunk, map[string]any{
+		"requestId": "r2",
+		"offset":    0,
+	}))
+	if err != nil || len(paths) != 0 {
+		t.Errorf("requestPaths without a path = %v, %v", paths, err)
+	}
+}
+
+func TestRequestPathsMalformed(t *testing.T) {
+	for _, data := range []string{`[1,2]`, `"path"`, `{"path": 5}`} {
+		_, err := requestPaths(&Message{Type: MsgTypeListFiles, Data: json.RawMessage(data)})
+		if !errors.Is(err, ErrBadPayload) {
+			t.Errorf("requestPaths(%s) error = %v, want ErrBadPayload", data, err)
+		}
+	}
+}
+
+func TestServerScopeKeepsNestedLinks(t *testing.T) {
+	root := t.TempDir()
+	allowed := filepath.Join(root, "data")
+	outside := filepath.Join(root, "secret")
+	tree := filepath.Join(allowed, "tree")
+	for _, dir := range []string{tree, outside} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(tree, "link")); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+
+	a, sent := newTestAgent(t, &Config{EnableFileOps: true, EnableCompress: true})
+	a.scope.Store(newPathScope([]string{allowed}))
+	handle := func(msgType string, data any) {
+		t.Helper()
+		raw, err := json.Marshal(map[string]any{"type": msgType, "data": data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.handleMessage(raw); err != nil {
+			t.Fatalf("%s: %v", msgType, err)
+		}
+		a.ops.Wait()
+		if result, ok := sent.last(t).data.(FileOpResultData); !ok || !result.Success {
+			t.Fatalf("%s result = %+v", msgType, sent.last(t).data)
+		}
+	}
+
+	handle(MsgTypeCopyItem, CopyItemData{RequestID: "copy", SourcePath: tree, TargetDir: allowed})
+	copied := filepath.Join(allowed, "tree (1)")
+	if _, err := os.Stat(filepath.Join(copied, "link", "secret.txt")); err != nil {
+		t.Fatalf("copied link does not resolve: %v", err)
+	}
+	if info, err := os.Lstat(filepath.Join(copied, "link")); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("copy_item under the server's scope followed the link: %v, %v", info, err)
+	}
+
+	if _, err := exec.LookPath("zip"); err != nil {
+		t.Skip("zip not installed")
+	}
+	handle(MsgTypeCompressFiles, CompressFilesData{RequestID: "zip", Paths: []string{tree}, ArchiveName: "tree.zip"})
+	var names []string
+	_, err := listArchive(context.Background(), filepath.Join(allowed, "tree.zip"), 100, func(e ArchiveEntry) {
+		names = append(names, e.Name)
+	})
+	if err != nil || len(names) == 0 {
+		t.Fatalf("archive entries = %v, %v", names, err)
+	}
+	for _, name := range names {
+		if strings.Contains(name, "secret") {
+			t.Errorf("compress_files under the server's scope archived %s", name)
+		}
+	}
+}
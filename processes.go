@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxProcessList    = 2000 // processes returned per list_processes
+	maxProcessCommand = 1024 // bytes of each command line kept
+)
+
+// ErrProtectedProcess is returned when asked to signal the agent itself or
+// a process that must not be signalled
+var ErrProtectedProcess = errors.New("refusing to signal this process")
+
+// processList lists the host's processes, busiest first, capped at the
+// requested limit
+func processList(ctx context.Context, data *ListProcessesData) ProcessListData {
+	result := ProcessListData{RequestID: data.RequestID}
+
+	procs, err := listProcesses(ctx)
+	if err != nil {
+		result.Error = fmt.Sprintf("Failed to list processes: %v", err)
+		return result
+	}
+
+	sort.Slice(procs, func(i, j int) bool {
+		if procs[i].CPU != procs[j].CPU {
+			return procs[i].CPU > procs[j].CPU
+		}
+		return procs[i].PID < procs[j].PID
+	})
+
+	limit := data.Limit
+	if limit <= 0 || limit > maxProcessList {
+		limit = maxProcessList
+	}
+	result.Total = len(procs)
+	if len(procs) > limit {
+		procs = procs[:limit]
+		result.Truncated = true
+	}
+
+	for i := range procs {
+		procs[i].Command = sanitizeCommand(procs[i].Command)
+	}
+	result.Processes = procs
+	return result
+}
+
+// checkSignalTarget rejects PIDs that would address process groups, init
+// or the agent itself
+func checkSignalTarget(pid int) error {
+	if pid <= 1 || pid == os.Getpid() {
+		return fmt.Errorf("%w: pid %d", ErrProtectedProcess, pid)
+	}
+	return nil
+}
+
+// sanitizeCommand makes a command line safe to display: invalid UTF-8 and
+// control characters are replaced and the length is capped
+func sanitizeCommand(cmd string) string {
+	cmd = strings.ToValidUTF8(cmd, "�")
+	cmd = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, cmd)
+	cmd = strings.TrimSpace(cmd)
+
+	if len(cmd) > maxProcessCommand {
+		cut := maxProcessCommand
+		for cut > 0 && !utf8.RuneStart(cmd[cut]) {
+			cut--
+		}
+		cmd = cmd[:cut] + "…"
+	}
+	return cmd
+}
@@ -0,0 +1,136 @@
+//go:build linux
+// +build linux
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// clockTicks is USER_HZ, the unit of the CPU times in /proc/<pid>/stat.
+// It is 100 on every architecture Linux supports.
+const clockTicks = 100
+
+// listProcesses reads the process table from /proc. Processes that exit
+// while being read are skipped.
+func listProcesses(ctx context.Context) ([]ProcessInfo, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	uptime := procUptime()
+	pageSize := uint64(os.Getpagesize())
+	users := make(map[uint32]string)
+
+	var procs []ProcessInfo
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if proc, ok := readProc(pid, uptime, pageSize, users); ok {
+			procs = append(procs, proc)
+		}
+	}
+	return procs, nil
+}
+
+// readProc reads one process from /proc/<pid>
+func readProc(pid int, uptime float64, pageSize uint64, users map[uint32]string) (ProcessInfo, bool) {
+	dir := "/proc/" + strconv.Itoa(pid)
+	stat, err := os.ReadFile(dir + "/stat")
+	if err != nil {
+		return ProcessInfo{}, false
+	}
+
+	// pid (comm) state ppid ...; comm may itself contain spaces and parens
+	open, end := bytes.IndexByte(stat, '('), bytes.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return ProcessInfo{}, false
+	}
+	comm := string(stat[open+1 : end])
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 22 {
+		return ProcessInfo{}, false
+	}
+
+	proc := ProcessInfo{PID: pid}
+	proc.PPID, _ = strconv.Atoi(fields[1])
+
+	// Fields are numbered from state, which is field 3 in proc(5)
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	start, _ := strconv.ParseUint(fields[19], 10, 64)
+	rss, _ := strconv.ParseUint(fields[21], 10, 64)
+	proc.RSS = rss * pageSize
+	if elapsed := uptime - float64(start)/clockTicks; elapsed > 0 {
+		proc.CPU = float64(utime+stime) / clockTicks / elapsed * 100
+	}
+
+	if info, err := os.Stat(dir); err == nil {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			proc.User = cachedUsername(users, st.Uid)
+		}
+	}
+
+	proc.Command = readCmdline(dir + "/cmdline")
+	if proc.Command == "" {
+		// Kernel threads and zombies have no command line
+		proc.Command = "[" + comm + "]"
+	}
+	return proc, true
+}
+
+// readCmdline returns a process's arguments joined by spaces, reading no
+// more than maxProcessCommand bytes
+func readCmdline(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	buf := make([]byte, maxProcessCommand+1)
+	n, _ := io.ReadFull(f, buf)
+	buf = bytes.TrimRight(buf[:n], "\x00")
+	return string(bytes.ReplaceAll(buf, []byte{0}, []byte{' '}))
+}
+
+// procUptime returns the seconds since boot, or 0 if unknown
+func procUptime() float64 {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	uptime, _ := strconv.ParseFloat(fields[0], 64)
+	return uptime
+}
+
+// cachedUsername looks up the name for uid, falling back to the number
+func cachedUsername(cache map[uint32]string, uid uint32) string {
+	if name, ok := cache[uid]; ok {
+		return name
+	}
+	name := strconv.FormatUint(uint64(uid), 10)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	cache[uid] = name
+	return name
+}
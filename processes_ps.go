@@ -0,0 +1,45 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// listProcesses runs ps(1), which every BSD and macOS provides
+func listProcesses(ctx context.Context) ([]ProcessInfo, error) {
+	out, err := exec.CommandContext(ctx, "ps", "-axo", "pid=,ppid=,user=,pcpu=,rss=,args=").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var procs []ProcessInfo
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+
+		proc := ProcessInfo{PID: pid, User: fields[2], Command: strings.Join(fields[5:], " ")}
+		proc.PPID, _ = strconv.Atoi(fields[1])
+		proc.CPU, _ = strconv.ParseFloat(fields[3], 64)
+		rss, _ := strconv.ParseUint(fields[4], 10, 64)
+		proc.RSS = rss * 1024 // ps reports KiB
+		procs = append(procs, proc)
+	}
+	return procs, scanner.Err()
+}
@@ -0,0 +1,44 @@
+//go:build !windows
+// +build !windows
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// processSignals are the signals kill_process accepts, by name without the
+// SIG prefix
+var processSignals = map[string]syscall.Signal{
+	"TERM": syscall.SIGTERM,
+	"KILL": syscall.SIGKILL,
+	"INT":  syscall.SIGINT,
+	"HUP":  syscall.SIGHUP,
+	"QUIT": syscall.SIGQUIT,
+	"STOP": syscall.SIGSTOP,
+	"CONT": syscall.SIGCONT,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// killProcess sends the named signal (default TERM) to pid
+func killProcess(pid int, signal string) error {
+	if err := checkSignalTarget(pid); err != nil {
+		return err
+	}
+
+	name := strings.TrimPrefix(strings.ToUpper(signal), "SIG")
+	if name == "" {
+		name = "TERM"
+	}
+	sig, ok := processSignals[name]
+	if !ok {
+		return fmt.Errorf("unsupported signal %q", signal)
+	}
+
+	return syscall.Kill(pid, sig)
+}
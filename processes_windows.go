@@ -0,0 +1,67 @@
+//go:build windows
+// +build windows
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// listProcesses takes a Toolhelp snapshot of the running processes
+func listProcesses(ctx context.Context) ([]ProcessInfo, error) {
+	snapshot, err := syscall.CreateToolhelp32Snapshot(syscall.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.CloseHandle(snapshot)
+
+	var entry syscall.ProcessEntry32
+	entry.Size = uint32(unsafe.Sizeof(entry))
+	if err := syscall.Process32First(snapshot, &entry); err != nil {
+		return nil, err
+	}
+
+	var procs []ProcessInfo
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		procs = append(procs, ProcessInfo{
+			PID:     int(entry.ProcessID),
+			PPID:    int(entry.ParentProcessID),
+			Command: syscall.UTF16ToString(entry.ExeFile[:]),
+		})
+		if err := syscall.Process32Next(snapshot, &entry); err != nil {
+			break // ERROR_NO_MORE_FILES
+		}
+	}
+	return procs, nil
+}
+
+// killProcess terminates pid. Windows has no signals, so only TERM and
+// KILL (or none) are accepted and both terminate the process.
+func killProcess(pid int, signal string) error {
+	if err := checkSignalTarget(pid); err != nil {
+		return err
+	}
+
+	switch strings.TrimPrefix(strings.ToUpper(signal), "SIG") {
+	case "", "TERM", "KILL":
+	default:
+		return fmt.Errorf("unsupported signal %q", signal)
+	}
+
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	defer proc.Release()
+	return proc.Kill()
+}
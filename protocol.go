@@ -2,22 +2,54 @@
 
 package main
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrBadPayload is returned when a message body cannot be decoded
+var ErrBadPayload = errors.New("malformed message data")
+
+// ProtocolVersion is reported in capabilities responses and increases when
+// existing messages change incompatibly
+const ProtocolVersion = 1
 
 // Message types
 const (
 	// Agent → Server
-	MsgTypeRegister  = "register"
-	MsgTypeHeartbeat = "heartbeat"
-	MsgTypePtyData   = "pty_data"
-	MsgTypePtyExit   = "pty_exit"
-	MsgTypeCmdResult = "cmd_result"
-	MsgTypeCmdError  = "cmd_error"
-	MsgTypePong      = "pong"
+	MsgTypeRegister   = "register"
+	MsgTypeHeartbeat  = "heartbeat"
+	MsgTypePtyData    = "pty_data"
+	MsgTypePtyExit    = "pty_exit"
+	MsgTypePtySpawned = "pty_spawned"
+	MsgTypePtyError   = "pty_error"
+	MsgTypeCmdResult  = "cmd_result"
+	MsgTypeCmdError   = "cmd_error"
+	MsgTypeAgentEvent = "agent_event" // unsolicited notification, see AgentEventData
+
+	MsgTypeCmdConfirmRequired = "cmd_confirm_required"
+	MsgTypePong               = "pong"
+
+	// Session management responses (Agent → Server)
+	MsgTypeSessionList        = "session_list"
+	MsgTypePruneSessionResult = "prune_session_result"
+	MsgTypeEnvValues          = "env_values"
+	MsgTypeReconnectAck       = "reconnect_ack"
+	MsgTypeCapabilitiesResult = "capabilities_result"
+	MsgTypeVersionStatus      = "version_status"
+	MsgTypeWhoAmIResult       = "whoami_result"
+	MsgTypeRestartAck         = "restart_ack"
+
+	// Process and service responses (Agent → Server)
+	MsgTypeProcessList         = "process_list"
+	MsgTypeKillProcessResult   = "kill_process_result"
+	MsgTypeServiceStatusResult = "service_status_result"
 
 	// File operation responses (Agent → Server)
 	MsgTypeFileList     = "file_list"
 	MsgTypeFileContent  = "file_content"
+	MsgTypeFileChunk    = "file_content_chunk"
 	MsgTypeFileOpResult = "file_op_result"
 	MsgTypeFileError    = "file_error"
 
@@ -28,27 +60,65 @@ const (
 	MsgTypePtyResize   = "pty_resize"
 	MsgTypeClosePty    = "close_pty"
 	MsgTypeExecCmd     = "exec_cmd"
+	MsgTypeCmdStdin    = "cmd_stdin"
+	MsgTypeConfirmCmd  = "confirm_cmd"
 	MsgTypePing        = "ping"
 
+	// Session management (Server → Agent)
+	MsgTypeListSessions = "list_sessions"
+	MsgTypePruneSession = "prune_session"
+	MsgTypeGetEnv       = "get_env"
+	MsgTypeReconnect    = "reconnect"     // Close the connection and reconnect immediately
+	MsgTypeCapabilities = "capabilities"  // List supported message types and features
+	MsgTypeVersionCheck = "version_check" // Announce the latest agent version, optionally installing it
+	MsgTypeWhoAmI       = "whoami"        // Report the user and groups the agent runs as
+	MsgTypeRestart      = "restart"       // Drain and re-execute the agent binary
+
+	// Processes and services (Server → Agent)
+	MsgTypeListProcesses = "list_processes"
+	MsgTypeKillProcess   = "kill_process"
+	MsgTypeServiceStatus = "service_status" // systemd unit state
+
 	// File operations (Server → Agent)
-	MsgTypeListFiles      = "list_files"
-	MsgTypeDownloadFile   = "download_file"
-	MsgTypeUploadFile     = "upload_file"
-	MsgTypeCreateFile     = "create_file"
-	MsgTypeCreateFolder   = "create_folder"
-	MsgTypeDeleteItem     = "delete_item"
-	MsgTypeCopyItem       = "copy_item"
-	MsgTypeMoveItem       = "move_item"
-	MsgTypeRenameItem     = "rename_item"
-	MsgTypeStreamFileInfo = "stream_file_info"  // Get file metadata for streaming
-	MsgTypeStreamChunk    = "stream_chunk"      // Request file chunk
-	MsgTypeCompressFiles  = "compress_files"   // Compress files into archive
-	MsgTypeGetDirStats    = "get_dir_stats"    // Get directory statistics
+	MsgTypeListFiles        = "list_files"
+	MsgTypeDownloadFile     = "download_file"
+	MsgTypeUploadFile       = "upload_file"
+	MsgTypeCreateFile       = "create_file"
+	MsgTypeCreateFolder     = "create_folder"
+	MsgTypeDeleteItem       = "delete_item"
+	MsgTypeDeleteItems      = "delete_items"
+	MsgTypeCopyItem         = "copy_item"
+	MsgTypeMoveItem         = "move_item"
+	MsgTypeRenameItem       = "rename_item"
+	MsgTypeChmod            = "chmod"             // Change permission bits of a file or folder
+	MsgTypeStreamFileInfo   = "stream_file_info"  // Get file metadata for streaming
+	MsgTypeStreamChunk      = "stream_chunk"      // Request file chunk
+	MsgTypeCompressFiles    = "compress_files"    // Compress files into archive
+	MsgTypeGetDirStats      = "get_dir_stats"     // Get directory statistics
+	MsgTypeDownloadMatching = "download_matching" // Archive files matching a glob
+	MsgTypePatchFile        = "patch_file"        // Apply byte-range edits to a file
+	MsgTypeFileQuickStats   = "file_quick_stats"  // Size, line count and encoding of a file
+	MsgTypeListArchive      = "list_archive"      // List the entries of a zip or tar archive
+	MsgTypeReadFiles        = "read_files"        // Read several small files at once
+	MsgTypeDiskUsage        = "disk_usage"        // Filesystem space and user quota for a path
+	MsgTypeUploadBegin      = "upload_begin"      // Start or resume a chunked upload
+	MsgTypeUploadChunk      = "upload_chunk"      // Append data to a chunked upload
+	MsgTypeUploadCommit     = "upload_commit"     // Move a completed chunked upload into place
 
 	// Streaming responses (Agent → Server)
-	MsgTypeStreamFileInfoResponse = "stream_file_info_response"
-	MsgTypeStreamChunkResponse    = "stream_chunk_response"
-	MsgTypeDirStats               = "dir_stats"
+	MsgTypeStreamFileInfoResponse   = "stream_file_info_response"
+	MsgTypeStreamChunkResponse      = "stream_chunk_response"
+	MsgTypeStreamProgress           = "stream_progress"
+	MsgTypeStreamFileHash           = "stream_file_hash"
+	MsgTypeDirStats                 = "dir_stats"
+	MsgTypeDownloadMatchingResponse = "download_matching_response"
+	MsgTypePatchFileResult          = "patch_file_result"
+	MsgTypeFileQuickStatsResult     = "file_quick_stats_result"
+	MsgTypeArchiveListing           = "archive_listing"
+	MsgTypeDeleteItemsResult        = "delete_items_result"
+	MsgTypeReadFilesResult          = "read_files_result"
+	MsgTypeDiskUsageResult          = "disk_usage_result"
+	MsgTypeUploadAck                = "upload_ack"
 )
 
 // Message is the generic wrapper for all JSON messages
@@ -61,38 +131,113 @@ type Message struct {
 
 // RegisterData is sent when agent connects to server
 type RegisterData struct {
-	DeviceID  string `json:"deviceId"`
-	Token     string `json:"token"`
-	Hostname  string `json:"hostname"`
-	Platform  string `json:"platform"`
-	OS        string `json:"os,omitempty"`
-	Arch      string `json:"arch,omitempty"`
-	GoVersion string `json:"goVersion,omitempty"`
+	DeviceID   string `json:"deviceId"`
+	Token      string `json:"token"`
+	Hostname   string `json:"hostname"`
+	Platform   string `json:"platform"`
+	OS         string `json:"os,omitempty"`
+	Arch       string `json:"arch,omitempty"`
+	GoVersion  string `json:"goVersion,omitempty"`
+	WorkingDir string `json:"workingDir,omitempty"`
+	HomeDir    string `json:"homeDir,omitempty"`
+
+	Interfaces []NetInterface    `json:"interfaces,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"` // operator-defined tags for grouping agents
+}
+
+// NetInterface is a network interface that is up, with its non-loopback,
+// non-link-local addresses in CIDR notation
+type NetInterface struct {
+	Name      string   `json:"name"`
+	MAC       string   `json:"mac,omitempty"`
+	Addresses []string `json:"addresses"`
 }
 
 // HeartbeatData is sent periodically to keep connection alive
 type HeartbeatData struct {
-	Uptime int64 `json:"uptime"` // seconds since agent started
+	Uptime  int64  `json:"uptime"`            // seconds since agent started
+	OpenFDs int    `json:"openFds,omitempty"` // open file descriptors (Unix)
+	FDLimit uint64 `json:"fdLimit,omitempty"` // soft RLIMIT_NOFILE (Unix)
 }
 
+// AgentEventData is something the agent noticed on its own that the server
+// may want to surface as an alert
+type AgentEventData struct {
+	Category string         `json:"category"` // see EventCategory*
+	Severity string         `json:"severity"` // see EventSeverity*
+	Message  string         `json:"message"`
+	Fields   map[string]any `json:"fields,omitempty"`
+	Time     string         `json:"time"` // RFC 3339
+}
+
+// Event categories
+const (
+	EventCategoryDisk    = "disk"    // free space or quota exhausted
+	EventCategorySession = "session" // terminal sessions ending abnormally
+	EventCategorySystem  = "system"  // resource limits, clock changes
+)
+
+// Event severities
+const (
+	EventSeverityInfo     = "info"
+	EventSeverityWarning  = "warning"
+	EventSeverityCritical = "critical"
+)
+
 // PtyDataMsg is sent when terminal has output to send
 type PtyDataMsg struct {
-	SessionID string `json:"sessionId"`
-	Data      string `json:"data"` // base64 encoded
+	SessionID  string `json:"sessionId"`
+	Data       string `json:"data"`                 // base64 encoded
+	Compressed bool   `json:"compressed,omitempty"` // Data is raw deflate (RFC 1951) of the output
 }
 
 // PtyExitMsg is sent when terminal session exits
 type PtyExitMsg struct {
 	SessionID string `json:"sessionId"`
 	Code      int    `json:"code"`
+	BytesIn   uint64 `json:"bytesIn,omitempty"`  // bytes written to the terminal
+	BytesOut  uint64 `json:"bytesOut,omitempty"` // bytes read from the terminal
+	Reason    string `json:"reason,omitempty"`   // see PtyExitReason*
+	Message   string `json:"message,omitempty"`  // why spawning failed, for the UI
+}
+
+// Reasons a terminal session ended, reported in PtyExitMsg
+const (
+	PtyExitReasonExited         = "exited"           // the shell exited on its own
+	PtyExitReasonTimeout        = "timeout"          // closed by the inactivity timeout
+	PtyExitReasonClosedByServer = "closed_by_server" // pruned by the server
+	PtyExitReasonError          = "error"            // failed to spawn or the terminal failed
+	PtyExitReasonNoPty          = "no_pty"           // the host has no pseudo-terminals left
+	PtyExitReasonAgentShutdown  = "agent_shutdown"   // closed because the agent stopped
+)
+
+// PtySpawnedData acknowledges a spawn_pty request that succeeded. RunAs is
+// the user the shell runs as, which differs from the requested Username
+// only when the agent is configured to fall back to its own user.
+type PtySpawnedData struct {
+	SessionID string `json:"sessionId"`
+	Username  string `json:"username,omitempty"`
+	RunAs     string `json:"runAs"`
+	Compress  bool   `json:"compress,omitempty"` // pty_data for this session may be compressed
+}
+
+// PtyErrorMsg is sent when input for a terminal session could not be applied
+type PtyErrorMsg struct {
+	SessionID string `json:"sessionId"`
+	Message   string `json:"message"`
 }
 
 // CmdResultData is sent with command execution results
 type CmdResultData struct {
 	Token    string `json:"token"`
 	ExitCode int    `json:"exitCode"`
-	Stdout   string `json:"stdout"` // base64 encoded
-	Stderr   string `json:"stderr"` // base64 encoded
+	Stdout   string `json:"stdout"`             // encoded as given by Encoding
+	Stderr   string `json:"stderr"`             // encoded as given by Encoding
+	Encoding string `json:"encoding,omitempty"` // "base64" (default) or "utf8"
+
+	// Set instead of Stdout when the command ran with OutputToFile
+	OutputFile string `json:"outputFile,omitempty"`
+	OutputSize int64  `json:"outputSize,omitempty"`
 }
 
 // CmdErrorData is sent when command execution fails
@@ -108,14 +253,29 @@ type CmdErrorData struct {
 type RegisterAckData struct {
 	Success bool   `json:"success"`
 	Message string `json:"message,omitempty"`
+	Reason  string `json:"reason,omitempty"` // machine-readable failure reason
+
+	// Absolute directories file operations on this connection are limited
+	// to; empty allows all paths
+	AllowedPaths []string `json:"allowedPaths,omitempty"`
 }
 
+// RegisterFailDeviceIDConflict is the register_ack reason sent when another
+// agent already uses this device ID
+const RegisterFailDeviceIDConflict = "device_id_conflict"
+
 // SpawnPtyData requests the agent to create a new PTY session
 type SpawnPtyData struct {
-	SessionID string `json:"sessionId"`
-	Cols      uint16 `json:"cols"`
-	Rows      uint16 `json:"rows"`
-	Username  string `json:"username,omitempty"`
+	SessionID   string   `json:"sessionId"`
+	Cols        uint16   `json:"cols"`
+	Rows        uint16   `json:"rows"`
+	Username    string   `json:"username,omitempty"`
+	IdleTimeout int      `json:"idleTimeout,omitempty"` // seconds, 0 = default (600s)
+	ShellArgs   []string `json:"shellArgs,omitempty"`   // replaces the configured shell arguments, [] = none
+
+	// Compress pty_data payloads. Honoured only if the agent reports the
+	// ptyCompression feature; pty_spawned tells whether it is in effect.
+	Compress bool `json:"compress,omitempty"`
 }
 
 // PtyInputData contains input data for a PTY session
@@ -143,6 +303,275 @@ type ExecCmdData struct {
 	Command  string   `json:"command"`
 	Args     []string `json:"args,omitempty"`
 	Timeout  int      `json:"timeout,omitempty"` // timeout in seconds, 0 = default (30s)
+
+	// Extra environment variables, added to the inherited environment or,
+	// with --clean-command-env, to the minimal one
+	Env map[string]string `json:"env,omitempty"`
+
+	// Absolute path to write stdout to instead of returning it; created or
+	// truncated. The server can fetch the file with the streaming messages.
+	OutputToFile string `json:"outputToFile,omitempty"`
+
+	// Preferred output encoding: "base64" (default) or "utf8". Output that is
+	// not valid UTF-8 is still sent as base64; CmdResultData.Encoding tells.
+	Encoding string `json:"encoding,omitempty"`
+
+	// Keep stdin open for cmd_stdin frames instead of leaving it empty
+	StreamStdin bool `json:"streamStdin,omitempty"`
+}
+
+// CmdStdinData feeds stdin of a command started with StreamStdin. Frames
+// are written in order; EOF closes stdin after Data is written and Abort
+// kills the command, which then fails with "command cancelled".
+type CmdStdinData struct {
+	Token string `json:"token"`
+	Data  string `json:"data,omitempty"` // base64 encoded
+	EOF   bool   `json:"eof,omitempty"`
+	Abort bool   `json:"abort,omitempty"`
+}
+
+// CmdConfirmRequiredData is sent instead of running an exec_cmd that
+// matches a dangerous pattern. The command runs if confirm_cmd echoes the
+// nonce within ExpiresIn seconds, otherwise it fails with cmd_error.
+type CmdConfirmRequiredData struct {
+	Token     string `json:"token"`
+	Nonce     string `json:"nonce"`
+	Pattern   string `json:"pattern"`
+	ExpiresIn int    `json:"expiresIn"` // seconds
+}
+
+// ConfirmCmdData confirms a command held back with cmd_confirm_required
+type ConfirmCmdData struct {
+	Token string `json:"token"`
+	Nonce string `json:"nonce"`
+}
+
+// Output encodings for command results
+const (
+	CmdEncodingBase64 = "base64"
+	CmdEncodingUTF8   = "utf8"
+)
+
+// --- Session Management Messages ---
+
+// ListSessionsData requests the list of active PTY sessions
+type ListSessionsData struct {
+	RequestID string `json:"requestId"`
+}
+
+// SessionInfo describes an active PTY session
+type SessionInfo struct {
+	SessionID    string `json:"sessionId"`
+	Username     string `json:"username,omitempty"`
+	RunAs        string `json:"runAs,omitempty"` // user the shell actually runs as
+	Cols         uint16 `json:"cols"`
+	Rows         uint16 `json:"rows"`
+	CreatedAt    string `json:"createdAt"`
+	LastActivity string `json:"lastActivity"`
+	BytesIn      uint64 `json:"bytesIn"`  // bytes written to the terminal
+	BytesOut     uint64 `json:"bytesOut"` // bytes read from the terminal
+}
+
+// SessionListData is the response to list_sessions
+type SessionListData struct {
+	RequestID string        `json:"requestId"`
+	Sessions  []SessionInfo `json:"sessions"`
+}
+
+// PruneSessionData requests closing an orphaned PTY session
+type PruneSessionData struct {
+	RequestID string `json:"requestId"`
+	SessionID string `json:"sessionId"`
+}
+
+// PruneSessionResultData is the response to prune_session
+type PruneSessionResultData struct {
+	RequestID string `json:"requestId"`
+	SessionID string `json:"sessionId"`
+	Success   bool   `json:"success"`
+	Message   string `json:"message,omitempty"`
+}
+
+// ReconnectData asks the agent to drop the connection and re-register
+type ReconnectData struct {
+	RequestID string `json:"requestId,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// ReconnectAckData is sent before the agent closes the connection
+type ReconnectAckData struct {
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// RestartData asks the agent to drain and restart its process
+type RestartData struct {
+	RequestID string `json:"requestId,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// RestartAckData is sent before the agent starts draining. Accepted is
+// false, with Error set, if remote restarts are not allowed.
+type RestartAckData struct {
+	RequestID string `json:"requestId,omitempty"`
+	Accepted  bool   `json:"accepted"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ListProcessesData requests the processes running on the host. Limit
+// caps the number returned (default and maximum maxProcessList).
+type ListProcessesData struct {
+	RequestID string `json:"requestId,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+}
+
+// ProcessInfo describes one process. Fields the platform cannot provide
+// are left empty: Windows reports no user, CPU or RSS.
+type ProcessInfo struct {
+	PID     int     `json:"pid"`
+	PPID    int     `json:"ppid"`
+	User    string  `json:"user,omitempty"`
+	Command string  `json:"command"`
+	CPU     float64 `json:"cpu"` // percent of one CPU, averaged over the process lifetime
+	RSS     uint64  `json:"rss"` // bytes
+}
+
+// ProcessListData is the response to list_processes, busiest first
+type ProcessListData struct {
+	RequestID string        `json:"requestId,omitempty"`
+	Processes []ProcessInfo `json:"processes"`
+	Total     int           `json:"total"`               // processes found before applying the limit
+	Truncated bool          `json:"truncated,omitempty"` // some processes were left out
+	Error     string        `json:"error,omitempty"`
+}
+
+// KillProcessData asks the agent to signal a process. Signal is a name
+// such as "TERM" or "SIGKILL" (default TERM); Windows only supports
+// terminating the process.
+type KillProcessData struct {
+	RequestID string `json:"requestId,omitempty"`
+	PID       int    `json:"pid"`
+	Signal    string `json:"signal,omitempty"`
+}
+
+// KillProcessResultData is the response to kill_process
+type KillProcessResultData struct {
+	RequestID string `json:"requestId,omitempty"`
+	PID       int    `json:"pid"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ServiceStatusData requests the state of a systemd unit. A name without
+// a suffix refers to a .service unit.
+type ServiceStatusData struct {
+	RequestID   string `json:"requestId,omitempty"`
+	ServiceName string `json:"serviceName"`
+}
+
+// ServiceStatusResultData is the response to service_status. Unsupported
+// is set on hosts without systemd.
+type ServiceStatusResultData struct {
+	RequestID   string `json:"requestId,omitempty"`
+	ServiceName string `json:"serviceName"`
+	LoadState   string `json:"loadState,omitempty"`   // loaded, not-found, masked...
+	ActiveState string `json:"activeState,omitempty"` // active, inactive, failed...
+	SubState    string `json:"subState,omitempty"`    // running, exited, dead...
+	MainPID     int    `json:"mainPid,omitempty"`
+	Description string `json:"description,omitempty"`
+	Unsupported bool   `json:"unsupported,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// CapabilitiesData requests the message types and features the agent supports
+type CapabilitiesData struct {
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// VersionCheckData announces the latest available agent version. If Install
+// is set and the agent allows self-update, the binary at DownloadURL is
+// installed once its SHA-256 matches Sha256 and the agent restarts.
+type VersionCheckData struct {
+	RequestID     string `json:"requestId,omitempty"`
+	LatestVersion string `json:"latestVersion"`
+	Install       bool   `json:"install,omitempty"`
+	DownloadURL   string `json:"downloadUrl,omitempty"`
+	Sha256        string `json:"sha256,omitempty"`
+}
+
+// VersionStatusData is the response to version_check. It is sent again
+// with Error set if an update that was started fails.
+type VersionStatusData struct {
+	RequestID       string `json:"requestId,omitempty"`
+	CurrentVersion  string `json:"currentVersion"`
+	LatestVersion   string `json:"latestVersion"`
+	UpdateAvailable bool   `json:"updateAvailable"`
+	Updating        bool   `json:"updating,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// Feature flags reported in CapabilitiesResultData
+const (
+	FeatureTerminal = "terminal"
+	FeatureExec     = "exec"
+	FeatureFileOps  = "fileOps"
+	FeatureCompress = "compress"
+	FeatureReadOnly = "readOnly"
+
+	FeaturePtyCompression = "ptyCompression"
+)
+
+// CapabilitiesResultData is the response to capabilities. MessageTypes
+// lists every request type the agent handles; Disabled those it currently
+// refuses because of local settings.
+type CapabilitiesResultData struct {
+	RequestID       string          `json:"requestId,omitempty"`
+	ProtocolVersion int             `json:"protocolVersion"`
+	AgentVersion    string          `json:"agentVersion"`
+	MessageTypes    []string        `json:"messageTypes"`
+	Disabled        []string        `json:"disabled,omitempty"`
+	Features        map[string]bool `json:"features"`
+}
+
+// --- Environment Query Messages ---
+
+// GetEnvData requests the values of specific environment variables
+type GetEnvData struct {
+	RequestID string   `json:"requestId"`
+	Names     []string `json:"names"`
+}
+
+// EnvVar is a single environment variable in an env_values response
+type EnvVar struct {
+	Name   string `json:"name"`
+	Value  string `json:"value,omitempty"`
+	Set    bool   `json:"set"`
+	Denied bool   `json:"denied,omitempty"` // not in the agent's allowlist
+}
+
+// EnvValuesData is the response to get_env
+type EnvValuesData struct {
+	RequestID string   `json:"requestId"`
+	Vars      []EnvVar `json:"vars"`
+}
+
+// WhoAmIData requests the identity the agent process runs as
+type WhoAmIData struct {
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// WhoAmIResultData describes the agent's user. UID and GID are the real
+// IDs; the effective ones are only included when they differ (setuid).
+type WhoAmIResultData struct {
+	RequestID    string   `json:"requestId,omitempty"`
+	Username     string   `json:"username"`
+	UID          string   `json:"uid"`
+	GID          string   `json:"gid"`
+	EffectiveUID *int     `json:"effectiveUid,omitempty"`
+	EffectiveGID *int     `json:"effectiveGid,omitempty"`
+	Groups       []string `json:"groups"` // supplementary group names, IDs where unnamed
+	HomeDir      string   `json:"homeDir,omitempty"`
+	Shell        string   `json:"shell,omitempty"`
+	Error        string   `json:"error,omitempty"`
 }
 
 // --- Helper functions ---
@@ -187,23 +616,75 @@ func ParseMessage(data []byte) (*Message, error) {
 func UnmarshalData[T any](msg *Message) (*T, error) {
 	var data T
 	if err := json.Unmarshal(msg.Data, &data); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrBadPayload, err)
 	}
 	return &data, nil
 }
 
+// Correlation holds the identifiers used to match responses to requests
+type Correlation struct {
+	RequestID string
+	Token     string
+	SessionID string
+}
+
+// ParseCorrelation leniently extracts the correlation fields from message
+// data, ignoring every other field, so that a request whose body fails to
+// unmarshal can still be answered with the right id
+func ParseCorrelation(msg *Message) Correlation {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(msg.Data, &fields); err != nil {
+		return Correlation{}
+	}
+
+	str := func(key string) string {
+		var v string
+		json.Unmarshal(fields[key], &v)
+		return v
+	}
+
+	return Correlation{
+		RequestID: str("requestId"),
+		Token:     str("token"),
+		SessionID: str("sessionId"),
+	}
+}
+
 // --- File Operation Request Messages (Server → Agent) ---
 
 // ListFilesData requests a directory listing
 type ListFilesData struct {
-	RequestID string `json:"requestId"`
-	Path      string `json:"path"`
+	RequestID     string `json:"requestId"`
+	Path          string `json:"path"`
+	IncludeXattrs bool   `json:"includeXattrs,omitempty"` // Linux only
+
+	// Report FileItem.Access for each entry and FileListData.Access for the
+	// directory, as AccessUser (default: the agent's user; Unix only)
+	IncludeAccess bool   `json:"includeAccess,omitempty"`
+	AccessUser    string `json:"accessUser,omitempty"`
+
+	// Order of the entries: SortBy* (default name, ascending). Ties are
+	// broken by name, so the order is stable across requests.
+	SortBy    string `json:"sortBy,omitempty"`
+	SortDesc  bool   `json:"sortDesc,omitempty"`
+	DirsFirst bool   `json:"dirsFirst,omitempty"` // directories before everything else, whatever the direction
 }
 
+// ListFiles sort keys
+const (
+	SortByName    = "name"
+	SortBySize    = "size"
+	SortByModTime = "modtime"
+	SortByType    = "type" // directories, links, files, then by extension
+)
+
 // DownloadFileData requests file contents
 type DownloadFileData struct {
 	RequestID string `json:"requestId"`
 	Path      string `json:"path"`
+	Chunked   bool   `json:"chunked,omitempty"`   // send as file_content_chunk frames
+	ChunkSize int    `json:"chunkSize,omitempty"` // raw bytes per chunk, 0 = default (32KB)
+	Hash      bool   `json:"hash,omitempty"`      // include the SHA-256 of the content
 }
 
 // UploadFileData uploads a file
@@ -211,15 +692,55 @@ type UploadFileData struct {
 	RequestID string `json:"requestId"`
 	Path      string `json:"path"`
 	FileName  string `json:"fileName"`
+	Content   string `json:"content"`           // base64 encoded
+	AsUser    string `json:"asUser,omitempty"`  // chown to this user (agent must run as root)
+	WriteAt   bool   `json:"writeAt,omitempty"` // overwrite the region at Offset of an existing file
+	Offset    int64  `json:"offset,omitempty"`  // byte offset for WriteAt, at most the current size
+}
+
+// UploadBeginData starts a chunked upload of Size bytes to Path/FileName.
+// Its RequestID identifies the upload in the chunks and commit that follow.
+// Repeating it for an upload in progress, e.g. after a reconnect, resumes
+// the upload: the upload_ack carries the offset to continue from.
+type UploadBeginData struct {
+	RequestID string `json:"requestId"`
+	Path      string `json:"path"`
+	FileName  string `json:"fileName"`
+	Size      int64  `json:"size"`
+	AsUser    string `json:"asUser,omitempty"` // chown to this user (agent must run as root)
+}
+
+// UploadChunkData appends data to a chunked upload. Offset must not be past
+// the bytes received so far.
+type UploadChunkData struct {
+	RequestID string `json:"requestId"` // RequestID of the upload_begin
+	Offset    int64  `json:"offset"`
 	Content   string `json:"content"` // base64 encoded
 }
 
+// UploadCommitData moves a chunked upload into place once all Size bytes
+// have arrived, replacing any existing file
+type UploadCommitData struct {
+	RequestID string `json:"requestId"` // RequestID of the upload_begin
+}
+
+// UploadAckData acknowledges an upload_begin or upload_chunk with the bytes
+// received so far
+type UploadAckData struct {
+	RequestID string `json:"requestId"`
+	Offset    int64  `json:"offset"`
+	Resumed   bool   `json:"resumed,omitempty"` // upload_begin continued an upload in progress
+	Error     string `json:"error,omitempty"`   // chunk out of order; resend from Offset
+}
+
 // CreateFileData creates an empty file
 type CreateFileData struct {
 	RequestID string `json:"requestId"`
 	Path      string `json:"path"`
 	FileName  string `json:"fileName"`
-	Content   string `json:"content,omitempty"` // base64 encoded, optional
+	Content   string `json:"content,omitempty"`   // base64 encoded, optional
+	AsUser    string `json:"asUser,omitempty"`    // chown to this user (agent must run as root)
+	Overwrite bool   `json:"overwrite,omitempty"` // replace an existing file instead of failing with 409
 }
 
 // CreateFolderData creates a new folder
@@ -227,6 +748,8 @@ type CreateFolderData struct {
 	RequestID  string `json:"requestId"`
 	Path       string `json:"path"`
 	FolderName string `json:"folderName"`
+	AsUser     string `json:"asUser,omitempty"`    // chown to this user (agent must run as root)
+	Overwrite  bool   `json:"overwrite,omitempty"` // succeed if the folder already exists instead of failing with 409
 }
 
 // DeleteItemData deletes a file or folder
@@ -234,6 +757,22 @@ type DeleteItemData struct {
 	RequestID   string `json:"requestId"`
 	Path        string `json:"path"`
 	IsDirectory bool   `json:"isDirectory"`
+	DryRun      bool   `json:"dryRun,omitempty"` // only report what would happen
+}
+
+// DeleteTarget is one path of a delete_items request. Directories are only
+// removed with their contents if Recursive is set.
+type DeleteTarget struct {
+	Path        string `json:"path"`
+	IsDirectory bool   `json:"isDirectory"`
+	Recursive   bool   `json:"recursive,omitempty"`
+}
+
+// DeleteItemsData deletes several files or folders in one request. Each
+// path succeeds or fails on its own.
+type DeleteItemsData struct {
+	RequestID string         `json:"requestId"`
+	Paths     []DeleteTarget `json:"paths"`
 }
 
 // CopyItemData copies a file or folder
@@ -241,6 +780,9 @@ type CopyItemData struct {
 	RequestID  string `json:"requestId"`
 	SourcePath string `json:"sourcePath"`
 	TargetDir  string `json:"targetDir"`
+	Verify     bool   `json:"verify,omitempty"` // re-read the copy and compare it with the source
+	Sparse     bool   `json:"sparse,omitempty"` // keep holes in sparse files instead of writing zeros
+	DryRun     bool   `json:"dryRun,omitempty"` // only report what would happen
 }
 
 // MoveItemData moves a file or folder
@@ -248,6 +790,7 @@ type MoveItemData struct {
 	RequestID  string `json:"requestId"`
 	SourcePath string `json:"sourcePath"`
 	TargetPath string `json:"targetPath"`
+	DryRun     bool   `json:"dryRun,omitempty"` // only report what would happen
 }
 
 // RenameItemData renames a file or folder
@@ -255,6 +798,15 @@ type RenameItemData struct {
 	RequestID string `json:"requestId"`
 	Path      string `json:"path"`
 	NewName   string `json:"newName"`
+	DryRun    bool   `json:"dryRun,omitempty"` // only report what would happen
+}
+
+// ChmodData changes the permission bits of a file or folder. On Windows only
+// the owner write bit has an effect, toggling the read-only attribute.
+type ChmodData struct {
+	RequestID string `json:"requestId"`
+	Path      string `json:"path"`
+	Mode      string `json:"mode"` // octal permission bits, e.g. "0755"
 }
 
 // CompressFilesData compresses files into an archive
@@ -263,6 +815,9 @@ type CompressFilesData struct {
 	Paths       []string `json:"paths"`       // Files/folders to compress
 	ArchiveName string   `json:"archiveName"` // Output archive name
 	Format      string   `json:"format"`      // zip, tar.gz, tar.bz2, tar.xz, tar, 7z
+
+	// Leave an existing archive alone if it is newer than every source
+	SkipIfUpToDate bool `json:"skipIfUpToDate,omitempty"`
 }
 
 // GetDirStatsData requests directory statistics
@@ -281,13 +836,122 @@ type DirStatsData struct {
 	Error       string `json:"error,omitempty"`
 }
 
+// DiskUsageData requests the space on the filesystem holding Path
+type DiskUsageData struct {
+	RequestID string `json:"requestId"`
+	Path      string `json:"path"`
+}
+
+// DiskQuota is the agent user's quota on a filesystem. Limits of 0 mean
+// no limit.
+type DiskQuota struct {
+	Used       uint64 `json:"used"` // bytes
+	Soft       uint64 `json:"soft"`
+	Hard       uint64 `json:"hard"`
+	InodesUsed uint64 `json:"inodesUsed"`
+	InodesSoft uint64 `json:"inodesSoft"`
+	InodesHard uint64 `json:"inodesHard"`
+}
+
+// DiskUsageResultData is the response to disk_usage. Quota is omitted
+// where quotas are not enabled, not readable, or not supported.
+type DiskUsageResultData struct {
+	RequestID string     `json:"requestId"`
+	Path      string     `json:"path"`
+	Total     uint64     `json:"total"`
+	Free      uint64     `json:"free"`
+	Available uint64     `json:"available"` // free bytes usable without privileges
+	Quota     *DiskQuota `json:"quota,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// DownloadMatchingData requests an archive of all files under RootPath
+// whose name (or relative path, if Glob contains "/") matches Glob
+type DownloadMatchingData struct {
+	RequestID     string `json:"requestId"`
+	RootPath      string `json:"rootPath"`
+	Glob          string `json:"glob"`
+	ArchiveFormat string `json:"archiveFormat"` // zip, tar.gz, tar (default zip)
+}
+
+// DownloadMatchingResponseData describes the archive built for
+// download_matching; its contents are fetched with stream_chunk
+type DownloadMatchingResponseData struct {
+	RequestID   string `json:"requestId"`
+	ArchivePath string `json:"archivePath,omitempty"`
+	FileName    string `json:"fileName,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"`
+	Size        int64  `json:"size"`
+	FileCount   int    `json:"fileCount"`
+	Error       string `json:"error,omitempty"`
+}
+
+// FileEdit replaces Length bytes at Offset (in the original file) with
+// Replacement. Length 0 inserts, an empty Replacement deletes.
+type FileEdit struct {
+	Offset      int64  `json:"offset"`
+	Length      int64  `json:"length"`
+	Replacement string `json:"replacement,omitempty"` // base64 encoded
+}
+
+// PatchFileData applies edits to a file, provided it still matches
+// BaseSha256. Edits must be sorted by offset and must not overlap.
+type PatchFileData struct {
+	RequestID  string     `json:"requestId"`
+	Path       string     `json:"path"`
+	BaseSha256 string     `json:"baseSha256"`
+	Edits      []FileEdit `json:"edits"`
+}
+
+// PatchFileResultData is the response to patch_file
+type PatchFileResultData struct {
+	RequestID string `json:"requestId"`
+	Path      string `json:"path"`
+	Sha256    string `json:"sha256"`
+	Size      int64  `json:"size"`
+}
+
+// FileQuickStatsData requests a summary of a file before it is opened
+type FileQuickStatsData struct {
+	RequestID string `json:"requestId"`
+	Path      string `json:"path"`
+}
+
+// FileQuickStatsResultData is the response to file_quick_stats. LineCount
+// is the number of '\n' characters; line information is omitted for
+// binary files.
+type FileQuickStatsResultData struct {
+	RequestID       string `json:"requestId"`
+	Path            string `json:"path"`
+	Size            int64  `json:"size"`
+	LineCount       int64  `json:"lineCount"`
+	EndsWithNewline bool   `json:"endsWithNewline"`
+	Encoding        string `json:"encoding"`             // utf-8, latin-1, binary
+	LineEnding      string `json:"lineEnding,omitempty"` // lf, crlf, mixed
+}
+
+// ListArchiveData requests the entries of an archive without extracting it
+type ListArchiveData struct {
+	RequestID   string `json:"requestId"`
+	ArchivePath string `json:"archivePath"`
+}
+
+// ReadFilesData reads several small files in one request. Each file is cut
+// off after MaxBytesEach bytes (0 = 64KB, at most 1MB) and reading stops
+// once 4MB have been returned in total.
+type ReadFilesData struct {
+	RequestID    string   `json:"requestId"`
+	Paths        []string `json:"paths"`
+	MaxBytesEach int64    `json:"maxBytesEach,omitempty"`
+}
+
 // --- File Operation Response Messages (Agent → Server) ---
 
 // FileItem represents a file or directory entry
 type FileItem struct {
 	Name        string `json:"name"`
 	Path        string `json:"path"`
-	Type        string `json:"type"`         // "file", "directory", "link"
+	Type        string `json:"type"` // "file", "directory", "link"
 	Size        int64  `json:"size"`
 	ModTime     string `json:"modTime"`
 	Permissions string `json:"permissions"`
@@ -295,13 +959,60 @@ type FileItem struct {
 	Group       string `json:"group,omitempty"`
 	Executable  bool   `json:"executable,omitempty"`
 	LinkTarget  string `json:"linkTarget,omitempty"`
+
+	// Set when the name is not valid UTF-8. Name then carries the invalid
+	// bytes escaped as \xNN for display, and NameBytes the raw name.
+	NameInvalid bool   `json:"nameInvalid,omitempty"`
+	NameBytes   []byte `json:"nameBytes,omitempty"` // base64 encoded
+
+	// Set when the path is not valid UTF-8, which JSON replaces with U+FFFD
+	// in Path. Holds the exact bytes, base64 encoded.
+	RawPath []byte `json:"rawPath,omitempty"`
+
+	// Only with ListFilesData.IncludeAccess
+	Access *FileAccess `json:"access,omitempty"`
+
+	// Only with ListFilesData.IncludeXattrs
+	Xattrs          map[string]string `json:"xattrs,omitempty"` // values base64 encoded
+	SecurityContext string            `json:"securityContext,omitempty"`
+}
+
+// FileAccess tells whether a user may read, write and execute (search, for
+// directories) a path
+type FileAccess struct {
+	Read    bool `json:"read"`
+	Write   bool `json:"write"`
+	Execute bool `json:"execute"`
 }
 
 // FileListData is the response to list_files
 type FileListData struct {
-	RequestID string     `json:"requestId"`
-	Path      string     `json:"path"`
-	Files     []FileItem `json:"files"`
+	RequestID string      `json:"requestId"`
+	Path      string      `json:"path"`
+	Files     []FileItem  `json:"files"`
+	Access    *FileAccess `json:"access,omitempty"` // of the directory, with IncludeAccess
+}
+
+// ArchiveEntry describes one member of an archive
+type ArchiveEntry struct {
+	Name        string `json:"name"` // path inside the archive
+	Type        string `json:"type"` // "file", "directory", "link"
+	Size        int64  `json:"size"`
+	ModTime     string `json:"modTime"`
+	Permissions string `json:"permissions"`
+	LinkTarget  string `json:"linkTarget,omitempty"`
+}
+
+// ArchiveListingData is one frame of a list_archive response. Frames carry
+// increasing sequence numbers; the last one has Final set and Truncated if
+// the archive had more entries than the agent returns.
+type ArchiveListingData struct {
+	RequestID   string         `json:"requestId"`
+	ArchivePath string         `json:"archivePath"`
+	Seq         int            `json:"seq"`
+	Entries     []ArchiveEntry `json:"entries"`
+	Final       bool           `json:"final,omitempty"`
+	Truncated   bool           `json:"truncated,omitempty"`
 }
 
 // FileContentData is the response to download_file
@@ -309,9 +1020,26 @@ type FileContentData struct {
 	RequestID string `json:"requestId"`
 	Path      string `json:"path"`
 	FileName  string `json:"fileName"`
-	Content   string `json:"content"`  // base64 encoded
+	Content   string `json:"content"` // base64 encoded
+	MimeType  string `json:"mimeType"`
+	Size      int64  `json:"size"`
+	Sha256    string `json:"sha256,omitempty"` // hex, when requested with Hash
+}
+
+// FileContentChunkData is one frame of a chunked download_file response.
+// Frames carry increasing sequence numbers; the last frame has Final set
+// and no data, so the receiver can detect gaps before reassembling.
+type FileContentChunkData struct {
+	RequestID string `json:"requestId"`
+	Path      string `json:"path"`
+	FileName  string `json:"fileName"`
 	MimeType  string `json:"mimeType"`
 	Size      int64  `json:"size"`
+	Seq       int    `json:"seq"`
+	Offset    int64  `json:"offset"`
+	Data      string `json:"data,omitempty"` // base64 encoded chunk
+	Final     bool   `json:"final,omitempty"`
+	Sha256    string `json:"sha256,omitempty"` // on the final frame, when requested with Hash
 }
 
 // FileOpResultData is the response to file modification operations
@@ -320,6 +1048,44 @@ type FileOpResultData struct {
 	Success    bool   `json:"success"`
 	Message    string `json:"message,omitempty"`
 	UniqueName string `json:"uniqueName,omitempty"` // for copy with name conflict
+	ResultPath string `json:"resultPath,omitempty"` // final location after move/rename
+	Skipped    bool   `json:"skipped,omitempty"`    // nothing to do, e.g. archive already up to date
+
+	// Set on dry runs, which describe the operation without performing it
+	DryRun         bool `json:"dryRun,omitempty"`
+	WouldOverwrite bool `json:"wouldOverwrite,omitempty"` // the target exists and would be replaced
+}
+
+// DeleteItemResult is the outcome for one path of a delete_items request
+type DeleteItemResult struct {
+	Path    string `json:"path"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// DeleteItemsResultData is the response to delete_items, with Results in
+// request order
+type DeleteItemsResultData struct {
+	RequestID string             `json:"requestId"`
+	Results   []DeleteItemResult `json:"results"`
+	Deleted   int                `json:"deleted"`
+	Failed    int                `json:"failed"`
+}
+
+// ReadFileResult is the content of one read_files path, or why it could
+// not be read
+type ReadFileResult struct {
+	Path      string `json:"path"`
+	Content   string `json:"content,omitempty"` // base64 encoded
+	Error     string `json:"error,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// ReadFilesResultData is the response to read_files, with Files in request
+// order
+type ReadFilesResultData struct {
+	RequestID string           `json:"requestId"`
+	Files     []ReadFileResult `json:"files"`
 }
 
 // FileErrorData is sent when a file operation fails
@@ -331,10 +1097,14 @@ type FileErrorData struct {
 
 // --- Streaming File Operation Messages ---
 
-// StreamFileInfoData requests file metadata for streaming
+// StreamFileInfoData requests file metadata for streaming. With Progress set,
+// the agent reports stream_progress for chunks that carry this RequestID
+// as their TransferID.
 type StreamFileInfoData struct {
 	RequestID string `json:"requestId"`
 	Path      string `json:"path"`
+	Progress  bool   `json:"progress,omitempty"`
+	Hash      bool   `json:"hash,omitempty"` // hash chunks as served, see StreamFileHashData
 }
 
 // StreamFileInfoResponseData returns file metadata
@@ -344,15 +1114,24 @@ type StreamFileInfoResponseData struct {
 	FileName  string `json:"fileName"`
 	MimeType  string `json:"mimeType"`
 	Size      int64  `json:"size"`
+	Version   string `json:"version,omitempty"` // pass to stream_chunk to detect changes
+	Sha256    string `json:"sha256,omitempty"`  // known up front only for empty files
 	Error     string `json:"error,omitempty"`
 }
 
-// StreamChunkData requests a chunk of a file
+// StreamChunkData requests a chunk of a file. Chunks of one file may be
+// requested concurrently, up to a per-file limit beyond which the response
+// has Busy set. Lengths above 8MB are clamped.
 type StreamChunkData struct {
-	RequestID string `json:"requestId"`
-	Path      string `json:"path"`
-	Offset    int64  `json:"offset"`
-	Length    int64  `json:"length"`
+	RequestID  string `json:"requestId"`
+	Path       string `json:"path"`
+	Offset     int64  `json:"offset"`
+	Length     int64  `json:"length"`
+	TransferID string `json:"transferId,omitempty"` // RequestID of the stream_file_info
+
+	// Version from stream_file_info. If set, the chunk fails with Changed
+	// when the file no longer has that version.
+	Version string `json:"version,omitempty"`
 }
 
 // StreamChunkResponseData returns a chunk of file data
@@ -362,4 +1141,28 @@ type StreamChunkResponseData struct {
 	Length    int64  `json:"length"`
 	Data      string `json:"data"` // base64 encoded chunk
 	Error     string `json:"error,omitempty"`
+	Busy      bool   `json:"busy,omitempty"`    // per-file concurrency limit reached, retry later
+	Changed   bool   `json:"changed,omitempty"` // file modified since stream_file_info, restart the transfer
+}
+
+// StreamProgressData reports bytes served so far for a streamed transfer
+// that opted in to progress
+type StreamProgressData struct {
+	RequestID   string `json:"requestId"` // RequestID of the stream_file_info
+	Path        string `json:"path"`
+	BytesServed int64  `json:"bytesServed"`
+	TotalBytes  int64  `json:"totalBytes"`
+	Done        bool   `json:"done,omitempty"`
+}
+
+// StreamFileHashData is the SHA-256 of a streamed transfer that opted in to
+// hashing. It is sent once chunks carrying its TransferID have covered the
+// whole file, or with Error set when the hash cannot be completed.
+type StreamFileHashData struct {
+	RequestID string `json:"requestId"` // RequestID of the stream_file_info
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Sha256    string `json:"sha256,omitempty"` // hex
+	Error     string `json:"error,omitempty"`
+	Changed   bool   `json:"changed,omitempty"` // file modified mid-stream, restart the transfer
 }
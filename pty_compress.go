@@ -0,0 +1,47 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"sync"
+)
+
+// Terminal output smaller than this is sent as is; the deflate framing
+// would cost more than it saves
+const ptyCompressMinSize = 128
+
+var ptyFlateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// compressPtyData deflates (RFC 1951, no zlib or gzip header) one chunk of
+// terminal output. Each chunk is compressed on its own so the server can
+// decode any pty_data frame without earlier ones. ok is false if
+// compressing would not make data smaller.
+func compressPtyData(data []byte) (compressed []byte, ok bool) {
+	if len(data) < ptyCompressMinSize {
+		return nil, false
+	}
+
+	var buf bytes.Buffer
+	w := ptyFlateWriters.Get().(*flate.Writer)
+	defer ptyFlateWriters.Put(w)
+
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, false
+	}
+	if err := w.Close(); err != nil {
+		return nil, false
+	}
+
+	if buf.Len() >= len(data) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
@@ -0,0 +1,46 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"testing"
+)
+
+// BenchmarkCompressPtyData measures the CPU spent deflating pty_data
+// frames against the share of bytes saved, reported as saved-%
+func BenchmarkCompressPtyData(b *testing.B) {
+	// A coloured directory listing and a redrawn full-screen status line
+	var listing bytes.Buffer
+	for i := range 200 {
+		fmt.Fprintf(&listing, "\x1b[0m\x1b[01;34mdir%03d\x1b[0m  \x1b[01;32mrun.sh\x1b[0m  notes-%03d.txt    \r\n", i, i)
+	}
+	redraw := bytes.Repeat([]byte("\x1b[H\x1b[2K\x1b[7m CPU  12.5%  MEM  41.0%  LOAD 0.42 0.38 0.35 \x1b[0m\x1b[K\r\n"), 64)
+	random := make([]byte, 4096)
+	rand.Read(random)
+
+	for _, bc := range []struct {
+		name string
+		data []byte
+	}{
+		{"listing", listing.Bytes()[:min(listing.Len(), sessionReadBufSize)]},
+		{"redraw", redraw},
+		{"echo", []byte("l")},
+		{"binary", random},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(bc.data)))
+			b.ReportAllocs()
+			var out int
+			for b.Loop() {
+				out = len(bc.data)
+				if compressed, ok := compressPtyData(bc.data); ok {
+					out = len(compressed)
+				}
+			}
+			b.ReportMetric(100*(1-float64(out)/float64(len(bc.data))), "saved-%")
+		})
+	}
+}
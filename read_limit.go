@@ -0,0 +1,153 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// minControlMaxSize keeps Config.ControlMaxSize large enough for ordinary
+// requests
+const minControlMaxSize = 4 * 1024
+
+// dataMessageTypes may be up to Config.DataMaxSize; every other message is
+// limited to Config.ControlMaxSize
+var dataMessageTypes = map[string]bool{
+	MsgTypeUploadFile:  true,
+	MsgTypeUploadChunk: true,
+	MsgTypePatchFile:   true,
+}
+
+// readMessage reads the next message from conn. Only data message types may
+// exceed ControlMaxSize: the type is taken from the start of a larger frame,
+// and any other message is discarded without being buffered in full and
+// answered with a 413 if its request id could be read. The connection's read
+// limit bounds every frame at DataMaxSize.
+func (a *Agent) readMessage(conn *websocket.Conn) ([]byte, error) {
+	limit := a.config.ControlMaxSize
+	for {
+		_, r, err := conn.NextReader()
+		if err != nil {
+			return nil, err
+		}
+
+		head, err := io.ReadAll(io.LimitReader(r, limit+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(head)) <= limit {
+			return head, nil
+		}
+
+		msgType, corr := leadingFields(head)
+		if dataMessageTypes[msgType] {
+			rest, err := io.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			return append(head, rest...), nil
+		}
+
+		rest, err := io.Copy(io.Discard, r)
+		if err != nil {
+			return nil, err
+		}
+		size := int64(len(head)) + rest
+		log.Warn().
+			Str("type", msgType).
+			Int64("size", size).
+			Int64("limit", limit).
+			Msg("discarding oversized control message")
+
+		// Answer the request if its id came before the cut-off, so the
+		// server does not wait for a response that will never come
+		a.rejectCorrelated(msgType, corr, 413, CmdErrBadRequest,
+			fmt.Sprintf("Message too large: %d bytes exceeds the limit of %d", size, limit))
+	}
+}
+
+// leadingFields returns the "type" of a message and the correlation ids in
+// its "data" from the first bytes of the message. Fields after a value that
+// is cut off are not seen and left empty.
+func leadingFields(head []byte) (string, Correlation) {
+	var msgType string
+	var corr Correlation
+
+	dec := json.NewDecoder(bytes.NewReader(head))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return msgType, corr
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return msgType, corr
+		}
+
+		switch key {
+		case "type":
+			tok, err := dec.Token()
+			if err != nil {
+				return msgType, corr
+			}
+			msgType, _ = tok.(string)
+		case "data":
+			if !leadingCorrelation(dec, &corr) {
+				return msgType, corr
+			}
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return msgType, corr
+			}
+		}
+	}
+	return msgType, corr
+}
+
+// leadingCorrelation reads the correlation ids from the "data" value at the
+// decoder's position, reporting false if the value is cut off
+func leadingCorrelation(dec *json.Decoder, corr *Correlation) bool {
+	tok, err := dec.Token()
+	if err != nil {
+		return false
+	}
+	if tok != json.Delim('{') {
+		// Only objects carry ids; a scalar was consumed whole
+		_, isDelim := tok.(json.Delim)
+		return !isDelim
+	}
+
+	fields := map[string]*string{
+		"requestId": &corr.RequestID,
+		"token":     &corr.Token,
+		"sessionId": &corr.SessionID,
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return false
+		}
+		if field, ok := fields[key.(string)]; ok {
+			tok, err := dec.Token()
+			if err != nil {
+				return false
+			}
+			*field, _ = tok.(string)
+			continue
+		}
+
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return false
+		}
+	}
+	_, err = dec.Token() // closing brace
+	return err == nil
+}
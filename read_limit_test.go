@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import "testing"
+
+func TestLeadingFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		head     string
+		wantType string
+		wantCorr Correlation
+	}{
+		{
+			name:     "complete",
+			head:     `{"type":"list_files","data":{"requestId":"r1","path":"/tmp"}}`,
+			wantType: "list_files",
+			wantCorr: Correlation{RequestID: "r1"},
+		},
+		{
+			name:     "cut off after the id",
+			head:     `{"type":"write_file","data":{"requestId":"r2","content":"aGVsbG8gd29y`,
+			wantType: "write_file",
+			wantCorr: Correlation{RequestID: "r2"},
+		},
+		{
+			name:     "data before type",
+			head:     `{"data":{"token":"t1","cmd":"ls"},"type":"exec_cmd"}`,
+			wantType: "exec_cmd",
+			wantCorr: Correlation{Token: "t1"},
+		},
+		{
+			name:     "session id after a nested value",
+			head:     `{"type":"spawn_pty","data":{"env":{"A":"1"},"sessionId":"s1"}}`,
+			wantType: "spawn_pty",
+			wantCorr: Correlation{SessionID: "s1"},
+		},
+		{
+			name:     "cut off before the id",
+			head:     `{"type":"write_file","data":{"content":"aGVsbG8gd29y`,
+			wantType: "write_file",
+		},
+		{
+			name: "cut off in the type",
+			head: `{"type":"write_fi`,
+		},
+		{
+			name:     "null data",
+			head:     `{"type":"ping","data":null}`,
+			wantType: "ping",
+		},
+		{
+			name: "not an object",
+			head: `["type","list_files"]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgType, corr := leadingFields([]byte(tt.head))
+			if msgType != tt.wantType || corr != tt.wantCorr {
+				t.Errorf("leadingFields = %q, %+v, want %q, %+v", msgType, corr, tt.wantType, tt.wantCorr)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reexec replaces the current process with a fresh run of the executable,
+// keeping the same arguments and environment
+func reexec() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// resultCacheSize is how many completed request results are remembered
+const resultCacheSize = 256
+
+// cachedResult is the response sent for a completed request
+type cachedResult struct {
+	requestID string
+	msgType   string
+	data      interface{}
+	done      bool
+}
+
+// resultCache is a small LRU of recently handled request IDs and the
+// response sent for each, giving at-most-once semantics to retried requests
+type resultCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newResultCache(size int) *resultCache {
+	return &resultCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// begin registers a request ID. It returns the cached entry and false if the
+// request was seen before, or nil and true if the caller should execute it.
+func (c *resultCache) begin(requestID string) (*cachedResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[requestID]; ok {
+		c.order.MoveToFront(elem)
+		entry := *elem.Value.(*cachedResult)
+		return &entry, false
+	}
+
+	c.entries[requestID] = c.order.PushFront(&cachedResult{requestID: requestID})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResult).requestID)
+	}
+
+	return nil, true
+}
+
+// lookup returns the recorded response for a request, or nil if it is
+// unknown or still in progress
+func (c *resultCache) lookup(requestID string) *cachedResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[requestID]
+	if !ok || !elem.Value.(*cachedResult).done {
+		return nil
+	}
+	entry := *elem.Value.(*cachedResult)
+	return &entry
+}
+
+// complete records the response for a request registered with begin. It
+// returns false if a response was already recorded, e.g. a timeout error.
+func (c *resultCache) complete(requestID, msgType string, data interface{}) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[requestID]
+	if !ok {
+		return true
+	}
+
+	entry := elem.Value.(*cachedResult)
+	if entry.done {
+		return false
+	}
+	entry.msgType = msgType
+	entry.data = data
+	entry.done = true
+	return true
+}
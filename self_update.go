@@ -0,0 +1,245 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Upper bound on a downloaded agent binary
+	maxUpdateSize = 256 << 20 // 256MB
+
+	updateDownloadTimeout = 10 * time.Minute
+)
+
+var (
+	ErrSelfUpdateDisabled = errors.New("self-update is disabled on this agent")
+	ErrUpdateChecksum     = errors.New("update checksum mismatch")
+)
+
+// compareVersions compares two versions of the form [v]MAJOR.MINOR.PATCH,
+// ignoring any pre-release or build suffix. ok is false if either version
+// cannot be parsed, e.g. for development builds.
+func compareVersions(a, b string) (result int, ok bool) {
+	pa, okA := parseVersion(a)
+	pb, okB := parseVersion(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	for i := range pa {
+		if pa[i] != pb[i] {
+			if pa[i] < pb[i] {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, true
+}
+
+func parseVersion(v string) ([3]int, bool) {
+	var parts [3]int
+
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+
+	fields := strings.Split(v, ".")
+	if len(fields) == 0 || len(fields) > 3 {
+		return parts, false
+	}
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return parts, false
+		}
+		parts[i] = n
+	}
+	return parts, true
+}
+
+// handleVersionCheck reports whether this build is older than the latest
+// version the server knows of, and installs it if asked and allowed
+func (a *Agent) handleVersionCheck(msg *Message) error {
+	data, err := UnmarshalData[VersionCheckData](msg)
+	if err != nil {
+		return err
+	}
+
+	status := VersionStatusData{
+		RequestID:      data.RequestID,
+		CurrentVersion: version,
+		LatestVersion:  data.LatestVersion,
+	}
+
+	cmp, comparable := compareVersions(version, data.LatestVersion)
+	status.UpdateAvailable = comparable && cmp < 0
+	if !comparable {
+		log.Debug().Str("version", version).Str("latest", data.LatestVersion).Msg("cannot compare agent versions")
+	} else if status.UpdateAvailable {
+		log.Warn().Str("version", version).Str("latest", data.LatestVersion).Msg("agent update available")
+	}
+
+	if status.UpdateAvailable && data.Install {
+		switch {
+		case !a.config.AllowSelfUpdate || a.config.ReadOnly:
+			status.Error = ErrSelfUpdateDisabled.Error()
+		case data.DownloadURL == "" || data.Sha256 == "":
+			status.Error = "downloadUrl and sha256 are required to install an update"
+		default:
+			status.Updating = true
+		}
+	}
+
+	if err := a.sendMessage(MsgTypeVersionStatus, status); err != nil {
+		return err
+	}
+
+	if status.Updating {
+		// Not tracked as an operation: installing stops the agent, which
+		// waits for operations to finish
+		go a.selfUpdate(data)
+	}
+	return nil
+}
+
+// selfUpdate installs the update described by data and, on success, stops
+// the agent so that main re-executes the new binary
+func (a *Agent) selfUpdate(data *VersionCheckData) {
+	log.Info().Str("version", data.LatestVersion).Str("url", data.DownloadURL).Msg("installing agent update")
+
+	if err := a.installUpdate(data.DownloadURL, data.Sha256); err != nil {
+		log.Error().Err(err).Str("version", data.LatestVersion).Msg("agent update failed")
+		a.sendMessage(MsgTypeVersionStatus, VersionStatusData{
+			RequestID:      data.RequestID,
+			CurrentVersion: version,
+			LatestVersion:  data.LatestVersion,
+			Error:          err.Error(),
+		})
+		return
+	}
+
+	log.Info().Str("version", data.LatestVersion).Msg("agent update installed, restarting")
+	a.restart.Store(true)
+	a.Stop()
+}
+
+// installUpdate downloads the binary at rawURL over HTTPS, verifies its
+// SHA-256 and replaces the running executable with it
+func (a *Agent) installUpdate(rawURL, checksum string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid download URL: %w", err)
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("update must be downloaded over https")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+
+	// Download next to the executable so the final rename stays on one
+	// filesystem
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".termix-agent-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sum, err := a.downloadUpdate(rawURL, tmp)
+	if err != nil {
+		return err
+	}
+	if sum != normalizeFingerprint(checksum) {
+		return ErrUpdateChecksum
+	}
+
+	if err := tmp.Chmod(0755); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// A running executable cannot be replaced on Windows, but it can be
+	// renamed out of the way
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp.Name(), exe); err != nil {
+			os.Rename(old, exe)
+			return err
+		}
+		return nil
+	}
+	return os.Rename(tmp.Name(), exe)
+}
+
+// downloadUpdate writes the body of rawURL to w, returning its SHA-256 in
+// hex. Updates are often served by a release host or CDN rather than the
+// agent's server, so the server's pin and trusted fingerprint do not apply:
+// the download trusts the system roots plus any configured CA bundle, and
+// honours the proxy environment variables.
+func (a *Agent) downloadUpdate(rawURL string, w io.Writer) (string, error) {
+	tlsConfig, err := buildTLSConfig(TLSOptions{CACertPath: a.config.CACertPath})
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}}
+
+	ctx, cancel := context.WithTimeout(a.ctx, updateDownloadTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), io.LimitReader(resp.Body, maxUpdateSize+1))
+	if err != nil {
+		return "", err
+	}
+	if n > maxUpdateSize {
+		return "", fmt.Errorf("update larger than %d bytes", maxUpdateSize)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,64 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	serviceQueryTimeout = 5 * time.Second
+	maxServiceField     = 256 // bytes kept of each reported field
+)
+
+// ErrServiceUnsupported is returned on hosts without systemd
+var ErrServiceUnsupported = errors.New("service status requires systemd")
+
+// serviceNameRe matches unit names as systemd accepts them, without
+// allowing anything systemctl would parse as an option
+var serviceNameRe = regexp.MustCompile(`^[A-Za-z0-9:_.@\\][A-Za-z0-9:_.@\\-]{0,255}$`)
+
+// serviceStatus queries the state of the requested unit
+func serviceStatus(ctx context.Context, data *ServiceStatusData) ServiceStatusResultData {
+	result := ServiceStatusResultData{RequestID: data.RequestID, ServiceName: data.ServiceName}
+	if !serviceNameRe.MatchString(data.ServiceName) {
+		result.Error = fmt.Sprintf("invalid service name %q", data.ServiceName)
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, serviceQueryTimeout)
+	defer cancel()
+
+	props, err := queryService(ctx, data.ServiceName)
+	if errors.Is(err, ErrServiceUnsupported) {
+		result.Unsupported = true
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.LoadState = sanitizeField(props["LoadState"])
+	result.ActiveState = sanitizeField(props["ActiveState"])
+	result.SubState = sanitizeField(props["SubState"])
+	result.Description = sanitizeField(props["Description"])
+	fmt.Sscan(props["MainPID"], &result.MainPID)
+	return result
+}
+
+// sanitizeField makes a reported value safe to display and bounds it
+func sanitizeField(s string) string {
+	s = sanitizeCommand(s)
+	if len(s) > maxServiceField {
+		s = s[:maxServiceField]
+		for len(s) > 0 && !utf8.ValidString(s) {
+			s = s[:len(s)-1]
+		}
+	}
+	return s
+}
@@ -0,0 +1,48 @@
+//go:build linux
+// +build linux
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// serviceProperties are the unit properties read by queryService
+var serviceProperties = []string{"LoadState", "ActiveState", "SubState", "MainPID", "Description"}
+
+// queryService reads a unit's properties with systemctl show
+func queryService(ctx context.Context, name string) (map[string]string, error) {
+	// The documented test for whether systemd is the init system
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		return nil, ErrServiceUnsupported
+	}
+	systemctl, err := exec.LookPath("systemctl")
+	if err != nil {
+		return nil, ErrServiceUnsupported
+	}
+
+	args := []string{"show", "--no-pager"}
+	for _, prop := range serviceProperties {
+		args = append(args, "--property="+prop)
+	}
+	args = append(args, "--", name)
+
+	out, err := exec.CommandContext(ctx, systemctl, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("systemctl show failed: %w", err)
+	}
+
+	props := make(map[string]string, len(serviceProperties))
+	for _, line := range strings.Split(string(out), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			props[key] = value
+		}
+	}
+	return props, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+import "context"
+
+// queryService is only supported on Linux with systemd
+func queryService(ctx context.Context, name string) (map[string]string, error) {
+	return nil, ErrServiceUnsupported
+}
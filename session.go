@@ -5,8 +5,11 @@ package main
 import (
 	"encoding/base64"
 	"errors"
+	"fmt"
+	"io"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -16,46 +19,99 @@ const (
 	maxSessions        = 10
 	sessionReadBufSize = 4096
 	inactivityTimeout  = 600 * time.Second
+
+	// Consecutive interrupted pty reads tolerated before the session is
+	// treated as broken, and the pause before retrying a would-block read
+	maxTransientReadErrors = 50
+	transientReadBackoff   = 10 * time.Millisecond
+
+	// How often the shared sweeper checks sessions for inactivity
+	sessionSweepInterval = 10 * time.Second
 )
 
 var (
 	ErrMaxSessions   = errors.New("maximum sessions reached")
 	ErrSessionExists = errors.New("session already exists")
 	ErrNoSession     = errors.New("session not found")
+	ErrInputDecode   = errors.New("invalid base64 input")
+	ErrNoPty         = errors.New("no ptys available")
+
+	ErrUserNotFound     = errors.New("user not found")
+	ErrUserNotPermitted = errors.New("not permitted to run as this user")
 )
 
+// TerminalOptions controls how a terminal's shell is started
+type TerminalOptions struct {
+	Username  string
+	UsePAM    bool
+	ShellArgs []string // arguments passed to the shell
+	EnvPass   []string // agent environment variables passed on to the shell
+
+	// Run as the agent's user when Username cannot be used
+	AllowUserFallback bool
+}
+
 // SessionManager manages multiple PTY sessions
 type SessionManager struct {
+	config       *Config
 	sessions     sync.Map
 	sessionCount int32
-	sendData     func(sessionID string, data []byte)
-	sendExit     func(sessionID string, code int)
+	sendData     func(sessionID string, data []byte, compressed bool)
+	sendExit     func(exit *PtyExitMsg)
+	sendEvent    func(category, severity, message string, fields map[string]any)
+	sendSpawned  func(spawned *PtySpawnedData)
+	stopChan     chan struct{}
+	stopOnce     sync.Once
 }
 
 // NewSessionManager creates a new session manager
 func NewSessionManager(
-	sendData func(sessionID string, data []byte),
-	sendExit func(sessionID string, code int),
+	config *Config,
+	sendData func(sessionID string, data []byte, compressed bool),
+	sendExit func(exit *PtyExitMsg),
+	sendSpawned func(spawned *PtySpawnedData),
+	sendEvent func(category, severity, message string, fields map[string]any),
 ) *SessionManager {
-	return &SessionManager{
-		sendData: sendData,
-		sendExit: sendExit,
+	m := &SessionManager{
+		config:      config,
+		sendData:    sendData,
+		sendExit:    sendExit,
+		sendSpawned: sendSpawned,
+		sendEvent:   sendEvent,
+		stopChan:    make(chan struct{}),
 	}
+
+	// Single sweeper for all sessions instead of a ticker per session
+	go m.sweepLoop()
+
+	return m
 }
 
 // TermSession wraps a Terminal with session metadata
 type TermSession struct {
-	ID           string
-	terminal     *Terminal
-	manager      *SessionManager
-	lastActivity time.Time
-	mu           sync.Mutex
-	closed       bool
-	stopChan     chan struct{}
+	ID            string
+	Username      string // as requested
+	RunAs         string // user the shell actually runs as
+	terminal      *Terminal
+	manager       *SessionManager
+	createdAt     time.Time
+	cols          uint16
+	rows          uint16
+	lastActivity  time.Time
+	idleTimeout   time.Duration
+	compress      bool   // deflate output sent to the server
+	inputEncoding string // base64 variant of the last input, see WriteBase64
+	bytesIn       uint64 // bytes written to the terminal, updated atomically
+	bytesOut      uint64 // bytes read from the terminal, updated atomically
+	mu            sync.Mutex
+	closed        bool
+	stopChan      chan struct{}
 }
 
-// SpawnSession creates and starts a new PTY session
-func (m *SessionManager) SpawnSession(sessionID string, cols, rows uint16, username string) error {
+// SpawnSession creates and starts a new PTY session. A zero idleTimeout
+// uses the default inactivity timeout and nil shellArgs the configured ones.
+// compress is ignored unless Config.PtyCompression is set.
+func (m *SessionManager) SpawnSession(sessionID string, cols, rows uint16, username string, idleTimeout time.Duration, shellArgs []string, compress bool) error {
 	// Check session limit
 	if atomic.LoadInt32(&m.sessionCount) >= maxSessions {
 		return ErrMaxSessions
@@ -66,8 +122,20 @@ func (m *SessionManager) SpawnSession(sessionID string, cols, rows uint16, usern
 		return ErrSessionExists
 	}
 
+	if shellArgs == nil {
+		shellArgs = m.config.ShellArgs
+	} else if err := validateShellArgs(shellArgs); err != nil {
+		return err
+	}
+
 	// Create terminal
-	terminal, err := NewTerminal(username)
+	terminal, err := NewTerminal(TerminalOptions{
+		Username:          username,
+		UsePAM:            m.config.UsePAM,
+		ShellArgs:         shellArgs,
+		EnvPass:           m.config.PtyEnvPassthrough,
+		AllowUserFallback: m.config.AllowUserFallback,
+	})
 	if err != nil {
 		return err
 	}
@@ -78,11 +146,23 @@ func (m *SessionManager) SpawnSession(sessionID string, cols, rows uint16, usern
 		return err
 	}
 
+	if idleTimeout <= 0 {
+		idleTimeout = inactivityTimeout
+	}
+
+	now := time.Now()
 	session := &TermSession{
 		ID:           sessionID,
+		Username:     username,
+		RunAs:        terminal.RunAs,
 		terminal:     terminal,
 		manager:      m,
-		lastActivity: time.Now(),
+		createdAt:    now,
+		cols:         cols,
+		rows:         rows,
+		lastActivity: now,
+		idleTimeout:  idleTimeout,
+		compress:     compress && m.config.PtyCompression,
 		stopChan:     make(chan struct{}),
 	}
 
@@ -94,14 +174,23 @@ func (m *SessionManager) SpawnSession(sessionID string, cols, rows uint16, usern
 		Uint16("cols", cols).
 		Uint16("rows", rows).
 		Str("username", username).
+		Str("runAs", terminal.RunAs).
+		Dur("idleTimeout", idleTimeout).
+		Strs("shellArgs", shellArgs).
+		Bool("compress", session.compress).
 		Msg("session spawned")
 
+	// Acknowledge before any output can be sent
+	m.sendSpawned(&PtySpawnedData{
+		SessionID: sessionID,
+		Username:  username,
+		RunAs:     terminal.RunAs,
+		Compress:  session.compress,
+	})
+
 	// Start read loop
 	go session.readLoop()
 
-	// Start inactivity monitor
-	go session.inactivityMonitor()
-
 	return nil
 }
 
@@ -129,6 +218,22 @@ func (m *SessionManager) CloseSession(sessionID string) error {
 	return nil
 }
 
+// PruneSession closes an orphaned session and notifies the server of its exit
+func (m *SessionManager) PruneSession(sessionID string) error {
+	val, ok := m.sessions.LoadAndDelete(sessionID)
+	if !ok {
+		return ErrNoSession
+	}
+
+	session := val.(*TermSession)
+	session.Close()
+	atomic.AddInt32(&m.sessionCount, -1)
+	m.sendExit(session.exitMessage(-1, PtyExitReasonClosedByServer))
+
+	log.Info().Str("sessionId", sessionID).Msg("session pruned")
+	return nil
+}
+
 // CloseAllSessions closes all active sessions
 func (m *SessionManager) CloseAllSessions() {
 	m.sessions.Range(func(key, value interface{}) bool {
@@ -142,6 +247,80 @@ func (m *SessionManager) CloseAllSessions() {
 	})
 }
 
+// ExitAllSessions closes all active sessions, notifying the server of each
+func (m *SessionManager) ExitAllSessions() {
+	m.sessions.Range(func(key, value interface{}) bool {
+		sessionID := key.(string)
+		session := value.(*TermSession)
+		if _, ok := m.sessions.LoadAndDelete(sessionID); !ok {
+			return true
+		}
+		session.Close()
+		atomic.AddInt32(&m.sessionCount, -1)
+		m.sendExit(session.exitMessage(0, PtyExitReasonAgentShutdown))
+		log.Debug().Str("sessionId", sessionID).Msg("session closed during shutdown")
+		return true
+	})
+}
+
+// ListSessions returns metadata for all active sessions
+func (m *SessionManager) ListSessions() []SessionInfo {
+	sessions := make([]SessionInfo, 0, m.SessionCount())
+	m.sessions.Range(func(key, value interface{}) bool {
+		sessions = append(sessions, value.(*TermSession).Info())
+		return true
+	})
+	return sessions
+}
+
+// Stop stops the inactivity sweeper
+func (m *SessionManager) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopChan)
+	})
+}
+
+// sweepLoop periodically closes sessions that exceeded their idle timeout
+func (m *SessionManager) sweepLoop() {
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stopChan:
+			return
+		case <-ticker.C:
+			m.sweepIdleSessions()
+		}
+	}
+}
+
+// sweepIdleSessions closes every session inactive for longer than its timeout
+func (m *SessionManager) sweepIdleSessions() {
+	now := time.Now()
+
+	m.sessions.Range(func(key, value interface{}) bool {
+		session := value.(*TermSession)
+		if !session.isIdle(now) {
+			return true
+		}
+
+		if _, ok := m.sessions.LoadAndDelete(key); !ok {
+			return true
+		}
+
+		log.Info().
+			Str("sessionId", session.ID).
+			Dur("timeout", session.idleTimeout).
+			Msg("session inactive, closing")
+
+		m.sendExit(session.exitMessage(0, PtyExitReasonTimeout))
+		atomic.AddInt32(&m.sessionCount, -1)
+		session.Close()
+		return true
+	})
+}
+
 // SessionCount returns the number of active sessions
 func (m *SessionManager) SessionCount() int {
 	return int(atomic.LoadInt32(&m.sessionCount))
@@ -157,19 +336,60 @@ func (s *TermSession) Write(data []byte) error {
 	s.lastActivity = time.Now()
 	s.mu.Unlock()
 
-	_, err := s.terminal.Write(data)
+	n, err := s.terminal.Write(data)
+	atomic.AddUint64(&s.bytesIn, uint64(n))
 	return err
 }
 
-// WriteBase64 decodes and sends base64 input to the terminal
+// WriteBase64 decodes and sends base64 input to the terminal. Padded
+// standard base64 is expected, but clients using the unpadded or URL-safe
+// alphabets are accepted too rather than having their typing dropped.
 func (s *TermSession) WriteBase64(b64data string) error {
-	data, err := base64.StdEncoding.DecodeString(b64data)
+	data, encoding, err := decodeInput(b64data)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %v", ErrInputDecode, err)
+	}
+
+	s.mu.Lock()
+	changed := encoding != s.inputEncoding
+	s.inputEncoding = encoding
+	s.mu.Unlock()
+	if changed && encoding != inputEncodings[0].name {
+		log.Debug().Str("sessionId", s.ID).Str("encoding", encoding).Msg("terminal input uses alternate base64 encoding")
 	}
+
 	return s.Write(data)
 }
 
+// inputEncodings are the base64 variants accepted for terminal input, in
+// the order they are tried
+var inputEncodings = []struct {
+	name string
+	enc  *base64.Encoding
+}{
+	{"std", base64.StdEncoding},
+	{"raw-std", base64.RawStdEncoding},
+	{"url", base64.URLEncoding},
+	{"raw-url", base64.RawURLEncoding},
+}
+
+// decodeInput decodes b64data with the first of inputEncodings that
+// accepts it, returning the name of that encoding. The error is the one
+// from standard base64.
+func decodeInput(b64data string) ([]byte, string, error) {
+	var firstErr error
+	for _, e := range inputEncodings {
+		data, err := e.enc.DecodeString(b64data)
+		if err == nil {
+			return data, e.name, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, "", firstErr
+}
+
 // Resize changes the terminal window size
 func (s *TermSession) Resize(cols, rows uint16) error {
 	s.mu.Lock()
@@ -178,11 +398,50 @@ func (s *TermSession) Resize(cols, rows uint16) error {
 		return ErrNoSession
 	}
 	s.lastActivity = time.Now()
+	s.cols = cols
+	s.rows = rows
 	s.mu.Unlock()
 
 	return s.terminal.SetWinSize(cols, rows)
 }
 
+// Info returns a snapshot of the session metadata
+func (s *TermSession) Info() SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return SessionInfo{
+		SessionID:    s.ID,
+		Username:     s.Username,
+		RunAs:        s.RunAs,
+		Cols:         s.cols,
+		Rows:         s.rows,
+		CreatedAt:    s.createdAt.Format(time.RFC3339),
+		LastActivity: s.lastActivity.Format(time.RFC3339),
+		BytesIn:      atomic.LoadUint64(&s.bytesIn),
+		BytesOut:     atomic.LoadUint64(&s.bytesOut),
+	}
+}
+
+// exitMessage builds the pty_exit message for this session
+func (s *TermSession) exitMessage(code int, reason string) *PtyExitMsg {
+	return &PtyExitMsg{
+		SessionID: s.ID,
+		Code:      code,
+		BytesIn:   atomic.LoadUint64(&s.bytesIn),
+		BytesOut:  atomic.LoadUint64(&s.bytesOut),
+		Reason:    reason,
+	}
+}
+
+// isIdle reports whether the session has been inactive past its timeout
+func (s *TermSession) isIdle(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return !s.closed && now.Sub(s.lastActivity) > s.idleTimeout
+}
+
 // Close terminates the session
 func (s *TermSession) Close() {
 	s.mu.Lock()
@@ -197,6 +456,37 @@ func (s *TermSession) Close() {
 	s.terminal.Close()
 }
 
+// compressOutput deflates terminal output if the session was spawned with
+// compression and doing so saves space
+func (s *TermSession) compressOutput(data []byte) ([]byte, bool) {
+	if !s.compress {
+		return nil, false
+	}
+	return compressPtyData(data)
+}
+
+// readRetrying reads from r, retrying a read that returned nothing because
+// it was interrupted by a signal or would block. A read interrupted by a
+// signal says nothing about the shell, so only maxTransientReadErrors such
+// failures in a row are taken as the terminal being broken.
+func readRetrying(r io.Reader, buf []byte, sessionID string) (int, error) {
+	for attempt := 1; ; attempt++ {
+		n, err := r.Read(buf)
+		if err == nil || n > 0 || !transientReadError(err) || attempt > maxTransientReadErrors {
+			return n, err
+		}
+
+		log.Debug().
+			Err(err).
+			Str("sessionId", sessionID).
+			Int("attempt", attempt).
+			Msg("terminal read interrupted, retrying")
+		if errors.Is(err, syscall.EAGAIN) {
+			time.Sleep(transientReadBackoff)
+		}
+	}
+}
+
 // readLoop reads from the terminal and sends data to the server
 func (s *TermSession) readLoop() {
 	buf := make([]byte, sessionReadBufSize)
@@ -208,20 +498,36 @@ func (s *TermSession) readLoop() {
 		default:
 		}
 
-		n, err := s.terminal.Read(buf)
+		n, err := readRetrying(s.terminal, buf, s.ID)
 		if err != nil {
 			s.mu.Lock()
 			closed := s.closed
 			s.mu.Unlock()
 
 			if !closed {
-				log.Debug().
-					Err(err).
-					Str("sessionId", s.ID).
-					Msg("terminal read error, closing session")
-
-				// Notify server of session exit
-				s.manager.sendExit(s.ID, 0)
+				if shellExited(err) {
+					log.Debug().
+						Err(err).
+						Str("sessionId", s.ID).
+						Msg("shell exited, closing session")
+				} else {
+					log.Warn().
+						Err(err).
+						Str("sessionId", s.ID).
+						Msg("terminal read error, closing session")
+				}
+
+				// Notify server of session exit. Without an exit status the
+				// shell was killed or the terminal itself failed.
+				code := s.terminal.ExitCode()
+				reason := PtyExitReasonExited
+				if code < 0 {
+					reason = PtyExitReasonError
+					s.manager.sendEvent(EventCategorySession, EventSeverityWarning,
+						"terminal session ended abnormally: the shell was killed or the terminal failed",
+						map[string]any{"sessionId": s.ID, "runAs": s.RunAs})
+				}
+				s.manager.sendExit(s.exitMessage(code, reason))
 
 				// Remove from manager
 				s.manager.sessions.Delete(s.ID)
@@ -236,38 +542,13 @@ func (s *TermSession) readLoop() {
 			s.lastActivity = time.Now()
 			s.mu.Unlock()
 
-			// Send data to server
-			s.manager.sendData(s.ID, buf[:n])
-		}
-	}
-}
+			atomic.AddUint64(&s.bytesOut, uint64(n))
 
-// inactivityMonitor closes the session after inactivity timeout
-func (s *TermSession) inactivityMonitor() {
-	ticker := time.NewTicker(60 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-s.stopChan:
-			return
-		case <-ticker.C:
-			s.mu.Lock()
-			inactive := time.Since(s.lastActivity) > inactivityTimeout
-			closed := s.closed
-			s.mu.Unlock()
-
-			if inactive && !closed {
-				log.Info().
-					Str("sessionId", s.ID).
-					Dur("timeout", inactivityTimeout).
-					Msg("session inactive, closing")
-
-				s.manager.sendExit(s.ID, 0)
-				s.manager.sessions.Delete(s.ID)
-				atomic.AddInt32(&s.manager.sessionCount, -1)
-				s.Close()
-				return
+			// Send data to server
+			if compressed, ok := s.compressOutput(buf[:n]); ok {
+				s.manager.sendData(s.ID, compressed, true)
+			} else {
+				s.manager.sendData(s.ID, buf[:n], false)
 			}
 		}
 	}
@@ -0,0 +1,49 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupPanicReleasesWaiters(t *testing.T) {
+	var g flightGroup[int]
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	go func() {
+		defer func() { recover() }()
+		g.Do("key", func() (int, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	waited := make(chan error, 1)
+	go func() {
+		_, err := g.Do("key", func() (int, error) { return 0, nil })
+		waited <- err
+	}()
+
+	// Let the waiter join the in-flight call before it panics
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-waited:
+		if err != nil && !errors.Is(err, errFlightPanicked) {
+			t.Fatalf("waiter error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter blocked after the shared call panicked")
+	}
+
+	// The key is free again
+	if v, err := g.Do("key", func() (int, error) { return 7, nil }); v != 7 || err != nil {
+		t.Fatalf("Do after panic = %d, %v", v, err)
+	}
+}
@@ -0,0 +1,151 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"sync"
+	"time"
+)
+
+// Chunks received ahead of the hashed position are held until the gap is
+// filled. Beyond this many buffered bytes the transfer's hash is abandoned.
+const maxStreamHashPending = 64 * 1024 * 1024
+
+// streamHashState is the incremental SHA-256 of one opted-in streamed transfer
+type streamHashState struct {
+	path     string
+	total    int64
+	version  string
+	hasher   hash.Hash
+	next     int64            // offset of the next byte to hash
+	pending  map[int64][]byte // out-of-order chunks by offset
+	buffered int64
+	lastSeen time.Time
+}
+
+// streamHashes hashes streamed transfers that asked for a checksum, keyed by
+// the RequestID of their stream_file_info. Chunks may be served in any order;
+// they are fed to the hash in file order.
+type streamHashes struct {
+	mu        sync.Mutex
+	transfers map[string]*streamHashState
+}
+
+func newStreamHashes() *streamHashes {
+	return &streamHashes{transfers: make(map[string]*streamHashState)}
+}
+
+// start begins hashing a transfer of total bytes at the given file version
+func (h *streamHashes) start(transferID, path string, total int64, version string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for id, t := range h.transfers {
+		if now.Sub(t.lastSeen) > streamProgressIdleTTL {
+			delete(h.transfers, id)
+		}
+	}
+
+	h.transfers[transferID] = &streamHashState{
+		path:     path,
+		total:    total,
+		version:  version,
+		hasher:   sha256.New(),
+		pending:  make(map[int64][]byte),
+		lastSeen: now,
+	}
+}
+
+// served feeds a chunk read from a file at the given version. It returns the
+// stream_file_hash to send and true once every byte has been hashed, or
+// straight away with Error set when the hash can no longer be completed.
+func (h *streamHashes) served(transferID string, offset int64, chunk []byte, version string) (StreamFileHashData, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t, ok := h.transfers[transferID]
+	if !ok {
+		return StreamFileHashData{}, false
+	}
+	t.lastSeen = time.Now()
+
+	result := StreamFileHashData{RequestID: transferID, Path: t.path, Size: t.total}
+
+	if version != t.version {
+		delete(h.transfers, transferID)
+		return changedHashResult(result), true
+	}
+
+	// Chunks wholly behind the hashed position are retries
+	if end := offset + int64(len(chunk)); len(chunk) > 0 && end > t.next {
+		if offset > t.next {
+			if _, dup := t.pending[offset]; !dup {
+				t.pending[offset] = chunk
+				t.buffered += int64(len(chunk))
+			}
+		} else {
+			t.hasher.Write(chunk[t.next-offset:])
+			t.next = end
+		}
+	}
+
+	// Drain buffered chunks that now line up
+	for len(t.pending) > 0 {
+		progressed := false
+		for off, c := range t.pending {
+			end := off + int64(len(c))
+			if off > t.next {
+				continue
+			}
+			if end > t.next {
+				t.hasher.Write(c[t.next-off:])
+				t.next = end
+			}
+			delete(t.pending, off)
+			t.buffered -= int64(len(c))
+			progressed = true
+		}
+		if !progressed {
+			break
+		}
+	}
+
+	if t.next >= t.total {
+		delete(h.transfers, transferID)
+		result.Sha256 = hex.EncodeToString(t.hasher.Sum(nil))
+		return result, true
+	}
+
+	if t.buffered > maxStreamHashPending {
+		delete(h.transfers, transferID)
+		result.Error = "Too many chunks received out of order to hash the stream"
+		return result, true
+	}
+
+	return StreamFileHashData{}, false
+}
+
+// changed abandons a transfer's hash because its file was modified, returning
+// the stream_file_hash to send and whether the transfer was being hashed
+func (h *streamHashes) changed(transferID string) (StreamFileHashData, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t, ok := h.transfers[transferID]
+	if !ok {
+		return StreamFileHashData{}, false
+	}
+	delete(h.transfers, transferID)
+
+	return changedHashResult(StreamFileHashData{RequestID: transferID, Path: t.path, Size: t.total}), true
+}
+
+func changedHashResult(result StreamFileHashData) StreamFileHashData {
+	result.Error = "File changed during streaming, hash is not valid"
+	result.Changed = true
+	return result
+}
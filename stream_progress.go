@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Minimum time between progress messages for one transfer
+	streamProgressInterval = time.Second
+
+	// Transfers without chunk requests for this long are forgotten
+	streamProgressIdleTTL = 10 * time.Minute
+)
+
+// streamTransfer is the progress state of one opted-in streamed transfer
+type streamTransfer struct {
+	path     string
+	total    int64
+	served   int64
+	lastSent time.Time
+	lastSeen time.Time
+}
+
+// streamProgress tracks bytes served for streamed transfers that asked for
+// progress, keyed by the RequestID of their stream_file_info
+type streamProgress struct {
+	mu        sync.Mutex
+	transfers map[string]*streamTransfer
+}
+
+func newStreamProgress() *streamProgress {
+	return &streamProgress{transfers: make(map[string]*streamTransfer)}
+}
+
+// start begins tracking a transfer of total bytes
+func (p *streamProgress) start(transferID, path string, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for id, t := range p.transfers {
+		if now.Sub(t.lastSeen) > streamProgressIdleTTL {
+			delete(p.transfers, id)
+		}
+	}
+
+	p.transfers[transferID] = &streamTransfer{path: path, total: total, lastSeen: now}
+}
+
+// served records n bytes sent for a transfer. It returns the progress to
+// report and true when a progress message is due: at most once per
+// streamProgressInterval, and always once the transfer completes.
+func (p *streamProgress) served(transferID string, n int64) (StreamProgressData, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t, ok := p.transfers[transferID]
+	if !ok {
+		return StreamProgressData{}, false
+	}
+
+	now := time.Now()
+	t.served = min(t.served+n, t.total)
+	t.lastSeen = now
+
+	done := t.served >= t.total
+	if done {
+		delete(p.transfers, transferID)
+	} else if now.Sub(t.lastSent) < streamProgressInterval {
+		return StreamProgressData{}, false
+	}
+	t.lastSent = now
+
+	return StreamProgressData{
+		RequestID:   transferID,
+		Path:        t.path,
+		BytesServed: t.served,
+		TotalBytes:  t.total,
+		Done:        done,
+	}, true
+}
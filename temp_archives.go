@@ -0,0 +1,92 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Archives not streamed from for this long are deleted
+	archiveIdleTTL = 10 * time.Minute
+
+	// Once the last byte has been served an archive is kept this long for
+	// retried chunks, then deleted
+	archiveDoneGrace = time.Minute
+)
+
+// tempArchives tracks archives the agent created for the server to stream,
+// such as download_matching results. They live in Config.TempDir, outside
+// any path scope, so they are exempt from it; each is deleted once idle,
+// shortly after it has been read to the end, and on shutdown.
+type tempArchives struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+func newTempArchives() *tempArchives {
+	return &tempArchives{timers: make(map[string]*time.Timer)}
+}
+
+// add registers an archive created by the agent
+func (t *tempArchives) add(path string) {
+	path = filepath.Clean(path)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timers[path] = time.AfterFunc(archiveIdleTTL, func() { t.remove(path) })
+}
+
+// owns reports whether path is a registered archive
+func (t *tempArchives) owns(path string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.timers[filepath.Clean(path)]
+	return ok
+}
+
+// served notes a read of an archive, deleting it after archiveDoneGrace if
+// the read reached the end and after archiveIdleTTL otherwise
+func (t *tempArchives) served(path string, end, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	timer, ok := t.timers[filepath.Clean(path)]
+	if !ok {
+		return
+	}
+	if end >= size {
+		timer.Reset(archiveDoneGrace)
+	} else {
+		timer.Reset(archiveIdleTTL)
+	}
+}
+
+// remove deletes an archive and forgets it
+func (t *tempArchives) remove(path string) {
+	t.mu.Lock()
+	if timer, ok := t.timers[path]; ok {
+		timer.Stop()
+		delete(t.timers, path)
+	}
+	t.mu.Unlock()
+
+	os.Remove(path)
+}
+
+// removeAll deletes every registered archive, e.g. on shutdown
+func (t *tempArchives) removeAll() {
+	t.mu.Lock()
+	paths := make([]string, 0, len(t.timers))
+	for path := range t.timers {
+		paths = append(paths, path)
+	}
+	t.mu.Unlock()
+
+	for _, path := range paths {
+		t.remove(path)
+	}
+}
@@ -8,20 +8,40 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/user"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/creack/pty"
+	"github.com/rs/zerolog/log"
 )
 
+// exitCodeWait bounds how long ExitCode waits for the process to be reaped
+const exitCodeWait = time.Second
+
+// defaultShellArgs starts the shell as a login shell
+var defaultShellArgs = []string{"-l"}
+
+// ErrLoginRequiresRoot is returned when a PAM login session is requested but
+// the agent lacks the privileges to start one
+var ErrLoginRequiresRoot = errors.New("login sessions require the agent to run as root")
+
 type Terminal struct {
-	pty *os.File
-	cmd *exec.Cmd
-	mu  sync.Mutex
+	RunAs    string // user the shell runs as
+	pty      *os.File
+	cmd      *exec.Cmd
+	mu       sync.Mutex
+	exitCode int
+	done     chan struct{} // closed once the shell has been reaped
 }
 
 type winsize struct {
@@ -32,55 +52,223 @@ type winsize struct {
 }
 
 // NewTerminal creates a new PTY terminal session.
-// If username is provided, attempts to run as that user's shell.
-// Otherwise uses the current user's default shell.
-func NewTerminal(username string) (*Terminal, error) {
-	shell := os.Getenv("SHELL")
-	if shell == "" {
-		shell = "/bin/sh"
-	}
+// If opts.Username is provided the shell runs as that user, which requires
+// root; see userShellCommand. Otherwise uses the current user's default
+// shell. With opts.UsePAM the shell is started through login(1) instead
+// and opts.ShellArgs is ignored.
+func NewTerminal(opts TerminalOptions) (*Terminal, error) {
+	username := opts.Username
+	shell := terminalShell()
 
 	var cmd *exec.Cmd
+	var runAs string
 
-	if username != "" {
-		// Try to get the user's shell
-		u, err := user.Lookup(username)
-		if err == nil && u.HomeDir != "" {
-			// Use login shell for the specified user
-			cmd = exec.Command(shell, "-l")
-			cmd.Env = append(os.Environ(),
-				"HOME="+u.HomeDir,
-				"USER="+username,
-				"LOGNAME="+username,
-			)
-			cmd.Dir = u.HomeDir
-		} else {
-			cmd = exec.Command(shell, "-l")
+	if opts.UsePAM {
+		var err error
+		cmd, err = loginCommand(username)
+		if err != nil {
+			return nil, err
+		}
+		runAs = username
+		if runAs == "" {
+			runAs = currentUsername()
 		}
 	} else {
-		cmd = exec.Command(shell, "-l")
+		var err error
+		cmd, runAs, err = userShellCommand(shell, opts.ShellArgs, username, opts.AllowUserFallback)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Set TERM environment variable
-	cmd.Env = append(cmd.Env, "TERM=xterm-256color")
+	// SHELL names the shell actually started, which may be the fallback
+	cmd.Env = terminalEnv(opts.EnvPass, append(cmd.Env, "SHELL="+shell)...)
+
+	// The shell must lead a new session with the pty as its controlling
+	// terminal, or the line discipline cannot deliver SIGINT/SIGTSTP for
+	// Ctrl-C/Ctrl-Z to the foreground job and job control is disabled.
+	// pty.Start does this too; it is set here so it cannot be lost with a
+	// change of start function. Ctty 0 is the child's stdin, the pty.
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
 
 	ptmx, err := pty.Start(cmd)
 	if err != nil {
+		if ptyExhausted(err) {
+			return nil, fmt.Errorf("%w: %v", ErrNoPty, err)
+		}
 		return nil, err
 	}
 
 	t := &Terminal{
-		pty: ptmx,
-		cmd: cmd,
+		RunAs:    runAs,
+		pty:      ptmx,
+		cmd:      cmd,
+		exitCode: -1,
+		done:     make(chan struct{}),
 	}
 
+	// Reap the shell so it doesn't linger as a zombie and record its status
+	go func() {
+		defer close(t.done)
+		cmd.Wait()
+		t.mu.Lock()
+		t.exitCode = cmd.ProcessState.ExitCode()
+		t.mu.Unlock()
+	}()
+
 	return t, nil
 }
 
+// ptyExhausted reports whether err came from opening the pty master because
+// the host ran out of pseudo-terminals (or descriptors for them), as opposed
+// to starting the shell
+func ptyExhausted(err error) bool {
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) || pathErr.Op != "open" {
+		return false
+	}
+	switch pathErr.Err {
+	case syscall.ENOSPC, syscall.EAGAIN, syscall.ENXIO, syscall.EMFILE, syscall.ENFILE:
+		return true
+	}
+	return false
+}
+
+// userShellCommand prepares shell to run as username, or as the agent's
+// user if username is empty. Switching to another user requires root. If
+// the user does not exist or cannot be switched to, it fails unless
+// allowFallback, in which case the shell runs as the agent's user. It
+// returns the user the shell will actually run as.
+func userShellCommand(shell string, args []string, username string, allowFallback bool) (*exec.Cmd, string, error) {
+	cmd := exec.Command(shell, args...)
+	current := currentUsername()
+	if username == "" || username == current {
+		return cmd, current, nil
+	}
+
+	u, err := user.Lookup(username)
+	if err == nil && os.Geteuid() != 0 {
+		err = ErrUserNotPermitted
+	} else if err != nil {
+		err = fmt.Errorf("%w: %v", ErrUserNotFound, err)
+	}
+	if err != nil {
+		if !allowFallback {
+			return nil, "", fmt.Errorf("user %s: %w", username, err)
+		}
+		log.Warn().Err(err).Str("username", username).Str("runAs", current).Msg("falling back to the agent's user for terminal")
+		return cmd, current, nil
+	}
+
+	setSysProcAttr(cmd, u)
+	cmd.Env = userEnv(u)
+	cmd.Dir = u.HomeDir
+	return cmd, username, nil
+}
+
+// fallbackShell is used when $SHELL is unset or cannot be run
+const fallbackShell = "/bin/sh"
+
+// terminalShell returns $SHELL, or fallbackShell if it is unset or names
+// a file that is missing or not executable, e.g. a removed shell still
+// listed in /etc/passwd
+func terminalShell() string {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		return fallbackShell
+	}
+
+	info, err := os.Stat(shell)
+	if err == nil && (!info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0) {
+		err = errors.New("not an executable")
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("shell", shell).Str("fallback", fallbackShell).Msg("configured shell cannot be used")
+		return fallbackShell
+	}
+	return shell
+}
+
+// terminalEnv builds a shell's environment from the agent's cleanEnvKeys
+// and passthrough variables, then overrides (describing the user the shell
+// runs as) and TERM. Later entries take precedence.
+func terminalEnv(passthrough []string, overrides ...string) []string {
+	var env []string
+	for _, keys := range [][]string{cleanEnvKeys, passthrough} {
+		for _, key := range keys {
+			if value, ok := os.LookupEnv(key); ok {
+				env = append(env, key+"="+value)
+			}
+		}
+	}
+	if _, ok := os.LookupEnv("PATH"); !ok {
+		env = append(env, "PATH="+defaultCommandPath)
+	}
+	env = append(env, overrides...)
+	return append(env, "TERM=xterm-256color")
+}
+
+// currentUsername returns the agent's user name, or its uid if the user
+// database has no entry for it
+func currentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return strconv.Itoa(os.Geteuid())
+}
+
+// loginCommand runs login(1) for username (default: the agent's user). login
+// opens a PAM session, so limits and systemd user sessions apply and the
+// terminal is recorded in utmp/wtmp. -f skips authentication, as the server
+// has already authorised the session, which login only permits for root.
+func loginCommand(username string) (*exec.Cmd, error) {
+	if os.Geteuid() != 0 {
+		return nil, ErrLoginRequiresRoot
+	}
+
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		username = current.Username
+	}
+	if strings.HasPrefix(username, "-") {
+		return nil, fmt.Errorf("invalid username %q", username)
+	}
+	if _, err := user.Lookup(username); err != nil {
+		return nil, err
+	}
+
+	loginPath, err := exec.LookPath("login")
+	if err != nil {
+		return nil, fmt.Errorf("login not available: %w", err)
+	}
+
+	return exec.Command(loginPath, "-f", username), nil
+}
+
 func (t *Terminal) Read(buf []byte) (int, error) {
 	return t.pty.Read(buf)
 }
 
+// transientReadError reports whether a pty read failed only because it was
+// interrupted by a signal or found no data yet, so it can be retried
+func transientReadError(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+}
+
+// shellExited reports whether a pty read error means the other side closed:
+// EOF, or EIO once the last slave descriptor is gone on Linux
+func shellExited(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.EIO)
+}
+
 func (t *Terminal) Write(data []byte) (int, error) {
 	return t.pty.Write(data)
 }
@@ -118,3 +306,16 @@ func (t *Terminal) Close() error {
 
 	return nil
 }
+
+// ExitCode returns the shell's exit code, or -1 if it is not known
+// (still running, or terminated by a signal)
+func (t *Terminal) ExitCode() int {
+	select {
+	case <-t.done:
+	case <-time.After(exitCodeWait):
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.exitCode
+}
@@ -0,0 +1,127 @@
+//go:build !windows
+// +build !windows
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// flakyReader fails each read with the next of errs before reading data
+type flakyReader struct {
+	errs  []error
+	data  []byte
+	reads int
+}
+
+func (r *flakyReader) Read(buf []byte) (int, error) {
+	r.reads++
+	if len(r.errs) > 0 {
+		err := r.errs[0]
+		r.errs = r.errs[1:]
+		return 0, err
+	}
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(buf, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestReadRetryingSurvivesEINTR(t *testing.T) {
+	r := &flakyReader{
+		errs: []error{syscall.EINTR, syscall.EINTR, syscall.EAGAIN},
+		data: []byte("prompt$ "),
+	}
+	buf := make([]byte, 64)
+
+	n, err := readRetrying(r, buf, "s1")
+	if err != nil || string(buf[:n]) != "prompt$ " {
+		t.Fatalf("read = %q, %v; want the data after the interruptions", buf[:n], err)
+	}
+	if r.reads != 4 {
+		t.Fatalf("made %d reads, want 4", r.reads)
+	}
+
+	// EOF still ends the session
+	if _, err := readRetrying(r, buf, "s1"); !shellExited(err) {
+		t.Fatalf("read after the data = %v, want a shell exit", err)
+	}
+}
+
+func TestReadRetryingGivesUp(t *testing.T) {
+	errs := make([]error, maxTransientReadErrors+5)
+	for i := range errs {
+		errs[i] = syscall.EINTR
+	}
+	r := &flakyReader{errs: errs}
+
+	_, err := readRetrying(r, make([]byte, 64), "s1")
+	if !errors.Is(err, syscall.EINTR) {
+		t.Fatalf("err = %v, want EINTR once retries run out", err)
+	}
+	if r.reads != maxTransientReadErrors+1 {
+		t.Fatalf("made %d reads, want %d", r.reads, maxTransientReadErrors+1)
+	}
+}
+
+func TestTerminalShellFallsBack(t *testing.T) {
+	dir := t.TempDir()
+	notExecutable := filepath.Join(dir, "zsh")
+	if err := os.WriteFile(notExecutable, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	executable := filepath.Join(dir, "fish")
+	if err := os.WriteFile(executable, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		shell string
+		want  string
+	}{
+		{"unset", "", fallbackShell},
+		{"missing", filepath.Join(dir, "removed-shell"), fallbackShell},
+		{"directory", dir, fallbackShell},
+		{"not executable", notExecutable, fallbackShell},
+		{"usable", executable, executable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SHELL", tt.shell)
+			if got := terminalShell(); got != tt.want {
+				t.Errorf("terminalShell() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPtyExhaustedOnlyMatchesMasterOpen(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"no devices", &os.PathError{Op: "open", Path: "/dev/ptmx", Err: syscall.ENOSPC}, true},
+		{"busy", &os.PathError{Op: "open", Path: "/dev/ptmx", Err: syscall.EAGAIN}, true},
+		{"process fd limit", &os.PathError{Op: "open", Path: "/dev/ptmx", Err: syscall.EMFILE}, true},
+		{"system fd limit", &os.PathError{Op: "open", Path: "/dev/ptmx", Err: syscall.ENFILE}, true},
+		{"permission", &os.PathError{Op: "open", Path: "/dev/ptmx", Err: syscall.EACCES}, false},
+		{"shell missing", &os.PathError{Op: "fork/exec", Path: "/bin/zsh", Err: syscall.ENOENT}, false},
+		{"plain", syscall.EAGAIN, false},
+	}
+	for _, tt := range tests {
+		if got := ptyExhausted(tt.err); got != tt.want {
+			t.Errorf("%s: ptyExhausted(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
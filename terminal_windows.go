@@ -9,41 +9,83 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"os/user"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	conpty "github.com/qsocket/conpty-go"
+	"github.com/rs/zerolog/log"
 )
 
+// exitCodeWait bounds how long ExitCode waits for the process to be reaped
+const exitCodeWait = time.Second
+
+// defaultShellArgs is empty: neither cmd.exe nor PowerShell needs flags
+var defaultShellArgs []string
+
 type Terminal struct {
-	pty       *conpty.ConPty
-	mu        sync.Mutex
-	closeOnce sync.Once
-	closed    bool
+	RunAs      string // user the shell runs as
+	pty        *conpty.ConPty
+	mu         sync.Mutex
+	closeOnce  sync.Once
+	closed     bool
+	exitCode   int
+	done       chan struct{} // closed once the Wait goroutine returns
+	cancelWait context.CancelFunc
 }
 
 // NewTerminal creates a new ConPTY terminal session on Windows.
-// The username parameter is currently ignored on Windows.
-func NewTerminal(username string) (*Terminal, error) {
+// opts.UsePAM is ignored. The shell always runs as the agent's user, so a
+// different opts.Username is refused unless opts.AllowUserFallback.
+func NewTerminal(opts TerminalOptions) (*Terminal, error) {
+	runAs := currentUsername()
+	if opts.Username != "" && !strings.EqualFold(opts.Username, runAs) {
+		if !opts.AllowUserFallback {
+			return nil, fmt.Errorf("user %s: %w", opts.Username, ErrUserNotPermitted)
+		}
+		log.Warn().Str("username", opts.Username).Str("runAs", runAs).Msg("falling back to the agent's user for terminal")
+	}
+
 	// Use PowerShell if available, otherwise cmd.exe
 	shell := "cmd.exe"
 	if _, err := os.Stat(`C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`); err == nil {
 		shell = "powershell.exe"
 	}
 
-	pty, err := conpty.Start(shell)
+	cmdLine := []string{shell}
+	for _, arg := range opts.ShellArgs {
+		cmdLine = append(cmdLine, syscall.EscapeArg(arg))
+	}
+
+	pty, err := conpty.Start(strings.Join(cmdLine, " "))
 	if err != nil {
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+
 	t := &Terminal{
-		pty: pty,
+		RunAs:      runAs,
+		pty:        pty,
+		exitCode:   -1,
+		done:       make(chan struct{}),
+		cancelWait: cancel,
 	}
 
-	// Monitor for process exit
+	// Monitor for process exit; cancelled on Close so it never outlives us
 	go func() {
-		pty.Wait(context.Background())
+		defer close(t.done)
+		code, err := pty.Wait(ctx)
 		t.mu.Lock()
+		if err == nil {
+			t.exitCode = int(code)
+		}
 		t.closed = true
 		t.mu.Unlock()
 	}()
@@ -55,6 +97,17 @@ func (t *Terminal) Read(buf []byte) (int, error) {
 	return t.pty.Read(buf)
 }
 
+// transientReadError reports whether a read can be retried. ConPTY pipes are
+// not interrupted by signals.
+func transientReadError(err error) bool {
+	return false
+}
+
+// shellExited reports whether a read error means the console closed
+func shellExited(err error) bool {
+	return errors.Is(err, io.EOF)
+}
+
 func (t *Terminal) Write(data []byte) (int, error) {
 	return t.pty.Write(data)
 }
@@ -69,6 +122,7 @@ func (t *Terminal) Close() error {
 		t.closed = true
 		t.mu.Unlock()
 		t.pty.Close()
+		t.cancelWait()
 	})
 	return nil
 }
@@ -78,3 +132,23 @@ func (t *Terminal) IsClosed() bool {
 	defer t.mu.Unlock()
 	return t.closed
 }
+
+// ExitCode returns the shell's exit code, or -1 if it is not known
+func (t *Terminal) ExitCode() int {
+	select {
+	case <-t.done:
+	case <-time.After(exitCodeWait):
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.exitCode
+}
+
+// currentUsername returns the agent's user name (DOMAIN\user)
+func currentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
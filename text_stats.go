@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"unicode/utf8"
+)
+
+// Encodings reported by file quick stats
+const (
+	EncodingUTF8   = "utf-8"
+	EncodingLatin1 = "latin-1"
+	EncodingBinary = "binary"
+)
+
+// Line ending styles reported by file quick stats
+const (
+	LineEndingLF    = "lf"
+	LineEndingCRLF  = "crlf"
+	LineEndingMixed = "mixed"
+)
+
+// textStats summarises a file's text layout
+type textStats struct {
+	Lines           int64
+	EndsWithNewline bool
+	Encoding        string
+	LineEnding      string // "" if the file has no line breaks
+}
+
+// scanTextStats reads r in fixed-size chunks so memory stays bounded
+// regardless of file size. Scanning stops early once the content is
+// found to be binary, since line information is meaningless then.
+func scanTextStats(r io.Reader) (textStats, error) {
+	var (
+		stats = textStats{Encoding: EncodingUTF8}
+		lf    int64
+		crlf  int64
+		prev  byte
+		carry []byte // incomplete UTF-8 sequence split across reads
+		buf   = make([]byte, 64*1024)
+	)
+
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			chunk := buf[:n]
+
+			if bytes.IndexByte(chunk, 0) >= 0 {
+				return textStats{Encoding: EncodingBinary}, nil
+			}
+
+			for i, b := range chunk {
+				if b == '\n' {
+					if i > 0 && chunk[i-1] == '\r' || i == 0 && prev == '\r' {
+						crlf++
+					} else {
+						lf++
+					}
+				}
+			}
+			prev = chunk[n-1]
+
+			if stats.Encoding == EncodingUTF8 {
+				carry = validUTF8Prefix(append(carry, chunk...))
+				if carry == nil {
+					stats.Encoding = EncodingLatin1
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return textStats{}, err
+		}
+	}
+
+	// A sequence still pending at EOF is truncated, so not valid UTF-8
+	if len(carry) > 0 {
+		stats.Encoding = EncodingLatin1
+	}
+
+	stats.Lines = lf + crlf
+	stats.EndsWithNewline = prev == '\n'
+
+	switch {
+	case lf > 0 && crlf > 0:
+		stats.LineEnding = LineEndingMixed
+	case crlf > 0:
+		stats.LineEnding = LineEndingCRLF
+	case lf > 0:
+		stats.LineEnding = LineEndingLF
+	}
+
+	return stats, nil
+}
+
+// validUTF8Prefix checks p and returns its trailing incomplete sequence
+// (possibly empty), or nil if p contains invalid UTF-8
+func validUTF8Prefix(p []byte) []byte {
+	for len(p) > 0 {
+		if !utf8.FullRune(p) {
+			return append([]byte{}, p...)
+		}
+		r, size := utf8.DecodeRune(p)
+		if r == utf8.RuneError && size == 1 {
+			return nil
+		}
+		p = p[size:]
+	}
+	return []byte{}
+}
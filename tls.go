@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// caCertEnv names the environment variable used as the default CA bundle path
+const caCertEnv = "TERMIX_CA_CERT"
+
+// ErrFingerprintChanged is returned when the server certificate differs from
+// the one recorded at enrollment
+var ErrFingerprintChanged = errors.New("server certificate changed since enrollment")
+
+// TLSOptions controls how the server certificate is verified
+type TLSOptions struct {
+	Insecure         bool   // Skip TLS certificate verification
+	CACertPath       string // PEM bundle of additional trusted CAs
+	PinnedCertSHA256 string // Expected SHA-256 of the server leaf certificate (hex)
+
+	// Fingerprint recorded at enrollment (trust on first use), enforced only
+	// with VerifyFingerprint. Unlike a pin it can be replaced by connecting
+	// once with AcceptFingerprint set.
+	TrustedFingerprint string
+	VerifyFingerprint  bool
+	AcceptFingerprint  bool
+}
+
+// buildTLSConfig creates the client TLS configuration shared by enrollment
+// and the agent connection
+func buildTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: opts.Insecure,
+	}
+
+	if opts.CACertPath != "" {
+		pem, err := os.ReadFile(opts.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", opts.CACertPath)
+		}
+		cfg.RootCAs = pool
+	}
+
+	pin := normalizeFingerprint(opts.PinnedCertSHA256)
+	if pin != "" && len(pin) != sha256.Size*2 {
+		return nil, fmt.Errorf("invalid pinned certificate fingerprint %q", opts.PinnedCertSHA256)
+	}
+
+	trusted := ""
+	if opts.VerifyFingerprint && !opts.AcceptFingerprint {
+		trusted = normalizeFingerprint(opts.TrustedFingerprint)
+	}
+
+	if pin != "" || trusted != "" {
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("server presented no certificate")
+			}
+			got := certFingerprint(state.PeerCertificates[0])
+			if pin != "" && got != pin {
+				return fmt.Errorf("server certificate fingerprint %s does not match pinned %s", got, pin)
+			}
+			if trusted != "" && got != trusted {
+				return fmt.Errorf("%w: server presented %s, expected %s (possible man-in-the-middle)",
+					ErrFingerprintChanged, got, trusted)
+			}
+			return nil
+		}
+	}
+
+	return cfg, nil
+}
+
+// peerFingerprint returns the fingerprint of the certificate presented on a
+// TLS WebSocket connection, or "" for plain connections
+func peerFingerprint(conn *websocket.Conn) string {
+	tlsConn, ok := conn.UnderlyingConn().(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return certFingerprint(state.PeerCertificates[0])
+}
+
+// certFingerprint returns the lowercase hex SHA-256 of a certificate
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint accepts fingerprints with colons and any case
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fp), ":", ""))
+}
@@ -0,0 +1,412 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Uploads without a chunk or resume for this long are discarded along with
+// their temp file
+const uploadIdleTimeout = 15 * time.Minute
+
+// upload is an in-progress chunked upload. Chunks are appended to a temp
+// file next to the target, which is renamed into place on commit.
+type upload struct {
+	mu      sync.Mutex
+	path    string // final location
+	tmpPath string
+	tmp     *os.File
+	size    int64 // total size announced by upload_begin
+	offset  int64 // bytes written so far
+	owner   *fileOwner
+	timer   *time.Timer // fires after uploadIdleTimeout without activity
+	done    bool        // committed or discarded
+}
+
+// uploads tracks chunked uploads by the RequestID of their upload_begin
+type uploads struct {
+	mu      sync.Mutex
+	entries map[string]*upload
+}
+
+func newUploads() *uploads {
+	return &uploads{entries: make(map[string]*upload)}
+}
+
+func (u *uploads) get(id string) *upload {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.entries[id]
+}
+
+// remove forgets an upload and deletes its temp file. The caller must hold
+// the upload's lock.
+func (u *uploads) remove(id string, up *upload) {
+	u.mu.Lock()
+	if u.entries[id] == up {
+		delete(u.entries, id)
+	}
+	u.mu.Unlock()
+
+	up.done = true
+	up.timer.Stop()
+	if up.tmp != nil {
+		up.tmp.Close()
+		os.Remove(up.tmpPath)
+	}
+}
+
+// expire discards an upload that has been idle for uploadIdleTimeout
+func (u *uploads) expire(id string, up *upload) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.done {
+		return
+	}
+
+	log.Info().Str("requestId", id).Str("path", up.path).Msg("discarding abandoned upload")
+	u.remove(id, up)
+}
+
+// discardAll removes every in-progress upload, e.g. on shutdown
+func (u *uploads) discardAll() {
+	u.mu.Lock()
+	ids := make(map[string]*upload, len(u.entries))
+	for id, up := range u.entries {
+		ids[id] = up
+	}
+	u.mu.Unlock()
+
+	for id, up := range ids {
+		up.mu.Lock()
+		if !up.done {
+			u.remove(id, up)
+		}
+		up.mu.Unlock()
+	}
+}
+
+// sweepStale deletes temp files left in dir by uploads that are no longer
+// tracked, e.g. because the agent crashed or was killed mid-upload. Files
+// touched within uploadIdleTimeout are kept in case another process owns
+// them.
+func (u *uploads) sweepStale(dir string) {
+	entries, err := os.ReadDir(longPath(dir))
+	if err != nil {
+		return
+	}
+
+	u.mu.Lock()
+	active := make(map[string]bool, len(u.entries))
+	for _, up := range u.entries {
+		active[up.tmpPath] = true
+	}
+	u.mu.Unlock()
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, ".") || !strings.Contains(name, ".upload-") || !entry.Type().IsRegular() {
+			continue
+		}
+		path := filepath.Join(longPath(dir), name)
+		if active[path] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < uploadIdleTimeout {
+			continue
+		}
+		if err := os.Remove(path); err == nil {
+			log.Info().Str("path", path).Msg("removed stale upload temp file")
+		}
+	}
+}
+
+// startedFiles remembers files that upload_file created, so that a file
+// assembled from writeAt uploads can be removed if it then grows past
+// Config.MaxUploadBytes rather than left behind half written. A file is
+// forgotten after uploadIdleTimeout without a write.
+type startedFiles struct {
+	mu      sync.Mutex
+	written map[string]time.Time // path -> last write
+}
+
+func newStartedFiles() *startedFiles {
+	return &startedFiles{written: make(map[string]time.Time)}
+}
+
+// add records a file created by an upload
+func (s *startedFiles) add(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for p, at := range s.written {
+		if now.Sub(at) > uploadIdleTimeout {
+			delete(s.written, p)
+		}
+	}
+	s.written[filepath.Clean(path)] = now
+}
+
+// touch notes a further write to path if an upload created it
+func (s *startedFiles) touch(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path = filepath.Clean(path)
+	if _, ok := s.written[path]; ok {
+		s.written[path] = time.Now()
+	}
+}
+
+// take forgets path, reporting whether an upload created it recently
+func (s *startedFiles) take(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path = filepath.Clean(path)
+	at, ok := s.written[path]
+	delete(s.written, path)
+	return ok && time.Since(at) <= uploadIdleTimeout
+}
+
+// sendUploadAck reports the bytes an upload has received so far
+func (f *FileOps) sendUploadAck(requestID string, offset int64, resumed bool, errMsg string) {
+	f.sendResult(MsgTypeUploadAck, UploadAckData{
+		RequestID: requestID,
+		Offset:    offset,
+		Resumed:   resumed,
+		Error:     errMsg,
+	})
+}
+
+// UploadBegin starts a chunked upload, or resumes the one with the same
+// RequestID from the last offset written
+func (f *FileOps) UploadBegin(data *UploadBeginData) {
+	log.Debug().
+		Str("path", data.Path).
+		Str("fileName", data.FileName).
+		Int64("size", data.Size).
+		Msg("beginning chunked upload")
+
+	if data.RequestID == "" {
+		f.sendError(data.RequestID, 400, "A request ID is required for chunked uploads")
+		return
+	}
+	if data.Size < 0 {
+		f.sendError(data.RequestID, 400, "Size must not be negative")
+		return
+	}
+
+	fullPath := filepath.Join(data.Path, data.FileName)
+
+	if f.resumeUpload(data.RequestID, fullPath, data.Size) {
+		return
+	}
+
+	owner, ok := f.resolveOwner(data.RequestID, data.AsUser)
+	if !ok {
+		return
+	}
+	if !f.checkUploadSize(data.RequestID, data.Size) {
+		return
+	}
+	if !f.checkFreeSpace(data.RequestID, fullPath, data.Size) {
+		return
+	}
+
+	f.uploads.sweepStale(filepath.Dir(fullPath))
+
+	// Created next to the target so the commit is a same-filesystem rename
+	tmp, err := os.CreateTemp(filepath.Dir(longPath(fullPath)), "."+filepath.Base(fullPath)+".upload-*")
+	if err != nil {
+		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to create temp file: %v", err))
+		return
+	}
+	if err := tmp.Chmod(f.perm(0644)); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to create temp file: %v", err))
+		return
+	}
+
+	up := &upload{
+		path:    fullPath,
+		tmpPath: tmp.Name(),
+		tmp:     tmp,
+		size:    data.Size,
+		owner:   owner,
+	}
+	up.timer = time.AfterFunc(uploadIdleTimeout, func() { f.uploads.expire(data.RequestID, up) })
+
+	f.uploads.mu.Lock()
+	if prev := f.uploads.entries[data.RequestID]; prev != nil && prev != up {
+		// A concurrent begin for the same ID won; keep that one
+		f.uploads.mu.Unlock()
+		up.mu.Lock()
+		f.uploads.remove(data.RequestID, up)
+		up.mu.Unlock()
+		f.sendError(data.RequestID, 409, "An upload with this request ID is already starting")
+		return
+	}
+	f.uploads.entries[data.RequestID] = up
+	f.uploads.mu.Unlock()
+
+	f.sendUploadAck(data.RequestID, 0, false, "")
+}
+
+// resumeUpload answers an upload_begin for an upload that is already in
+// progress. It returns false if there is none to resume.
+func (f *FileOps) resumeUpload(requestID, fullPath string, size int64) bool {
+	up := f.uploads.get(requestID)
+	if up == nil {
+		return false
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.done {
+		return false
+	}
+
+	if up.path != fullPath || up.size != size {
+		f.sendError(requestID, 409, "An upload with this request ID is in progress for a different file")
+		return true
+	}
+	up.timer.Reset(uploadIdleTimeout)
+
+	log.Info().Str("requestId", requestID).Int64("offset", up.offset).Msg("resuming chunked upload")
+	f.sendUploadAck(requestID, up.offset, true, "")
+	return true
+}
+
+// UploadChunk appends a chunk to an upload. Chunks must arrive in order and
+// are run one at a time per upload, see Agent.handleUploadChunk; a chunk that
+// was already written is acknowledged again without rewriting it, and one past
+// the current offset is answered with the offset to resume from.
+func (f *FileOps) UploadChunk(data *UploadChunkData) {
+	log.Debug().
+		Str("requestId", data.RequestID).
+		Int64("offset", data.Offset).
+		Msg("upload chunk")
+
+	up := f.uploads.get(data.RequestID)
+	if up == nil {
+		f.sendError(data.RequestID, 404, "No upload in progress for this request ID")
+		return
+	}
+
+	if !f.checkUploadSize(data.RequestID, data.Offset+int64(base64.StdEncoding.DecodedLen(len(data.Content)))) {
+		return
+	}
+
+	content, err := base64.StdEncoding.DecodeString(data.Content)
+	if err != nil {
+		f.sendError(data.RequestID, 400, fmt.Sprintf("Invalid base64 content: %v", err))
+		return
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.done {
+		f.sendError(data.RequestID, 404, "No upload in progress for this request ID")
+		return
+	}
+	up.timer.Reset(uploadIdleTimeout)
+
+	if data.Offset < 0 || data.Offset > up.offset {
+		f.sendUploadAck(data.RequestID, up.offset, false, fmt.Sprintf("Expected chunk at offset %d", up.offset))
+		return
+	}
+
+	// Skip the part of a retransmitted chunk that is already written
+	end := data.Offset + int64(len(content))
+	if end <= up.offset {
+		f.sendUploadAck(data.RequestID, up.offset, false, "")
+		return
+	}
+	if end > up.size {
+		f.sendError(data.RequestID, 400, fmt.Sprintf("Chunk ends at %d, past the announced size of %d", end, up.size))
+		return
+	}
+
+	if _, err := up.tmp.WriteAt(content[up.offset-data.Offset:], up.offset); err != nil {
+		// Drop any partial write so the offset stays accurate for a resume
+		up.tmp.Truncate(up.offset)
+		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to write file: %v", err))
+		return
+	}
+	up.offset = end
+
+	f.sendUploadAck(data.RequestID, up.offset, false, "")
+}
+
+// UploadCommit moves a completely received upload into place
+func (f *FileOps) UploadCommit(data *UploadCommitData) {
+	log.Debug().Str("requestId", data.RequestID).Msg("committing chunked upload")
+
+	up := f.uploads.get(data.RequestID)
+	if up == nil {
+		// A retried commit gets the original result
+		if cached := f.completed.lookup(data.RequestID); cached != nil {
+			f.sendResult(cached.msgType, cached.data)
+			return
+		}
+		f.sendError(data.RequestID, 404, "No upload in progress for this request ID")
+		return
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.done {
+		f.sendError(data.RequestID, 404, "No upload in progress for this request ID")
+		return
+	}
+	if up.offset != up.size {
+		f.sendError(data.RequestID, 409, fmt.Sprintf("Upload incomplete: received %d of %d bytes", up.offset, up.size))
+		return
+	}
+
+	err := up.tmp.Sync()
+	if closeErr := up.tmp.Close(); err == nil {
+		err = closeErr
+	}
+	up.tmp = nil
+	if err == nil {
+		err = os.Rename(up.tmpPath, longPath(up.path))
+	}
+	if err != nil {
+		os.Remove(up.tmpPath)
+		f.uploads.remove(data.RequestID, up)
+		f.sendError(data.RequestID, 500, fmt.Sprintf("Failed to write file: %v", err))
+		return
+	}
+	f.uploads.remove(data.RequestID, up)
+
+	// Only a successful commit is remembered; earlier errors must not be
+	// replayed to a commit retried after the missing chunks arrive
+	f.completed.begin(data.RequestID)
+
+	if !f.chownCreated(data.RequestID, up.path, up.owner) {
+		return
+	}
+
+	f.sendOpResult(data.RequestID, true, "File uploaded successfully", "")
+}
+
+// Cleanup removes the temp files of unfinished uploads and the archives
+// still waiting to be streamed
+func (f *FileOps) Cleanup() {
+	f.uploads.discardAll()
+	f.archives.removeAll()
+}
@@ -0,0 +1,235 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sentMessage is a response captured by newTestFileOps
+type sentMessage struct {
+	msgType string
+	data    interface{}
+}
+
+// sentLog collects the responses a FileOps sends
+type sentLog struct {
+	mu   sync.Mutex
+	msgs []sentMessage
+}
+
+func (l *sentLog) send(msgType string, data interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, sentMessage{msgType, data})
+}
+
+// last returns the most recent response, failing the test if there is none
+func (l *sentLog) last(t *testing.T) sentMessage {
+	t.Helper()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.msgs) == 0 {
+		t.Fatal("no response sent")
+	}
+	return l.msgs[len(l.msgs)-1]
+}
+
+func newTestFileOps(t *testing.T) (*FileOps, *sentLog) {
+	t.Helper()
+	sent := &sentLog{}
+	f := NewFileOps(&Config{}, sent.send)
+	t.Cleanup(f.Cleanup)
+	return f, sent
+}
+
+// expectAck checks that the last response is an upload_ack at offset
+func expectAck(t *testing.T, sent *sentLog, offset int64, resumed, wantErr bool) {
+	t.Helper()
+	msg := sent.last(t)
+	ack, ok := msg.data.(UploadAckData)
+	if !ok {
+		t.Fatalf("response = %s %+v, want upload_ack", msg.msgType, msg.data)
+	}
+	if ack.Offset != offset || ack.Resumed != resumed || (ack.Error != "") != wantErr {
+		t.Fatalf("ack = %+v, want offset %d resumed %v error %v", ack, offset, resumed, wantErr)
+	}
+}
+
+func chunk(id string, offset int64, content string) *UploadChunkData {
+	return &UploadChunkData{
+		RequestID: id,
+		Offset:    offset,
+		Content:   base64.StdEncoding.EncodeToString([]byte(content)),
+	}
+}
+
+func TestChunkedUploadResumeAndCommit(t *testing.T) {
+	f, sent := newTestFileOps(t)
+	dir := t.TempDir()
+	begin := &UploadBeginData{RequestID: "up-1", Path: dir, FileName: "out.txt", Size: 11}
+
+	f.UploadBegin(begin)
+	expectAck(t, sent, 0, false, false)
+
+	f.UploadChunk(chunk("up-1", 0, "hello"))
+	expectAck(t, sent, 5, false, false)
+
+	// A chunk past the received bytes is answered with where to resume
+	f.UploadChunk(chunk("up-1", 8, "rld"))
+	expectAck(t, sent, 5, false, true)
+
+	// A retransmitted chunk is acknowledged without being written again
+	f.UploadChunk(chunk("up-1", 0, "hello"))
+	expectAck(t, sent, 5, false, false)
+
+	// A repeated upload_begin resumes from the last offset
+	f.UploadBegin(begin)
+	expectAck(t, sent, 5, true, false)
+
+	f.UploadCommit(&UploadCommitData{RequestID: "up-1"})
+	if msg := sent.last(t); msg.msgType != MsgTypeFileError {
+		t.Fatalf("commit of an incomplete upload sent %s, want file_error", msg.msgType)
+	}
+
+	// Overlapping chunks only write the new part
+	f.UploadChunk(chunk("up-1", 3, "lo world"))
+	expectAck(t, sent, 11, false, false)
+
+	f.UploadCommit(&UploadCommitData{RequestID: "up-1"})
+	if result, ok := sent.last(t).data.(FileOpResultData); !ok || !result.Success {
+		t.Fatalf("commit result = %+v", sent.last(t).data)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("file = %q, want %q", got, "hello world")
+	}
+
+	// No temp files are left next to the target
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("directory holds %d entries, want 1", len(entries))
+	}
+}
+
+func TestSerialQueueRunsInJoinOrder(t *testing.T) {
+	var q serialQueue
+	const turns = 5
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+
+	// Turns are joined in order but start in reverse
+	waits := make([]func(), turns)
+	leaves := make([]func(), turns)
+	for i := range turns {
+		waits[i], leaves[i] = q.join("upload")
+	}
+	for i := turns - 1; i >= 0; i-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer leaves[i]()
+			waits[i]()
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		}()
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("turns ran in order %v", order)
+		}
+	}
+	if len(q.tails) != 0 {
+		t.Fatalf("queue still tracks %d keys", len(q.tails))
+	}
+}
+
+func TestUploadBeginSweepsStaleTempFiles(t *testing.T) {
+	f, sent := newTestFileOps(t)
+	dir := t.TempDir()
+
+	stale := filepath.Join(dir, ".old.bin.upload-123")
+	fresh := filepath.Join(dir, ".new.bin.upload-456")
+	other := filepath.Join(dir, ".keep")
+	for _, path := range []string{stale, fresh, other} {
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * uploadIdleTimeout)
+	for _, path := range []string{stale, other} {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.UploadBegin(&UploadBeginData{RequestID: "up-2", Path: dir, FileName: "data.bin", Size: 1})
+	expectAck(t, sent, 0, false, false)
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale temp file was not removed: %v", err)
+	}
+	for _, path := range []string{fresh, other} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was removed: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestWriteAtOverLimitRemovesStartedFile(t *testing.T) {
+	f, sent := newTestFileOps(t)
+	f.config.MaxUploadBytes = 8
+	dir := t.TempDir()
+
+	upload := func(name string, writeAt bool, offset int64, content string) {
+		f.UploadFile(&UploadFileData{
+			RequestID: name + content,
+			Path:      dir,
+			FileName:  name,
+			Content:   base64.StdEncoding.EncodeToString([]byte(content)),
+			WriteAt:   writeAt,
+			Offset:    offset,
+		})
+	}
+	expectCode := func(code int) {
+		t.Helper()
+		if e, ok := sent.last(t).data.(FileErrorData); !ok || e.Code != code {
+			t.Fatalf("response = %+v, want a %d file_error", sent.last(t).data, code)
+		}
+	}
+
+	// A file the upload created is removed once it outgrows the limit
+	upload("new.bin", false, 0, "abcd")
+	upload("new.bin", true, 4, "ef")
+	upload("new.bin", true, 6, "ghij")
+	expectCode(413)
+	if _, err := os.Stat(filepath.Join(dir, "new.bin")); !os.IsNotExist(err) {
+		t.Errorf("partial upload was not removed: %v", err)
+	}
+
+	// An existing file is only refused
+	existing := filepath.Join(dir, "old.bin")
+	if err := os.WriteFile(existing, []byte("abcd"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	upload("old.bin", true, 4, "efghij")
+	expectCode(413)
+	if got, err := os.ReadFile(existing); err != nil || string(got) != "abcd" {
+		t.Errorf("existing file = %q, %v; want it unchanged", got, err)
+	}
+}
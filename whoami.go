@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+)
+
+// whoAmI gathers the identity of the agent process. Lookup failures are
+// reported in Error with the numeric IDs filled in as far as known.
+func whoAmI() WhoAmIResultData {
+	var result WhoAmIResultData
+
+	u, err := user.Current()
+	if err != nil {
+		result.Error = err.Error()
+		result.UID = strconv.Itoa(os.Getuid())
+		result.GID = strconv.Itoa(os.Getgid())
+	} else {
+		result.Username = u.Username
+		result.UID = u.Uid
+		result.GID = u.Gid
+		result.HomeDir = u.HomeDir
+	}
+
+	// Both are -1 on Windows, where there is no setuid
+	if euid := os.Geteuid(); euid != os.Getuid() {
+		result.EffectiveUID = &euid
+	}
+	if egid := os.Getegid(); egid != os.Getgid() {
+		result.EffectiveGID = &egid
+	}
+
+	result.Groups = groupNames(u)
+	result.Shell = os.Getenv("SHELL")
+	if result.Shell == "" && runtime.GOOS == "windows" {
+		result.Shell = os.Getenv("ComSpec")
+	}
+	return result
+}
+
+// groupNames returns the process's supplementary groups by name. Windows
+// has no process group list, so the user's groups are used there.
+func groupNames(u *user.User) []string {
+	var ids []string
+	if gids, err := os.Getgroups(); err == nil {
+		for _, gid := range gids {
+			ids = append(ids, strconv.Itoa(gid))
+		}
+	} else if u != nil {
+		ids, _ = u.GroupIds()
+	}
+
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if g, err := user.LookupGroupId(id); err == nil {
+			names = append(names, g.Name)
+		} else {
+			names = append(names, id)
+		}
+	}
+	return names
+}
@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"syscall"
+)
+
+const (
+	maxXattrs         = 64       // attributes returned per item
+	maxXattrValueSize = 4 * 1024 // larger values are omitted
+	selinuxXattr      = "security.selinux"
+)
+
+// readXattrs returns an item's extended attributes (values base64 encoded)
+// and its SELinux context, if any. Errors such as ENOTSUP are treated as
+// the item having no attributes.
+func readXattrs(path string) (map[string]string, string) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size <= 0 {
+		return nil, ""
+	}
+	names := make([]byte, size)
+	size, err = syscall.Listxattr(path, names)
+	if err != nil {
+		return nil, ""
+	}
+
+	attrs := make(map[string]string)
+	context := ""
+	value := make([]byte, maxXattrValueSize)
+
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		if len(attrs) >= maxXattrs {
+			break
+		}
+
+		n, err := syscall.Getxattr(path, string(name), value)
+		if err != nil {
+			// ERANGE: value exceeds maxXattrValueSize
+			continue
+		}
+
+		attrs[string(name)] = base64.StdEncoding.EncodeToString(value[:n])
+		if string(name) == selinuxXattr {
+			context = string(bytes.TrimRight(value[:n], "\x00"))
+		}
+	}
+
+	if len(attrs) == 0 {
+		return nil, context
+	}
+	return attrs, context
+}
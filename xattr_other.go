@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+// SPDX-License-Identifier: MIT
+
+package main
+
+// readXattrs is not supported on this platform
+func readXattrs(path string) (map[string]string, string) {
+	return nil, ""
+}